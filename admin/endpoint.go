@@ -0,0 +1,58 @@
+package admin
+
+import (
+	"context"
+	"time"
+
+	errs "github.com/bnelz/gokit-base/errors"
+	hb "github.com/bnelz/gokit-base/logger"
+	"github.com/go-kit/kit/endpoint"
+)
+
+// logLevelsRequest has no parameters, but we still generate an empty struct to represent it
+type logLevelsRequest struct{}
+
+// logLevelsResponse represents an HTTP response listing the effective log level of every component
+type logLevelsResponse struct {
+	Levels []hb.ComponentLevel `json:"levels,omitempty"`
+	Error  error               `json:"error,omitempty"`
+}
+
+// error is the logLevelsResponse errorer implementation
+func (r logLevelsResponse) error() error { return r.Error }
+
+// makeLogLevelsEndpoint returns a go-kit endpoint listing the current log levels
+func makeLogLevelsEndpoint(levels *hb.Levels) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		return logLevelsResponse{Levels: levels.Snapshot()}, nil
+	}
+}
+
+// setLogLevelRequest represents an HTTP request changing the log level of a component, optionally for a limited time
+type setLogLevelRequest struct {
+	Component string `json:"component"`
+	Level     string `json:"level"`
+	TTL       string `json:"ttl,omitempty"`
+}
+
+// makeSetLogLevelEndpoint returns a go-kit endpoint changing the log level of a component
+func makeSetLogLevelEndpoint(levels *hb.Levels) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(*setLogLevelRequest)
+
+		level, err := hb.ParseLogLevel(req.Level)
+		if err != nil {
+			return logLevelsResponse{Error: errs.ErrInvalidArgument.Wrap(err)}, nil
+		}
+
+		var ttl time.Duration
+		if req.TTL != "" {
+			if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl < 0 {
+				return logLevelsResponse{Error: errs.ErrInvalidArgument.WithDetail("ttl must be a positive duration")}, nil
+			}
+		}
+
+		levels.Set(req.Component, level, ttl)
+		return logLevelsResponse{Levels: levels.Snapshot()}, nil
+	}
+}
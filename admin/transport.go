@@ -0,0 +1,77 @@
+// Admin package exposes operational endpoints that are not part of the public API
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	errs "github.com/bnelz/gokit-base/errors"
+	hb "github.com/bnelz/gokit-base/logger"
+	kitlog "github.com/go-kit/kit/log"
+	kithttp "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+)
+
+// errorer describes the behavior of a request or response that can contain errors
+type errorer interface {
+	error() error
+}
+
+// MakeHandler builds a go-kit http transport for the admin endpoints and returns it
+func MakeHandler(levels *hb.Levels, logger kitlog.Logger) http.Handler {
+	opts := []kithttp.ServerOption{
+		kithttp.ServerErrorLogger(logger),
+		kithttp.ServerErrorEncoder(encodeError),
+		kithttp.ServerBefore(kithttp.PopulateRequestContext),
+	}
+
+	logLevelsHandler := kithttp.NewServer(
+		makeLogLevelsEndpoint(levels),
+		decodeLogLevelsRequest,
+		encodeResponse,
+		opts...,
+	)
+
+	setLogLevelHandler := kithttp.NewServer(
+		makeSetLogLevelEndpoint(levels),
+		decodeSetLogLevelRequest,
+		encodeResponse,
+		opts...,
+	)
+
+	r := mux.NewRouter()
+	r.Handle("/admin/loglevel", logLevelsHandler).Methods("GET")
+	r.Handle("/admin/loglevel", setLogLevelHandler).Methods("PUT")
+	return r
+}
+
+// decodeLogLevelsRequest returns an empty request because there are no params for this request
+func decodeLogLevelsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return logLevelsRequest{}, nil
+}
+
+// decodeSetLogLevelRequest decodes the requested component level change from the body
+func decodeSetLogLevelRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	var req setLogLevelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, errs.ErrInvalidArgument.Wrap(err)
+	}
+	return &req, nil
+}
+
+// encodeResponse encodes any errors received from handling the request or the response itself
+func encodeResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	if e, ok := response.(errorer); ok && e.error() != nil {
+		encodeError(ctx, e.error(), w)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return json.NewEncoder(w).Encode(response)
+}
+
+// encodeError renders err as RFC 7807 problem details
+func encodeError(ctx context.Context, err error, w http.ResponseWriter) {
+	errs.EncodeProblem(ctx, err, w)
+}
@@ -0,0 +1,59 @@
+// Auth package identifies the clients calling the API by the bearer tokens they present, or by their address
+package auth
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	jwt "github.com/golang-jwt/jwt"
+)
+
+// Subject returns the subject of the bearer token of r if its HMAC signature is valid for secret. Without a secret
+// no token is trusted.
+func Subject(r *http.Request, secret []byte) string {
+	header := r.Header.Get("Authorization")
+	if len(secret) == 0 || !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+
+	claims := &jwt.StandardClaims{}
+	_, err := jwt.ParseWithClaims(strings.TrimPrefix(header, "Bearer "), claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return secret, nil
+	})
+	if err != nil {
+		return ""
+	}
+	return claims.Subject
+}
+
+// RemoteIP returns the address of the peer that sent r
+func RemoteIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// addressPrefix starts the identity of clients identified by their address
+const addressPrefix = "ip:"
+
+// Client returns a function identifying the client making a request by the subject of its bearer token signed
+// with secret, or by its remote IP if it has no valid token. Clients cannot claim the identity of another.
+func Client(secret []byte) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		if sub := Subject(r, secret); sub != "" {
+			return "sub:" + sub
+		}
+		return addressPrefix + RemoteIP(r)
+	}
+}
+
+// ByAddress reports whether client, as returned by Client, is identified by its address. Such identities are
+// personal data and not meant to be shown to other clients.
+func ByAddress(client string) bool {
+	return strings.HasPrefix(client, addressPrefix)
+}
@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	jwt "github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient(t *testing.T) {
+	secret := []byte("secret")
+	sign := func(key []byte) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{Subject: "ada"}).SignedString(key)
+		require.NoError(t, err)
+		return "Bearer " + token
+	}
+
+	for auth, want := range map[string]string{
+		"":                   "ip:10.0.0.1",
+		sign(secret):         "sub:ada",
+		sign([]byte("x")):    "ip:10.0.0.1",
+		"Bearer not-a-token": "ip:10.0.0.1",
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "10.0.0.1:4321"
+		r.Header.Set("Authorization", auth)
+		assert.Equal(t, want, Client(secret)(r), auth)
+	}
+
+	// Without a secret no token is trusted
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:4321"
+	r.Header.Set("Authorization", sign(nil))
+	assert.Equal(t, "ip:10.0.0.1", Client(nil)(r))
+}
@@ -0,0 +1,65 @@
+// Build package describes the binary that is running. Values are injected at link time, e.g.
+//
+//	go build -ldflags "-X github.com/bnelz/gokit-base/build.Version=1.2.0 -X github.com/bnelz/gokit-base/build.Commit=abc123"
+package build
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// unknown is reported for any value that was not injected and cannot be derived
+const unknown = "unknown"
+
+var (
+	// Version is the release version of the binary
+	Version string
+
+	// Commit is the git commit the binary was built from
+	Commit string
+
+	// Time is the UTC time the binary was built at
+	Time string
+)
+
+// Info describes the running build
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the running build's info. The module version recorded by the go tool is used when no version
+// was injected.
+func Get() Info {
+	i := Info{
+		Version:   Version,
+		Commit:    Commit,
+		BuildTime: Time,
+		GoVersion: runtime.Version(),
+	}
+
+	if i.Version == "" {
+		if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+			i.Version = bi.Main.Version
+		}
+	}
+
+	for _, v := range []*string{&i.Version, &i.Commit, &i.BuildTime} {
+		if *v == "" {
+			*v = unknown
+		}
+	}
+	return i
+}
+
+// Labels returns the info as alternating label names and values for metrics
+func (i Info) Labels() []string {
+	return []string{
+		"version", i.Version,
+		"commit", i.Commit,
+		"build_time", i.BuildTime,
+		"go_version", i.GoVersion,
+	}
+}
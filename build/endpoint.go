@@ -0,0 +1,17 @@
+package build
+
+import (
+	"context"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+// versionRequest has no parameters, but we still generate an empty struct to represent it
+type versionRequest struct{}
+
+// makeVersionEndpoint returns a go-kit endpoint responding with the running build's info
+func makeVersionEndpoint(info Info) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		return info, nil
+	}
+}
@@ -0,0 +1,41 @@
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	kitlog "github.com/go-kit/kit/log"
+	kithttp "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+)
+
+// MakeHandler builds a go-kit http transport serving info at /api/v1/version and /admin/build
+func MakeHandler(info Info, logger kitlog.Logger) http.Handler {
+	opts := []kithttp.ServerOption{
+		kithttp.ServerErrorLogger(logger),
+	}
+
+	versionHandler := kithttp.NewServer(
+		makeVersionEndpoint(info),
+		decodeVersionRequest,
+		encodeVersionResponse,
+		opts...,
+	)
+
+	r := mux.NewRouter()
+	r.Handle("/api/v1/version", versionHandler).Methods("GET")
+	r.Handle("/admin/build", versionHandler).Methods("GET")
+	return r
+}
+
+// decodeVersionRequest returns an empty version request because there are no params for this request
+func decodeVersionRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return versionRequest{}, nil
+}
+
+// encodeVersionResponse encodes the build info
+func encodeVersionResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return json.NewEncoder(w).Encode(response)
+}
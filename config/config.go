@@ -2,9 +2,21 @@ package config
 
 import (
 	"fmt"
+	"net/http"
 	"os"
+	"regexp"
+	"time"
 
+	"github.com/bnelz/gokit-base/auth"
+	"github.com/bnelz/gokit-base/cors"
+	"github.com/bnelz/gokit-base/deadline"
+	"github.com/bnelz/gokit-base/events"
+	"github.com/bnelz/gokit-base/idempotency"
+	"github.com/bnelz/gokit-base/loadshed"
 	"github.com/bnelz/gokit-base/logger"
+	"github.com/bnelz/gokit-base/outbox"
+	"github.com/bnelz/gokit-base/ratelimit"
+	"github.com/bnelz/gokit-base/webhooks"
 
 	"github.com/spf13/viper"
 	_ "github.com/spf13/viper/remote"
@@ -15,6 +27,8 @@ const (
 	DEVELOPMENT    = "development"
 	STAGING        = "staging"
 	DEFAULT_CONSUL = "consul"
+
+	DEFAULT_ADMIN_PORT = "8082"
 )
 
 // Config describes our global application configuration element.
@@ -38,7 +52,9 @@ type Env struct {
 	// ApplicationEnvironment provides production, development, or staging environment specification
 	ApplicationEnvironment string `mapstructure:"app_env"`
 
-	// ApplicationToken is the JWT signing token used to compare incoming authentication requests with the auth middleware
+	// ApplicationToken is the JWT signing token used to compare incoming authentication requests with the auth middleware.
+	// It verifies the HMAC signature of the bearer tokens clients are identified and rate limited by, clients without
+	// a valid token are identified by their address.
 	ApplicationToken string `mapstructure:"token"`
 
 	// Debug flags whether the application is running in debugging mode or not (increased log verbosity, no "pm", etc)
@@ -50,12 +66,182 @@ type Env struct {
 	// HTTPPort defines the port that the HTTP server will listen on e.g. 80
 	HTTPPort string `mapstructure:"http_port"`
 
+	// AdminHTTPPort defines the port that the admin HTTP server (metrics, pprof, probes) will listen on e.g. 8082
+	AdminHTTPPort string `mapstructure:"admin_http_port"`
+
+	// CORSAllowedOrigins lists origins allowed to call the API: exact origins, wildcard subdomains such as
+	// "https://*.example.com" or "*". Defaults to "*", which cannot be combined with CORSAllowCredentials.
+	CORSAllowedOrigins []string `mapstructure:"cors_allowed_origins"`
+
+	// CORSAllowedMethods lists the methods allowed in cross-origin requests
+	CORSAllowedMethods []string `mapstructure:"cors_allowed_methods"`
+
+	// CORSAllowedHeaders lists the request headers allowed in cross-origin requests
+	CORSAllowedHeaders []string `mapstructure:"cors_allowed_headers"`
+
+	// CORSExposedHeaders lists the response headers browsers may expose to cross-origin scripts
+	CORSExposedHeaders []string `mapstructure:"cors_exposed_headers"`
+
+	// CORSAllowCredentials allows cross-origin requests to include cookies and authorization headers
+	CORSAllowCredentials bool `mapstructure:"cors_allow_credentials"`
+
+	// CORSMaxAge is how long browsers may cache preflight responses e.g. "10m"
+	CORSMaxAge time.Duration `mapstructure:"cors_max_age"`
+
 	// LogPath is the storage path for Herbert/Monolog style log output
 	LogPath string `mapstructure:"log_path"`
 
 	// LogChannel defines the channel this application's logs will be tagged with. Within our "golang" app channel
 	// we have defined channels by service. This value may be "gokit-base" for this project.
 	LogChannel string `mapstructure:"channel"`
+
+	// LogMaxSizeMB is the size in megabytes the log file may reach before it is rotated, 0 disables size rotation
+	LogMaxSizeMB int `mapstructure:"log_max_size_mb"`
+
+	// LogMaxAge is how long the log file is written to before it is rotated e.g. "24h", 0 disables age rotation
+	LogMaxAge time.Duration `mapstructure:"log_max_age"`
+
+	// LogMaxBackups is the number of rotated log files to retain, 0 retains all of them
+	LogMaxBackups int `mapstructure:"log_max_backups"`
+
+	// LogCompress flags whether rotated log files are gzip compressed
+	LogCompress bool `mapstructure:"log_compress"`
+
+	// LogBufferSize is the number of log entries buffered in memory before the overflow policy applies
+	LogBufferSize int `mapstructure:"log_buffer_size"`
+
+	// LogFlushInterval is how often buffered log entries are flushed to the log file e.g. "1s"
+	LogFlushInterval time.Duration `mapstructure:"log_flush_interval"`
+
+	// LogOverflowPolicy is applied when the log buffer is full: "block", "drop-oldest" or "drop-newest"
+	LogOverflowPolicy string `mapstructure:"log_overflow_policy"`
+
+	// LogRedaction lists log fields that must be masked, hashed or dropped before they are logged. Production also
+	// masks user names unless a rule here redacts them otherwise.
+	LogRedaction []RedactionRule `mapstructure:"log_redaction"`
+
+	// LogHashKey is the secret keying the digests of hashed log fields, it is required by "hash" redactions
+	LogHashKey string `mapstructure:"log_hash_key"`
+
+	// UserRetention is how long soft deleted users are kept before they are purged e.g. "720h"
+	UserRetention time.Duration `mapstructure:"user_retention"`
+
+	// UserPurgeInterval is how often soft deleted users past their retention period are purged e.g. "1h"
+	UserPurgeInterval time.Duration `mapstructure:"user_purge_interval"`
+
+	// WebhookWorkers is the number of webhook deliveries made concurrently
+	WebhookWorkers int `mapstructure:"webhook_workers"`
+
+	// WebhookMaxAttempts is the number of times a webhook delivery is attempted before it is dead lettered
+	WebhookMaxAttempts int `mapstructure:"webhook_max_attempts"`
+
+	// WebhookBackoff is the wait before the first webhook retry, it doubles up to WebhookMaxBackoff e.g. "1s"
+	WebhookBackoff time.Duration `mapstructure:"webhook_backoff"`
+
+	// WebhookMaxBackoff caps the wait between webhook retries e.g. "5m"
+	WebhookMaxBackoff time.Duration `mapstructure:"webhook_max_backoff"`
+
+	// WebhookTimeout bounds a single webhook delivery attempt e.g. "10s"
+	WebhookTimeout time.Duration `mapstructure:"webhook_timeout"`
+
+	// EventStreamReplaySize is the number of user events kept for event stream clients resuming with Last-Event-ID
+	EventStreamReplaySize int `mapstructure:"event_stream_replay_size"`
+
+	// EventStreamHeartbeat is how often idle event streams send a heartbeat comment e.g. "15s"
+	EventStreamHeartbeat time.Duration `mapstructure:"event_stream_heartbeat"`
+
+	// DatabaseURL is the PostgreSQL connection string of the user repository e.g.
+	// "postgres://api@localhost/api?sslmode=disable", users are kept in memory when it is empty
+	DatabaseURL string `mapstructure:"database_url"`
+
+	// OutboxBatchSize is the number of outbox records relayed to a consumer at a time
+	OutboxBatchSize int `mapstructure:"outbox_batch_size"`
+
+	// OutboxInterval is how often the outbox is checked for events to relay e.g. "1s"
+	OutboxInterval time.Duration `mapstructure:"outbox_interval"`
+
+	// IdempotencyTTL is how long responses to requests with an Idempotency-Key are replayed e.g. "24h"
+	IdempotencyTTL time.Duration `mapstructure:"idempotency_ttl"`
+
+	// IdempotencyMaxKeys is the number of idempotency keys kept, the oldest completed one is forgotten to make room
+	IdempotencyMaxKeys int `mapstructure:"idempotency_max_keys"`
+
+	// IdempotencyMaxKeysPerClient is the number of idempotency keys kept for a single client
+	IdempotencyMaxKeysPerClient int `mapstructure:"idempotency_max_keys_per_client"`
+
+	// IdempotencyMaxBodyBytes bounds the size of request bodies sent with an Idempotency-Key
+	IdempotencyMaxBodyBytes int64 `mapstructure:"idempotency_max_body_bytes"`
+
+	// RateLimitKeys lists what clients are rate limited by, the first one present in a request is used: "api_key",
+	// "jwt_subject" or "ip". Defaults to "jwt_subject" then "ip", clients none of them identifies are limited by
+	// their address.
+	RateLimitKeys []string `mapstructure:"rate_limit_keys"`
+
+	// RateLimitAPIKeys lists the API keys issued to clients, "api_key" ignores X-API-Key headers carrying others
+	RateLimitAPIKeys []string `mapstructure:"rate_limit_api_keys"`
+
+	// RateLimits maps route names e.g. "create_user" or "import_users" to their rate limit, "default" applies to
+	// routes without one. Entries override the built in defaults.
+	RateLimits map[string]RateLimitRule `mapstructure:"rate_limits"`
+
+	// ConcurrencyMinLimit and ConcurrencyMaxLimit bound the adaptive number of public API requests served at once
+	ConcurrencyMinLimit int `mapstructure:"concurrency_min_limit"`
+	ConcurrencyMaxLimit int `mapstructure:"concurrency_max_limit"`
+
+	// ConcurrencyLatencyThreshold is the request latency above which the concurrency limit is lowered e.g. "500ms"
+	ConcurrencyLatencyThreshold time.Duration `mapstructure:"concurrency_latency_threshold"`
+
+	// RequestTimeout bounds how long user endpoints may take to answer e.g. "10s"
+	RequestTimeout time.Duration `mapstructure:"request_timeout"`
+
+	// RequestMaxTimeout caps the timeouts clients request with the X-Request-Timeout header e.g. "60s"
+	RequestMaxTimeout time.Duration `mapstructure:"request_max_timeout"`
+
+	// EndpointTimeouts maps endpoint names e.g. "import_users" to a timeout overriding RequestTimeout
+	EndpointTimeouts map[string]time.Duration `mapstructure:"endpoint_timeouts"`
+
+	// RepositoryRetryAttempts is the number of times a user repository call failing with a transient error is made
+	RepositoryRetryAttempts int `mapstructure:"repository_retry_attempts"`
+
+	// RepositoryRetryBackoff is the wait before the first repository retry, it doubles up to 1s e.g. "50ms"
+	RepositoryRetryBackoff time.Duration `mapstructure:"repository_retry_backoff"`
+
+	// RepositoryBreakerFailures is the number of consecutive transient errors opening the user repository breaker
+	RepositoryBreakerFailures uint32 `mapstructure:"repository_breaker_failures"`
+
+	// RepositoryBreakerTimeout is how long the open repository breaker fails calls before trying again e.g. "30s"
+	RepositoryBreakerTimeout time.Duration `mapstructure:"repository_breaker_timeout"`
+
+	// UserCacheSize is the number of user lookups cached
+	UserCacheSize int `mapstructure:"user_cache_size"`
+
+	// UserCacheTTL is how long found users are cached e.g. "1m"
+	UserCacheTTL time.Duration `mapstructure:"user_cache_ttl"`
+
+	// UserCacheNegativeTTL is how long users that were not found are cached e.g. "5s"
+	UserCacheNegativeTTL time.Duration `mapstructure:"user_cache_negative_ttl"`
+}
+
+// RateLimitRule describes the rate limit of a route
+type RateLimitRule struct {
+	// Limit is the number of requests allowed per Period e.g. 600 per "1m"
+	Limit  int           `mapstructure:"limit"`
+	Period time.Duration `mapstructure:"period"`
+
+	// Burst is the number of requests a client may make at once, defaults to Limit
+	Burst int `mapstructure:"burst"`
+}
+
+// RedactionRule describes a sensitive log field, matched by exact key or by regular expression
+type RedactionRule struct {
+	// Key is an exact log key e.g. "context_fname"
+	Key string `mapstructure:"key"`
+
+	// Pattern is a regular expression matching log keys, used when Key is empty
+	Pattern string `mapstructure:"pattern"`
+
+	// Action is one of "mask", "hash" or "drop"
+	Action string `mapstructure:"action"`
 }
 
 func Init() *Config {
@@ -105,6 +291,51 @@ func (a *Config) IsDebugEnvironment() bool {
 	return a.Env.Debug == true
 }
 
+// AdminPort returns the port of the admin HTTP listener, defaulting to 8082
+func (a *Config) AdminPort() string {
+	if a.Env.AdminHTTPPort == "" {
+		return DEFAULT_ADMIN_PORT
+	}
+	return a.Env.AdminHTTPPort
+}
+
+// CORS returns the cross-origin policy of the public API. Any origin is allowed by default, allowing credentials
+// requires listing the allowed origins.
+func (a *Config) CORS() (cors.Options, error) {
+	opts := cors.Options{
+		AllowedOrigins:   a.Env.CORSAllowedOrigins,
+		AllowedMethods:   a.Env.CORSAllowedMethods,
+		AllowedHeaders:   a.Env.CORSAllowedHeaders,
+		ExposedHeaders:   a.Env.CORSExposedHeaders,
+		AllowCredentials: a.Env.CORSAllowCredentials,
+		MaxAge:           a.Env.CORSMaxAge,
+	}
+	if len(opts.AllowedOrigins) == 0 {
+		opts.AllowedOrigins = []string{"*"}
+	}
+	if opts.AllowCredentials {
+		for _, o := range opts.AllowedOrigins {
+			if o == "*" {
+				return cors.Options{}, fmt.Errorf("cors_allow_credentials requires cors_allowed_origins to list origins instead of %q", o)
+			}
+		}
+	}
+	if len(opts.AllowedMethods) == 0 {
+		opts.AllowedMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+	}
+	if len(opts.AllowedHeaders) == 0 {
+		opts.AllowedHeaders = []string{
+			"Origin", "Content-Type", "Authorization", "Idempotency-Key", "X-Request-Timeout", "If-Match", "If-None-Match",
+		}
+	}
+	if len(opts.ExposedHeaders) == 0 {
+		opts.ExposedHeaders = []string{
+			"ETag", "Location", "Retry-After", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset",
+		}
+	}
+	return opts, nil
+}
+
 // LogLevel returns the current the application logger level
 func (a *Config) LogLevel() logger.LogLevel {
 	if a.Env.ApplicationEnvironment == PRODUCTION {
@@ -113,3 +344,267 @@ func (a *Config) LogLevel() logger.LogLevel {
 
 	return logger.VERBOSE
 }
+
+// LogRotation returns the rotation policy for the application log file
+func (a *Config) LogRotation() logger.RotateOptions {
+	return logger.RotateOptions{
+		MaxSize:    int64(a.Env.LogMaxSizeMB) * 1024 * 1024,
+		MaxAge:     a.Env.LogMaxAge,
+		MaxBackups: a.Env.LogMaxBackups,
+		Compress:   a.Env.LogCompress,
+	}
+}
+
+// LogBuffer returns the asynchronous log writer configuration, an unknown overflow policy is an error
+func (a *Config) LogBuffer() (logger.AsyncOptions, error) {
+	opts := logger.AsyncOptions{
+		BufferSize:    a.Env.LogBufferSize,
+		FlushInterval: a.Env.LogFlushInterval,
+	}
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = 1024
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = time.Second
+	}
+	overflow, err := logger.ParseOverflowPolicy(a.Env.LogOverflowPolicy)
+	if err != nil {
+		return logger.AsyncOptions{}, err
+	}
+	opts.Overflow = overflow
+	return opts, nil
+}
+
+// UserPurge returns how long soft deleted users are retained and how often they are purged, defaulting to
+// 30 days and hourly
+func (a *Config) UserPurge() (retention time.Duration, interval time.Duration) {
+	retention, interval = a.Env.UserRetention, a.Env.UserPurgeInterval
+	if retention <= 0 {
+		retention = 30 * 24 * time.Hour
+	}
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	return retention, interval
+}
+
+// Webhooks returns the webhook dispatcher configuration
+func (a *Config) Webhooks() webhooks.DispatcherOptions {
+	opts := webhooks.DispatcherOptions{
+		Workers:     a.Env.WebhookWorkers,
+		QueueSize:   1000,
+		MaxAttempts: a.Env.WebhookMaxAttempts,
+		BaseBackoff: a.Env.WebhookBackoff,
+		MaxBackoff:  a.Env.WebhookMaxBackoff,
+		Timeout:     a.Env.WebhookTimeout,
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = 4
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 8
+	}
+	if opts.BaseBackoff <= 0 {
+		opts.BaseBackoff = time.Second
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 5 * time.Minute
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	return opts
+}
+
+// EventStream returns the configuration of the user event stream, replaying up to 1000 events by default
+func (a *Config) EventStream() events.StreamOptions {
+	opts := events.StreamOptions{
+		ReplaySize:   a.Env.EventStreamReplaySize,
+		Heartbeat:    a.Env.EventStreamHeartbeat,
+		ClientBuffer: 256,
+	}
+	if opts.ReplaySize <= 0 {
+		opts.ReplaySize = 1000
+	}
+	if opts.Heartbeat <= 0 {
+		opts.Heartbeat = 15 * time.Second
+	}
+	return opts
+}
+
+// Outbox returns the options of the relays handing outbox events to consumers, defaulting to 100 records every second
+func (a *Config) Outbox() outbox.RelayOptions {
+	opts := outbox.RelayOptions{
+		BatchSize: a.Env.OutboxBatchSize,
+		Interval:  a.Env.OutboxInterval,
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+	return opts
+}
+
+// Clients returns how clients of the public API are identified: by the subject of their bearer token, or by their
+// address without a valid one
+func (a *Config) Clients() func(r *http.Request) string {
+	return auth.Client([]byte(a.Env.ApplicationToken))
+}
+
+// Idempotency returns the options of the Idempotency-Key middleware. Keys are scoped to the client identified by
+// its bearer token or address, responses are replayed for a day and bodies are bounded to 1 MiB by default.
+func (a *Config) Idempotency() idempotency.Options {
+	opts := idempotency.Options{
+		TTL:          a.Env.IdempotencyTTL,
+		Client:       a.Clients(),
+		MaxBodyBytes: a.Env.IdempotencyMaxBodyBytes,
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = 24 * time.Hour
+	}
+	if opts.MaxBodyBytes <= 0 {
+		opts.MaxBodyBytes = 1 << 20
+	}
+	return opts
+}
+
+// RateLimits returns the rate limits of the public API. By default clients may make 600 requests a minute in
+// bursts of 100, and 10 imports a minute.
+func (a *Config) RateLimits() ratelimit.Options {
+	opts := ratelimit.Options{
+		Rules: map[string]ratelimit.Rule{
+			ratelimit.DefaultRoute: {Limit: 600, Period: time.Minute, Burst: 100},
+			"import_users":         {Limit: 10, Period: time.Minute},
+		},
+		Keys:      a.Env.RateLimitKeys,
+		APIKeys:   a.Env.RateLimitAPIKeys,
+		JWTSecret: []byte(a.Env.ApplicationToken),
+	}
+	for route, r := range a.Env.RateLimits {
+		opts.Rules[route] = ratelimit.Rule{Limit: r.Limit, Period: r.Period, Burst: r.Burst}
+	}
+	return opts
+}
+
+// LoadShedding returns the concurrency limits of the public listener, by default between 10 and 1000 requests
+// with a latency threshold of 500ms
+func (a *Config) LoadShedding() loadshed.Options {
+	opts := loadshed.Options{
+		MinLimit:         a.Env.ConcurrencyMinLimit,
+		MaxLimit:         a.Env.ConcurrencyMaxLimit,
+		LatencyThreshold: a.Env.ConcurrencyLatencyThreshold,
+		Backoff:          0.9,
+		RetryAfter:       time.Second,
+	}
+	if opts.MinLimit <= 0 {
+		opts.MinLimit = 10
+	}
+	if opts.MaxLimit <= 0 {
+		opts.MaxLimit = 1000
+	}
+	if opts.LatencyThreshold <= 0 {
+		opts.LatencyThreshold = 500 * time.Millisecond
+	}
+	opts.InitialLimit = opts.MinLimit * 10
+	if opts.InitialLimit > opts.MaxLimit {
+		opts.InitialLimit = opts.MaxLimit
+	}
+	return opts
+}
+
+// Deadlines returns the endpoint timeouts of the users API. Endpoints answer within 10 seconds by default,
+// imports within a minute, and clients may ask for up to a minute.
+func (a *Config) Deadlines() deadline.Options {
+	opts := deadline.Options{
+		Default:   a.Env.RequestTimeout,
+		Max:       a.Env.RequestMaxTimeout,
+		Endpoints: map[string]time.Duration{"import_users": time.Minute},
+	}
+	if opts.Default <= 0 {
+		opts.Default = 10 * time.Second
+	}
+	if opts.Max <= 0 {
+		opts.Max = time.Minute
+	}
+	for name, timeout := range a.Env.EndpointTimeouts {
+		opts.Endpoints[name] = timeout
+	}
+	return opts
+}
+
+// RepositoryRetries returns how many times user repository calls are made and the backoff before the first
+// retry, defaulting to 3 attempts and 50ms
+func (a *Config) RepositoryRetries() (attempts int, backoff time.Duration) {
+	attempts, backoff = a.Env.RepositoryRetryAttempts, a.Env.RepositoryRetryBackoff
+	if attempts <= 0 {
+		attempts = 3
+	}
+	if backoff <= 0 {
+		backoff = 50 * time.Millisecond
+	}
+	return attempts, backoff
+}
+
+// RepositoryBreaker returns the number of consecutive transient errors opening the user repository circuit breaker
+// and how long it stays open, defaulting to 5 errors and 30 seconds
+func (a *Config) RepositoryBreaker() (failures uint32, openTimeout time.Duration) {
+	failures, openTimeout = a.Env.RepositoryBreakerFailures, a.Env.RepositoryBreakerTimeout
+	if failures == 0 {
+		failures = 5
+	}
+	if openTimeout <= 0 {
+		openTimeout = 30 * time.Second
+	}
+	return failures, openTimeout
+}
+
+// UserCache returns the number of user lookups cached and how long found and missing users are cached,
+// defaulting to 10000 lookups, a minute and 5 seconds
+func (a *Config) UserCache() (size int, ttl time.Duration, negativeTTL time.Duration) {
+	size, ttl, negativeTTL = a.Env.UserCacheSize, a.Env.UserCacheTTL, a.Env.UserCacheNegativeTTL
+	if size <= 0 {
+		size = 10000
+	}
+	if ttl <= 0 {
+		ttl = time.Minute
+	}
+	if negativeTTL <= 0 {
+		negativeTTL = 5 * time.Second
+	}
+	return size, ttl, negativeTTL
+}
+
+// LogRedactions returns the redaction rules applied to every log entry. In production the default redactions
+// follow the configured ones, so configuring rules never unmasks user names and the first rule matching a key wins.
+func (a *Config) LogRedactions() ([]logger.Redaction, error) {
+	redactions := make([]logger.Redaction, 0, len(a.Env.LogRedaction)+len(logger.DefaultRedactions))
+	for _, rule := range a.Env.LogRedaction {
+		if rule.Key == "" && rule.Pattern == "" {
+			return nil, fmt.Errorf("log redaction %+v has neither a key nor a pattern", rule)
+		}
+
+		action, err := logger.ParseRedactAction(rule.Action)
+		if err != nil {
+			return nil, err
+		}
+
+		if action == logger.Hash && a.Env.LogHashKey == "" {
+			return nil, fmt.Errorf("log redaction %+v hashes values but log_hash_key is not set", rule)
+		}
+
+		r := logger.Redaction{Key: rule.Key, Action: action}
+		if rule.Key == "" {
+			if r.Pattern, err = regexp.Compile(rule.Pattern); err != nil {
+				return nil, fmt.Errorf("invalid log redaction pattern %q: %v", rule.Pattern, err)
+			}
+		}
+		redactions = append(redactions, r)
+	}
+
+	if a.IsProduction() {
+		redactions = append(redactions, logger.DefaultRedactions...)
+	}
+	return redactions, nil
+}
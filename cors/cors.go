@@ -0,0 +1,213 @@
+// Cors package implements a configurable Cross-Origin Resource Sharing policy as HTTP middleware
+package cors
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Options describes a CORS policy
+type Options struct {
+	// AllowedOrigins lists origins allowed to make cross-origin requests. Entries are exact origins such as
+	// "https://example.com", wildcard subdomains such as "https://*.example.com" or "*" for any origin. "*" is
+	// ignored when credentials are allowed, any site could otherwise act with the credentials of its visitors.
+	AllowedOrigins []string
+
+	// AllowedMethods lists the methods allowed in cross-origin requests
+	AllowedMethods []string
+
+	// AllowedHeaders lists the request headers allowed in cross-origin requests, "*" allows any header
+	AllowedHeaders []string
+
+	// ExposedHeaders lists the response headers browsers may expose to scripts
+	ExposedHeaders []string
+
+	// AllowCredentials allows requests to include cookies and authorization headers
+	AllowCredentials bool
+
+	// MaxAge is how long browsers may cache preflight responses, zero omits the header
+	MaxAge time.Duration
+}
+
+// policy is a compiled set of options
+type policy struct {
+	anyOrigin     bool
+	origins       map[string]bool
+	wildcards     [][2]string
+	methods       map[string]bool
+	anyHeader     bool
+	headers       map[string]bool
+	allowMethods  string
+	allowHeaders  string
+	exposeHeaders string
+	credentials   bool
+	maxAge        string
+}
+
+// New returns middleware applying the CORS policy described by opts
+func New(opts Options) func(http.Handler) http.Handler {
+	p := &policy{
+		origins:       make(map[string]bool),
+		methods:       make(map[string]bool),
+		headers:       make(map[string]bool),
+		allowMethods:  strings.Join(opts.AllowedMethods, ", "),
+		exposeHeaders: strings.Join(opts.ExposedHeaders, ", "),
+		credentials:   opts.AllowCredentials,
+	}
+
+	for _, o := range opts.AllowedOrigins {
+		o = strings.ToLower(o)
+		switch i := strings.Index(o, "*"); {
+		case o == "*":
+			p.anyOrigin = !opts.AllowCredentials
+		case i >= 0:
+			p.wildcards = append(p.wildcards, [2]string{o[:i], o[i+1:]})
+		default:
+			p.origins[o] = true
+		}
+	}
+
+	for _, m := range opts.AllowedMethods {
+		p.methods[strings.ToUpper(m)] = true
+	}
+
+	var headers []string
+	for _, h := range opts.AllowedHeaders {
+		if h == "*" {
+			p.anyHeader = true
+			continue
+		}
+		h = http.CanonicalHeaderKey(h)
+		p.headers[h] = true
+		headers = append(headers, h)
+	}
+	p.allowHeaders = strings.Join(headers, ", ")
+
+	if opts.MaxAge > 0 {
+		p.maxAge = strconv.Itoa(int(opts.MaxAge.Seconds()))
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isPreflight(r) {
+				p.handlePreflight(w, r)
+				return
+			}
+			p.handleActual(w, r)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// isPreflight reports whether r is a CORS preflight request rather than a plain OPTIONS request
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions &&
+		r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// handlePreflight answers a preflight request. Disallowed requests get no CORS headers so the browser blocks them.
+func (p *policy) handlePreflight(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+	defer w.WriteHeader(http.StatusNoContent)
+
+	origin := r.Header.Get("Origin")
+	if !p.originAllowed(origin) || !p.methods[strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))] {
+		return
+	}
+
+	requested := parseHeaderList(r.Header.Get("Access-Control-Request-Headers"))
+	if !p.headersAllowed(requested) {
+		return
+	}
+
+	h.Set("Access-Control-Allow-Origin", p.allowOrigin(origin))
+	h.Set("Access-Control-Allow-Methods", p.allowMethods)
+	if len(requested) > 0 {
+		if p.anyHeader {
+			h.Set("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+		} else {
+			h.Set("Access-Control-Allow-Headers", p.allowHeaders)
+		}
+	}
+	if p.credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if p.maxAge != "" {
+		h.Set("Access-Control-Max-Age", p.maxAge)
+	}
+}
+
+// handleActual adds CORS headers to a cross-origin request from an allowed origin
+func (p *policy) handleActual(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Add("Vary", "Origin")
+
+	origin := r.Header.Get("Origin")
+	if origin == "" || !p.originAllowed(origin) {
+		return
+	}
+
+	h.Set("Access-Control-Allow-Origin", p.allowOrigin(origin))
+	if p.credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if p.exposeHeaders != "" {
+		h.Set("Access-Control-Expose-Headers", p.exposeHeaders)
+	}
+}
+
+// originAllowed reports whether origin matches the policy
+func (p *policy) originAllowed(origin string) bool {
+	if p.anyOrigin {
+		return true
+	}
+
+	origin = strings.ToLower(origin)
+	if p.origins[origin] {
+		return true
+	}
+	for _, w := range p.wildcards {
+		if len(origin) > len(w[0])+len(w[1]) && strings.HasPrefix(origin, w[0]) && strings.HasSuffix(origin, w[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin value for an allowed origin
+func (p *policy) allowOrigin(origin string) string {
+	if p.anyOrigin {
+		return "*"
+	}
+	return origin
+}
+
+// headersAllowed reports whether every requested header is allowed
+func (p *policy) headersAllowed(requested []string) bool {
+	if p.anyHeader {
+		return true
+	}
+	for _, h := range requested {
+		if !p.headers[h] {
+			return false
+		}
+	}
+	return true
+}
+
+// parseHeaderList splits a comma separated header list into canonical header names
+func parseHeaderList(list string) []string {
+	var headers []string
+	for _, h := range strings.Split(list, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			headers = append(headers, http.CanonicalHeaderKey(h))
+		}
+	}
+	return headers
+}
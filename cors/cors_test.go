@@ -0,0 +1,97 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newHandler(opts Options) http.Handler {
+	return New(opts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+}
+
+func TestCORS_ActualRequest(t *testing.T) {
+	h := newHandler(Options{
+		AllowedOrigins: []string{"https://example.com", "https://*.example.org"},
+		AllowedMethods: []string{"GET"},
+		ExposedHeaders: []string{"Location"},
+	})
+
+	for origin, allowed := range map[string]bool{
+		"https://example.com":     true,
+		"https://app.example.org": true,
+		"https://example.org":     false,
+		"https://evil.com":        false,
+	} {
+		r := httptest.NewRequest("GET", "/api/v1/users", nil)
+		r.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusTeapot, w.Code)
+		assert.Equal(t, "Origin", w.Header().Get("Vary"))
+		if allowed {
+			assert.Equal(t, origin, w.Header().Get("Access-Control-Allow-Origin"), origin)
+			assert.Equal(t, "Location", w.Header().Get("Access-Control-Expose-Headers"))
+		} else {
+			assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"), origin)
+		}
+	}
+}
+
+func TestCORS_Preflight(t *testing.T) {
+	h := newHandler(Options{
+		AllowedOrigins:   []string{"https://example.com"},
+		AllowedMethods:   []string{"GET", "DELETE"},
+		AllowedHeaders:   []string{"content-type"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	})
+
+	r := httptest.NewRequest("OPTIONS", "/api/v1/users/1", nil)
+	r.Header.Set("Origin", "https://example.com")
+	r.Header.Set("Access-Control-Request-Method", "DELETE")
+	r.Header.Set("Access-Control-Request-Headers", "Content-Type")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "GET, DELETE", w.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "Content-Type", w.Header().Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "600", w.Header().Get("Access-Control-Max-Age"))
+
+	r.Header.Set("Access-Control-Request-Method", "PUT")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestCORS_AnyOriginIsNotCredentialed(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api/v1/users", nil)
+	r.Header.Set("Origin", "https://evil.com")
+
+	w := httptest.NewRecorder()
+	newHandler(Options{AllowedOrigins: []string{"*"}}).ServeHTTP(w, r)
+	assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Credentials"))
+
+	w = httptest.NewRecorder()
+	newHandler(Options{AllowedOrigins: []string{"*"}, AllowCredentials: true}).ServeHTTP(w, r)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestCORS_PlainOptionsPassesThrough(t *testing.T) {
+	h := newHandler(Options{AllowedOrigins: []string{"*"}})
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("OPTIONS", "/api/v1/health", nil))
+	assert.Equal(t, http.StatusTeapot, w.Code)
+}
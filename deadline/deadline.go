@@ -0,0 +1,98 @@
+// Deadline package bounds how long endpoints may take to answer, honoring deadlines requested by clients
+package deadline
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	errs "github.com/bnelz/gokit-base/errors"
+	"github.com/go-kit/kit/endpoint"
+)
+
+// Header carries the time a client is willing to wait for a response as a duration e.g. "2s" or "500ms"
+const Header = "X-Request-Timeout"
+
+// Options configures a Policy
+type Options struct {
+	// Default bounds endpoints without a timeout of their own, zero leaves them unbounded
+	Default time.Duration
+
+	// Endpoints maps endpoint names to their timeout
+	Endpoints map[string]time.Duration
+
+	// Max caps the timeouts requested by clients
+	Max time.Duration
+}
+
+// Policy applies timeouts to the endpoints of a transport. A nil policy applies none.
+type Policy struct {
+	opts Options
+}
+
+// NewPolicy returns a policy applying the timeouts of opts
+func NewPolicy(opts Options) *Policy {
+	return &Policy{opts: opts}
+}
+
+// contextKey is the type of the request context keys of this package
+type contextKey int
+
+const requestedKey contextKey = iota
+
+// PopulateTimeout is a go-kit ServerBefore function recording the timeout requested by the client
+func (p *Policy) PopulateTimeout(ctx context.Context, r *http.Request) context.Context {
+	if v := r.Header.Get(Header); v != "" && p != nil {
+		return context.WithValue(ctx, requestedKey, v)
+	}
+	return ctx
+}
+
+// Middleware bounds the endpoint of route by its timeout, or by the one requested by the client capped at the
+// maximum. The deadline reaches the repository through the context, endpoints failing because of it fail with
+// ErrDeadlineExceeded.
+func (p *Policy) Middleware(route string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		if p == nil {
+			return next
+		}
+		configured, ok := p.opts.Endpoints[route]
+		if !ok {
+			configured = p.opts.Default
+		}
+
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			timeout := configured
+			if v, ok := ctx.Value(requestedKey).(string); ok {
+				requested, err := time.ParseDuration(v)
+				if err != nil || requested <= 0 {
+					return nil, errs.ErrInvalidArgument.WithDetail(Header + " must be a positive duration e.g. \"2s\"")
+				}
+				timeout = requested
+				if p.opts.Max > 0 && timeout > p.opts.Max {
+					timeout = p.opts.Max
+				}
+			}
+			if timeout <= 0 {
+				return next(ctx, request)
+			}
+
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			return call(ctx, next, request)
+		}
+	}
+}
+
+// call calls next on the caller's goroutine so the endpoint never outlives the request it serves. Failures caused by
+// the deadline of ctx are reported as ErrDeadlineExceeded, an endpoint answering after the deadline without
+// failing did its work and its response is kept. Errors endpoints return inside their responses are out of reach
+// here, transports encoding them map context.DeadlineExceeded to ErrDeadlineExceeded themselves.
+func call(ctx context.Context, next endpoint.Endpoint, request interface{}) (interface{}, error) {
+	response, err := next(ctx, request)
+	if err != nil && errors.Is(err, context.DeadlineExceeded) {
+		return nil, errs.ErrDeadlineExceeded
+	}
+	return response, err
+}
@@ -0,0 +1,115 @@
+package deadline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	errs "github.com/bnelz/gokit-base/errors"
+	kithttp "github.com/go-kit/kit/transport/http"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serve calls e through a policy under the name "read_user" and returns the response along with the timeout the
+// endpoint saw, if it was called
+func serve(p *Policy, timeoutHeader string, e func(ctx context.Context) error) (*httptest.ResponseRecorder, time.Duration) {
+	seen := make(chan time.Duration, 1)
+	h := kithttp.NewServer(
+		p.Middleware("read_user")(func(ctx context.Context, _ interface{}) (interface{}, error) {
+			var timeout time.Duration
+			if d, ok := ctx.Deadline(); ok {
+				timeout = time.Until(d).Round(time.Second)
+			}
+			seen <- timeout
+			return nil, e(ctx)
+		}),
+		func(context.Context, *http.Request) (interface{}, error) { return nil, nil },
+		func(context.Context, http.ResponseWriter, interface{}) error { return nil },
+		kithttp.ServerErrorEncoder(errs.EncodeProblem),
+		kithttp.ServerBefore(p.PopulateTimeout),
+	)
+
+	r := httptest.NewRequest("GET", "/api/v1/users/1", nil)
+	if timeoutHeader != "" {
+		r.Header.Set(Header, timeoutHeader)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	select {
+	case timeout := <-seen:
+		return w, timeout
+	default:
+		return w, 0
+	}
+}
+
+func ok(context.Context) error { return nil }
+
+func TestDeadline_Timeouts(t *testing.T) {
+	p := NewPolicy(Options{
+		Default:   10 * time.Second,
+		Endpoints: map[string]time.Duration{"read_user": 5 * time.Second},
+		Max:       30 * time.Second,
+	})
+
+	for header, want := range map[string]time.Duration{
+		"":    5 * time.Second,
+		"2s":  2 * time.Second,
+		"20s": 20 * time.Second,
+		"1h":  30 * time.Second,
+	} {
+		w, seen := serve(p, header, ok)
+		assert.Equal(t, http.StatusOK, w.Code, header)
+		assert.Equal(t, want, seen, header)
+	}
+
+	w, _ := serve(p, "soon", ok)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Without a policy nothing is bounded
+	_, seen := serve(nil, "2s", ok)
+	assert.Zero(t, seen)
+}
+
+func TestDeadline_Exceeded(t *testing.T) {
+	p := NewPolicy(Options{Default: time.Second})
+
+	// The repository gave up on its context
+	w, _ := serve(p, "10ms", func(ctx context.Context) error {
+		<-ctx.Done()
+		return errs.ErrInternal.Wrap(ctx.Err())
+	})
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+
+	var problem errs.Problem
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &problem))
+	assert.Equal(t, errs.CodeDeadlineExceeded, problem.Code)
+}
+
+func TestDeadline_LateSuccessIsKept(t *testing.T) {
+	p := NewPolicy(Options{Default: time.Second})
+
+	// The write committed after the deadline, reporting a timeout would have the client apply it again
+	w, _ := serve(p, "10ms", func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestDeadline_PanicsReachCaller(t *testing.T) {
+	e := NewPolicy(Options{Default: time.Second}).Middleware("read_user")(
+		func(context.Context, interface{}) (interface{}, error) { panic("boom") },
+	)
+	assert.PanicsWithValue(t, "boom", func() { e(context.Background(), nil) })
+
+	_, err := NewPolicy(Options{Default: time.Second}).Middleware("read_user")(
+		func(context.Context, interface{}) (interface{}, error) { return nil, errs.ErrUserNotFound },
+	)(context.Background(), nil)
+	assert.True(t, errors.Is(err, errs.ErrUserNotFound))
+}
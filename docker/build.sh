@@ -63,6 +63,12 @@ while getopts "ic:v:h" opt; do
 	esac
 done
 
+# Embed build information in the binary
+BUILD_PKG="${MODULE_ROOT}/${APP_NAME}/build"
+GIT_COMMIT=$(git -C "$BASE_DIR" rev-parse --short HEAD 2>/dev/null)
+BUILD_TIME=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+LDFLAGS="-X ${BUILD_PKG}.Version=${VERSION} -X ${BUILD_PKG}.Commit=${GIT_COMMIT} -X ${BUILD_PKG}.Time=${BUILD_TIME}"
+
 # Compile the application
 echo "Compiling ${APP_NAME}..."
 docker run -it --rm \
@@ -70,7 +76,7 @@ docker run -it --rm \
     -v $HOME/.ssh:/root/.ssh \
     -w $BUILD_PATH \
     $BASE_GOLANG_CONTAINER \
-    sh -c "go build -v -o $PROJECT_BINARY $COMPILER_FLAGS"
+    sh -c "go build -v -ldflags '$LDFLAGS' -o $PROJECT_BINARY $COMPILER_FLAGS"
 
 # Build and tag our container
 echo "Building ${APP_NAME} container"
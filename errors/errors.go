@@ -1,8 +1,130 @@
 package errors
 
-import "errors"
+import (
+	"errors"
+	"net/http"
+)
+
+// Code is a stable, machine readable identifier for a class of application error
+type Code string
+
+const (
+	CodeInvalidArgument  Code = "invalid_argument"
+	CodeValidation       Code = "validation_failed"
+	CodeUserNotFound     Code = "user_not_found"
+	CodeUserExists       Code = "user_exists"
+	CodeVersionConflict  Code = "version_conflict"
+	CodeImportAborted    Code = "import_aborted"
+	CodeUserNotDeleted   Code = "user_not_deleted"
+	CodeWebhookNotFound  Code = "webhook_not_found"
+	CodeIdempotencyKey   Code = "idempotency_key_reused"
+	CodeRequestInFlight  Code = "request_in_progress"
+	CodePayloadTooLarge  Code = "payload_too_large"
+	CodeRateLimited      Code = "rate_limited"
+	CodeOverloaded       Code = "overloaded"
+	CodeDeadlineExceeded Code = "deadline_exceeded"
+	CodeUnavailable      Code = "unavailable"
+	CodeInternal         Code = "internal"
+)
 
 var (
-	ErrInvalidArgument = errors.New("Invalid function argument(s)")
-	ErrUserNotFound    = errors.New("User not found")
+	ErrInvalidArgument  = New(CodeInvalidArgument, http.StatusBadRequest, "Invalid function argument(s)")
+	ErrValidation       = New(CodeValidation, http.StatusUnprocessableEntity, "Request validation failed")
+	ErrUserNotFound     = New(CodeUserNotFound, http.StatusNotFound, "User not found")
+	ErrUserExists       = New(CodeUserExists, http.StatusConflict, "User already exists")
+	ErrVersionConflict  = New(CodeVersionConflict, http.StatusPreconditionFailed, "User was modified by another request")
+	ErrUserNotDeleted   = New(CodeUserNotDeleted, http.StatusConflict, "User is not deleted")
+	ErrWebhookNotFound  = New(CodeWebhookNotFound, http.StatusNotFound, "Webhook subscription not found")
+	ErrImportAborted    = New(CodeImportAborted, http.StatusUnprocessableEntity, "Import aborted because another row failed")
+	ErrIdempotencyKey   = New(CodeIdempotencyKey, http.StatusUnprocessableEntity, "Idempotency key was used for a different request")
+	ErrRequestInFlight  = New(CodeRequestInFlight, http.StatusConflict, "A request with this idempotency key is in progress")
+	ErrPayloadTooLarge  = New(CodePayloadTooLarge, http.StatusRequestEntityTooLarge, "Request body is too large")
+	ErrRateLimited      = New(CodeRateLimited, http.StatusTooManyRequests, "Too many requests")
+	ErrOverloaded       = New(CodeOverloaded, http.StatusServiceUnavailable, "Server is overloaded, retry later")
+	ErrDeadlineExceeded = New(CodeDeadlineExceeded, http.StatusGatewayTimeout, "Request deadline exceeded")
+	ErrUnavailable      = New(CodeUnavailable, http.StatusServiceUnavailable, "Service temporarily unavailable, retry later")
+	ErrInternal         = New(CodeInternal, http.StatusInternalServerError, "Internal server error")
 )
+
+// FieldError describes a problem with a single request field
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Error is an application error carrying everything a transport needs to describe it to a client
+type Error struct {
+	// Code identifies the class of error
+	Code Code
+
+	// Status is the HTTP status code the error maps to
+	Status int
+
+	// Title is a short, human readable summary of the class of error
+	Title string
+
+	// Detail is a human readable explanation specific to this occurrence
+	Detail string
+
+	// Fields lists per field problems, e.g. validation failures
+	Fields []FieldError
+
+	// Err is the underlying cause, if any
+	Err error
+}
+
+// New returns an application error of the given class
+func New(code Code, status int, title string) *Error {
+	return &Error{Code: code, Status: status, Title: title}
+}
+
+// Error returns the title followed by the detail of this occurrence, if any
+func (e *Error) Error() string {
+	if e.Detail != "" {
+		return e.Title + ": " + e.Detail
+	}
+	return e.Title
+}
+
+// Unwrap returns the underlying cause
+func (e *Error) Unwrap() error { return e.Err }
+
+// Is reports whether target is an application error of the same class, so copies made by WithDetail and Wrap
+// still match the sentinel they were made from
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// WithDetail returns a copy of e describing this occurrence
+func (e *Error) WithDetail(detail string) *Error {
+	c := *e
+	c.Detail = detail
+	return &c
+}
+
+// WithFields returns a copy of e listing per field problems
+func (e *Error) WithFields(fields ...FieldError) *Error {
+	c := *e
+	c.Fields = append([]FieldError(nil), fields...)
+	return &c
+}
+
+// Wrap returns a copy of e caused by err, using err's message as the detail
+func (e *Error) Wrap(err error) *Error {
+	c := *e
+	c.Err = err
+	if err != nil {
+		c.Detail = err.Error()
+	}
+	return &c
+}
+
+// AsError returns the application error in err's chain, or ErrInternal wrapping err if there is none
+func AsError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return ErrInternal.Wrap(err)
+}
@@ -0,0 +1,62 @@
+package errors
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	kithttp "github.com/go-kit/kit/transport/http"
+)
+
+// ProblemContentType is the media type of RFC 7807 problem details
+const ProblemContentType = "application/problem+json"
+
+// problemTypeBase prefixes error codes to build the problem type URI reference
+const problemTypeBase = "/problems/"
+
+// Problem is an RFC 7807 problem details document
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      Code         `json:"code"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+}
+
+// NewProblem describes err as problem details. Errors that are not application errors are reported as internal
+// errors without exposing their message.
+func NewProblem(ctx context.Context, err error) Problem {
+	e := AsError(err)
+
+	p := Problem{
+		Type:   problemTypeBase + string(e.Code),
+		Title:  e.Title,
+		Status: e.Status,
+		Detail: e.Detail,
+		Code:   e.Code,
+		Errors: e.Fields,
+	}
+	if e.Code == CodeInternal {
+		p.Detail = ""
+	}
+
+	if path, ok := ctx.Value(kithttp.ContextKeyRequestPath).(string); ok {
+		p.Instance = path
+	}
+	if id, ok := ctx.Value(kithttp.ContextKeyRequestXRequestID).(string); ok {
+		p.RequestID = id
+	}
+	return p
+}
+
+// EncodeProblem is a go-kit error encoder writing err as application/problem+json
+func EncodeProblem(ctx context.Context, err error, w http.ResponseWriter) {
+	p := NewProblem(ctx, err)
+
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
@@ -0,0 +1,56 @@
+package errors
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	kithttp "github.com/go-kit/kit/transport/http"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestError_WrappedErrorsMatchSentinels(t *testing.T) {
+	err := fmt.Errorf("finding user 7: %w", ErrUserNotFound.WithDetail("no user with id 7"))
+
+	assert.True(t, errors.Is(err, ErrUserNotFound))
+	assert.False(t, errors.Is(err, ErrInvalidArgument))
+	assert.Equal(t, http.StatusNotFound, AsError(err).Status)
+}
+
+func TestEncodeProblem(t *testing.T) {
+	ctx := context.WithValue(context.Background(), kithttp.ContextKeyRequestPath, "/api/v1/users/7")
+	ctx = context.WithValue(ctx, kithttp.ContextKeyRequestXRequestID, "abc123")
+
+	w := httptest.NewRecorder()
+	EncodeProblem(ctx, fmt.Errorf("read: %w", ErrUserNotFound.WithDetail("no user with id 7")), w)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, ProblemContentType, w.Header().Get("Content-Type"))
+
+	var p Problem
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &p))
+	assert.Equal(t, Problem{
+		Type:      "/problems/user_not_found",
+		Title:     "User not found",
+		Status:    http.StatusNotFound,
+		Detail:    "no user with id 7",
+		Instance:  "/api/v1/users/7",
+		Code:      CodeUserNotFound,
+		RequestID: "abc123",
+	}, p)
+}
+
+func TestEncodeProblem_HidesInternalErrors(t *testing.T) {
+	w := httptest.NewRecorder()
+	EncodeProblem(context.Background(), errors.New("connection refused to 10.0.0.3"), w)
+
+	var p Problem
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &p))
+	assert.Equal(t, http.StatusInternalServerError, p.Status)
+	assert.Equal(t, CodeInternal, p.Code)
+	assert.Empty(t, p.Detail)
+}
@@ -0,0 +1,141 @@
+// Events package defines the domain events of the application and streams them to HTTP clients
+package events
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Type names a kind of domain event
+type Type string
+
+const (
+	TypeUserCreated  Type = "user.created"
+	TypeUserUpdated  Type = "user.updated"
+	TypeUserDeleted  Type = "user.deleted"
+	TypeUserRestored Type = "user.restored"
+)
+
+// Handler reacts to an event
+type Handler func(ctx context.Context, e Envelope) error
+
+// Event is a domain event, its concrete type describes what happened
+type Event interface {
+	EventType() Type
+}
+
+// UserCreated is published once a user has been created
+type UserCreated struct {
+	UserID        int    `json:"user_id"`
+	FirstName     string `json:"first_name"`
+	LastName      string `json:"last_name"`
+	FavoriteColor string `json:"fav_color,omitempty"`
+}
+
+// EventType implements Event
+func (UserCreated) EventType() Type { return TypeUserCreated }
+
+// UserUpdated is published once a user's favorite color has been changed
+type UserUpdated struct {
+	UserID        int    `json:"user_id"`
+	FavoriteColor string `json:"fav_color"`
+	Version       int    `json:"version"`
+}
+
+// EventType implements Event
+func (UserUpdated) EventType() Type { return TypeUserUpdated }
+
+// UserDeleted is published once a user has been soft deleted
+type UserDeleted struct {
+	UserID int `json:"user_id"`
+}
+
+// EventType implements Event
+func (UserDeleted) EventType() Type { return TypeUserDeleted }
+
+// UserRestored is published once a soft deleted user has been restored
+type UserRestored struct {
+	UserID  int `json:"user_id"`
+	Version int `json:"version"`
+}
+
+// EventType implements Event
+func (UserRestored) EventType() Type { return TypeUserRestored }
+
+// Envelope carries an event along with the metadata shared by every event
+type Envelope struct {
+	ID         string    `json:"id"`
+	Type       Type      `json:"type"`
+	OccurredAt time.Time `json:"occurred_at"`
+
+	// Actor made the change the event describes
+	Actor string `json:"actor,omitempty"`
+
+	Data Event `json:"data"`
+}
+
+// NewEnvelope wraps e in an envelope with a new random ID, stamped with the current time
+func NewEnvelope(e Event, actor string) Envelope {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return Envelope{
+		ID:         hex.EncodeToString(b),
+		Type:       e.EventType(),
+		OccurredAt: time.Now().UTC(),
+		Actor:      actor,
+		Data:       e,
+	}
+}
+
+// decoders decode the data of every event type
+var decoders = map[Type]func(data []byte) (Event, error){
+	TypeUserCreated: func(data []byte) (Event, error) {
+		var e UserCreated
+		err := json.Unmarshal(data, &e)
+		return e, err
+	},
+	TypeUserUpdated: func(data []byte) (Event, error) {
+		var e UserUpdated
+		err := json.Unmarshal(data, &e)
+		return e, err
+	},
+	TypeUserDeleted: func(data []byte) (Event, error) {
+		var e UserDeleted
+		err := json.Unmarshal(data, &e)
+		return e, err
+	},
+	TypeUserRestored: func(data []byte) (Event, error) {
+		var e UserRestored
+		err := json.Unmarshal(data, &e)
+		return e, err
+	},
+}
+
+// UnmarshalJSON decodes an envelope, decoding its data as the event type it names
+func (e *Envelope) UnmarshalJSON(b []byte) error {
+	type envelope Envelope
+	var raw struct {
+		envelope
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	decode, ok := decoders[raw.Type]
+	if !ok {
+		return fmt.Errorf("unknown event type %q", raw.Type)
+	}
+	data, err := decode(raw.Data)
+	if err != nil {
+		return err
+	}
+
+	*e = Envelope(raw.envelope)
+	e.Data = data
+	return nil
+}
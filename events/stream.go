@@ -0,0 +1,236 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TypeStreamReset is sent to a resuming client whose Last-Event-ID is older than the replay buffer, events were
+// missed and the client should reload its state
+const TypeStreamReset Type = "stream.reset"
+
+// StreamOptions configures a Stream
+type StreamOptions struct {
+	// ReplaySize is the number of recent events kept for clients resuming with Last-Event-ID
+	ReplaySize int
+
+	// Heartbeat is how often an idle stream sends a comment to keep the connection open
+	Heartbeat time.Duration
+
+	// ClientBuffer is the number of events queued for a client, a client falling further behind is disconnected
+	// and can resume with Last-Event-ID
+	ClientBuffer int
+}
+
+// streamEvent is an event along with the ID ordering it among every event of the application
+type streamEvent struct {
+	id   int64
+	typ  Type
+	data []byte
+}
+
+// Stream pushes events to HTTP clients as Server-Sent Events. Events are pushed with the ID of the outbox record
+// they were committed as, which is their SSE id, so a client can resume with Last-Event-ID on any instance of the
+// application. The most recent events are kept in a bounded buffer for resuming clients.
+type Stream struct {
+	opts StreamOptions
+
+	// last is the ID of the last event pushed, the stream has every event after floor. Both are zero until the
+	// first event is pushed.
+	mtx     sync.Mutex
+	last    int64
+	floor   int64
+	replay  []streamEvent
+	clients map[chan streamEvent]int64
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewStream returns a stream with no clients
+func NewStream(opts StreamOptions) *Stream {
+	if opts.ReplaySize <= 0 {
+		opts.ReplaySize = 1
+	}
+	if opts.Heartbeat <= 0 {
+		opts.Heartbeat = 15 * time.Second
+	}
+	if opts.ClientBuffer <= 0 {
+		opts.ClientBuffer = 1
+	}
+	return &Stream{
+		opts:    opts,
+		clients: make(map[chan streamEvent]int64),
+		done:    make(chan struct{}),
+	}
+}
+
+// Push pushes e to every connected client with id as its SSE id. Events are pushed in the order of their IDs, an
+// event whose ID is not after the last one pushed was pushed already and is ignored. Push never blocks on slow
+// clients.
+func (s *Stream) Push(id int64, e Envelope) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	select {
+	case <-s.done:
+		return nil
+	default:
+	}
+	if id <= s.last {
+		return nil
+	}
+
+	if s.last == 0 {
+		// The stream follows the outbox from this event on, it may have missed any event before it
+		s.floor = id - 1
+	}
+	s.last = id
+	se := streamEvent{id: id, typ: e.Type, data: data}
+	s.replay = append(s.replay, se)
+	if len(s.replay) > s.opts.ReplaySize {
+		evicted := len(s.replay) - s.opts.ReplaySize
+		s.floor = s.replay[evicted-1].id
+		s.replay = append(s.replay[:0:0], s.replay[evicted:]...)
+	}
+
+	for c, after := range s.clients {
+		if id <= after {
+			continue
+		}
+		select {
+		case c <- se:
+		default:
+			delete(s.clients, c)
+			close(c)
+		}
+	}
+	return nil
+}
+
+// ServeHTTP streams events to the client until it goes away, falls too far behind or the stream is closed.
+// Clients sending Last-Event-ID first receive the buffered events they missed.
+func (s *Stream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	lastID := int64(-1)
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		if id, err := strconv.ParseInt(v, 10, 64); err == nil && id >= 0 {
+			lastID = id
+		}
+	}
+
+	c, missed, reset := s.subscribe(lastID)
+	if c == nil {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	defer s.unsubscribe(c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if reset {
+		fmt.Fprintf(w, "event: %s\ndata: {}\n\n", TypeStreamReset)
+	}
+	for _, se := range missed {
+		if writeEvent(w, se) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(s.opts.Heartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case se, ok := <-c:
+			if !ok {
+				return
+			}
+			if writeEvent(w, se) != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-s.done:
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// Close ends every client stream and stops accepting events and clients. It is meant to be registered with
+// http.Server.RegisterOnShutdown, a server shutdown would otherwise wait for streams that never end.
+func (s *Stream) Close() {
+	s.closeOnce.Do(func() { close(s.done) })
+}
+
+// subscribe registers a client and returns the buffered events after lastID, a negative lastID replays nothing.
+// reset is set when events after lastID may have been missed: the stream started after lastID, evicted events
+// after it, or has not received any event yet. A client ahead of the stream, e.g. one that resumes on an instance
+// lagging behind the one it left, only receives the events after lastID. A nil channel is returned once the
+// stream is closed.
+func (s *Stream) subscribe(lastID int64) (c chan streamEvent, missed []streamEvent, reset bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	select {
+	case <-s.done:
+		return nil, nil, false
+	default:
+	}
+
+	c = make(chan streamEvent, s.opts.ClientBuffer)
+	s.clients[c] = lastID
+
+	if lastID < 0 {
+		return c, nil, false
+	}
+	reset = s.last == 0 || lastID < s.floor
+	for _, se := range s.replay {
+		if se.id > lastID {
+			missed = append(missed, se)
+		}
+	}
+	return c, missed, reset
+}
+
+// unsubscribe removes a client unless Push already dropped it
+func (s *Stream) unsubscribe(c chan streamEvent) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, ok := s.clients[c]; ok {
+		delete(s.clients, c)
+		close(c)
+	}
+}
+
+// writeEvent writes se in the event stream format
+func writeEvent(w http.ResponseWriter, se streamEvent) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", se.id, se.typ, se.data)
+	return err
+}
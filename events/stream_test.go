@@ -0,0 +1,116 @@
+package events
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readFrames reads n event stream frames, skipping heartbeat comments. Frames are summarized as their fields
+// joined by "|", data values are elided.
+func readFrames(t *testing.T, r *bufio.Reader, n int) []string {
+	var frames []string
+	var fields []string
+	for len(frames) < n {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && len(fields) > 0:
+			frames = append(frames, strings.Join(fields, "|"))
+			fields = nil
+		case strings.HasPrefix(line, "data: "):
+			fields = append(fields, "data:")
+		case line != "" && !strings.HasPrefix(line, ":"):
+			fields = append(fields, strings.Replace(line, ": ", ":", 1))
+		}
+	}
+	return frames
+}
+
+func TestStream_ResumesAndPushes(t *testing.T) {
+	s := NewStream(StreamOptions{ReplaySize: 2, Heartbeat: time.Hour, ClientBuffer: 8})
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	for i := 1; i <= 3; i++ {
+		s.Push(int64(10+i), NewEnvelope(UserCreated{UserID: i}, ""))
+	}
+
+	// Event 12 is still buffered so the client only misses event 13
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Last-Event-ID", "12")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	r := bufio.NewReader(res.Body)
+	assert.Equal(t, []string{"id:13|event:user.created|data:"}, readFrames(t, r, 1))
+
+	// Events pushed again are ignored, IDs need not be contiguous
+	s.Push(13, NewEnvelope(UserCreated{UserID: 3}, ""))
+	s.Push(20, NewEnvelope(UserDeleted{UserID: 1}, ""))
+	assert.Equal(t, []string{"id:20|event:user.deleted|data:"}, readFrames(t, r, 1))
+
+	// Closing the stream ends the response
+	s.Close()
+	_, err = r.ReadString('\n')
+	assert.Error(t, err)
+}
+
+func TestStream_ResetsWhenEventsWereEvicted(t *testing.T) {
+	s := NewStream(StreamOptions{ReplaySize: 1, Heartbeat: time.Hour, ClientBuffer: 8})
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	defer s.Close()
+
+	for i := 1; i <= 3; i++ {
+		s.Push(int64(10+i), NewEnvelope(UserCreated{UserID: i}, ""))
+	}
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Last-Event-ID", "11")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	frames := readFrames(t, bufio.NewReader(res.Body), 2)
+	assert.Equal(t, []string{"event:stream.reset|data:", "id:13|event:user.created|data:"}, frames)
+}
+
+func TestStream_ResumesFromAnotherInstance(t *testing.T) {
+	s := NewStream(StreamOptions{ReplaySize: 8, Heartbeat: time.Hour, ClientBuffer: 8})
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	defer s.Close()
+
+	s.Push(5, NewEnvelope(UserCreated{UserID: 1}, ""))
+	s.Push(6, NewEnvelope(UserCreated{UserID: 2}, ""))
+
+	// The client saw event 7 on an instance ahead of this one, it waits for the events after it
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Last-Event-ID", "7")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	r := bufio.NewReader(res.Body)
+	s.Push(7, NewEnvelope(UserCreated{UserID: 3}, ""))
+	s.Push(8, NewEnvelope(UserDeleted{UserID: 3}, ""))
+	assert.Equal(t, []string{"id:8|event:user.deleted|data:"}, readFrames(t, r, 1))
+
+	// A client that left before this instance started may have missed events
+	req.Header.Set("Last-Event-ID", "3")
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	frames := readFrames(t, bufio.NewReader(res.Body), 2)
+	assert.Equal(t, []string{"event:stream.reset|data:", "id:5|event:user.created|data:"}, frames)
+}
@@ -4,9 +4,14 @@ go 1.15
 
 require (
 	github.com/go-kit/kit v0.10.0
+	github.com/golang-jwt/jwt v3.2.2+incompatible
 	github.com/golang/mock v1.4.4
 	github.com/gorilla/mux v1.8.0
+	github.com/lib/pq v1.10.9
 	github.com/prometheus/client_golang v1.9.0
+	github.com/sony/gobreaker v0.5.0
 	github.com/spf13/viper v1.7.1
 	github.com/stretchr/testify v1.7.0
+	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e
+	golang.org/x/text v0.3.2
 )
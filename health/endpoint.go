@@ -23,3 +23,19 @@ func makeHealthCheckEndpoint() endpoint.Endpoint {
 		return healthCheckResponse{}, nil
 	}
 }
+
+// Check reports whether a dependency is ready to serve requests, returning an application error describing why
+// it is not, e.g. ErrUnavailable
+type Check func(ctx context.Context) error
+
+// makeReadinessEndpoint returns a go-kit endpoint failing with the error of the first check that is not ready
+func makeReadinessEndpoint(checks []Check) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		for _, check := range checks {
+			if err := check(ctx); err != nil {
+				return healthCheckResponse{Error: err}, nil
+			}
+		}
+		return healthCheckResponse{}, nil
+	}
+}
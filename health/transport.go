@@ -6,6 +6,7 @@ import (
 	"context"
 	"encoding/json"
 
+	errs "github.com/bnelz/gokit-base/errors"
 	kitlog "github.com/go-kit/kit/log"
 	kithttp "github.com/go-kit/kit/transport/http"
 
@@ -37,6 +38,33 @@ func MakeHandler(logger kitlog.Logger) http.Handler {
 	return r
 }
 
+// MakeProbeHandler builds a go-kit http transport for liveness and readiness probes and returns it. The
+// readiness probe fails while any of checks does.
+func MakeProbeHandler(logger kitlog.Logger, checks ...Check) http.Handler {
+	opts := []kithttp.ServerOption{
+		kithttp.ServerErrorLogger(logger),
+	}
+
+	liveHandler := kithttp.NewServer(
+		makeHealthCheckEndpoint(),
+		decodeHealthCheckRequest,
+		encodeHealthCheckResponse,
+		opts...,
+	)
+
+	readyHandler := kithttp.NewServer(
+		makeReadinessEndpoint(checks),
+		decodeHealthCheckRequest,
+		encodeHealthCheckResponse,
+		opts...,
+	)
+
+	r := mux.NewRouter()
+	r.Handle("/health/live", liveHandler).Methods("GET")
+	r.Handle("/health/ready", readyHandler).Methods("GET")
+	return r
+}
+
 // decodeHealthCheckRequest returns an empty healthCheck request because there are no params for this request
 func decodeHealthCheckRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	return healthCheckRequest{}, nil
@@ -52,11 +80,7 @@ func encodeHealthCheckResponse(ctx context.Context, w http.ResponseWriter, respo
 	return json.NewEncoder(w).Encode(response)
 }
 
-// encodeError writes error headers if an error was received from a health check
-func encodeError(_ context.Context, err error, w http.ResponseWriter) {
-	w.WriteHeader(http.StatusInternalServerError)
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"error": err.Error(),
-	})
+// encodeError renders an error received from a health check as RFC 7807 problem details
+func encodeError(ctx context.Context, err error, w http.ResponseWriter) {
+	errs.EncodeProblem(ctx, err, w)
 }
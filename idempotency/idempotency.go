@@ -0,0 +1,260 @@
+// Idempotency package implements the Idempotency-Key header as HTTP middleware, so clients can safely retry
+// requests that are not idempotent by nature
+package idempotency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/bnelz/gokit-base/auth"
+	errs "github.com/bnelz/gokit-base/errors"
+	kithttp "github.com/go-kit/kit/transport/http"
+)
+
+const (
+	// Header carries the key a client chose for a request and reuses when retrying it
+	Header = "Idempotency-Key"
+
+	// ReplayedHeader is set on responses replayed from the store
+	ReplayedHeader = "Idempotent-Replayed"
+
+	// maxKeyLength bounds the length of client chosen keys
+	maxKeyLength = 255
+)
+
+// ErrTooManyKeys is returned by stores refusing to reserve another key for a client holding too many
+var ErrTooManyKeys = errors.New("too many idempotency keys")
+
+// Response is a response stored for replay
+type Response struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// Entry is the state of a key in the store
+type Entry struct {
+	// Fingerprint identifies the request the key was first used for
+	Fingerprint string
+
+	// Response is nil while the first request is in progress
+	Response *Response
+
+	ExpiresAt time.Time
+}
+
+// Store is the set of behavior a store of idempotency keys must conform to. Keys are scoped to the client that
+// chose them, keys of different clients never collide.
+type Store interface {
+	// Reserve claims the key of client for the request with the given fingerprint until ttl has passed. It returns
+	// nil if the key was claimed, or the existing entry if the key is already in use. Stores bounding the keys of a
+	// client fail with ErrTooManyKeys.
+	Reserve(client string, key string, fingerprint string, ttl time.Duration) (*Entry, error)
+
+	// Complete stores the response of the request that claimed the key of client
+	Complete(client string, key string, res *Response) error
+
+	// Release forgets the key of client so the request can be retried
+	Release(client string, key string) error
+}
+
+// Options configures the middleware
+type Options struct {
+	// TTL is how long responses are kept for replay
+	TTL time.Duration
+
+	// Methods lists the methods honoring the header, defaults to POST and PUT
+	Methods []string
+
+	// Client identifies the client making a request, keys of different clients never collide. It must not trust
+	// anything a client can claim without proof, see auth.Client. Defaults to the remote IP.
+	Client func(r *http.Request) string
+
+	// MaxBodyBytes bounds the bodies buffered to fingerprint requests, larger requests fail with 413. Defaults
+	// to 1 MiB.
+	MaxBodyBytes int64
+
+	// ExemptPaths lists paths whose requests ignore the header, e.g. bulk imports with bodies too large to buffer
+	ExemptPaths []string
+}
+
+// New returns middleware honoring the Idempotency-Key header. The first response to a key is stored and replayed
+// for requests repeating it, a key reused for a different method, path or body is rejected with 422. Responses
+// telling the client to try again later are not stored so their requests can be retried: server errors, 429 and
+// the 409 answered while the first request is in progress.
+func New(store Store, opts Options) func(http.Handler) http.Handler {
+	if opts.TTL <= 0 {
+		opts.TTL = 24 * time.Hour
+	}
+	if len(opts.Methods) == 0 {
+		opts.Methods = []string{http.MethodPost, http.MethodPut}
+	}
+	if opts.Client == nil {
+		opts.Client = auth.RemoteIP
+	}
+	if opts.MaxBodyBytes <= 0 {
+		opts.MaxBodyBytes = 1 << 20
+	}
+	methods := make(map[string]bool, len(opts.Methods))
+	for _, m := range opts.Methods {
+		methods[m] = true
+	}
+	exempt := make(map[string]bool, len(opts.ExemptPaths))
+	for _, p := range opts.ExemptPaths {
+		exempt[p] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(Header)
+			if key == "" || !methods[r.Method] || exempt[r.URL.Path] {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > maxKeyLength {
+				encodeError(w, r, errs.ErrInvalidArgument.WithDetail("Idempotency-Key is longer than 255 characters"))
+				return
+			}
+
+			body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, opts.MaxBodyBytes))
+			switch {
+			case err != nil && int64(len(body)) >= opts.MaxBodyBytes:
+				encodeError(w, r, errs.ErrPayloadTooLarge)
+				return
+			case err != nil:
+				encodeError(w, r, errs.ErrInvalidArgument.WithDetail("request body could not be read"))
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+			client := opts.Client(r)
+			fingerprint := fingerprint(r, body)
+
+			existing, err := store.Reserve(client, key, fingerprint, opts.TTL)
+			switch {
+			case err == ErrTooManyKeys:
+				encodeError(w, r, errs.ErrRateLimited.WithDetail("too many requests with an Idempotency-Key in progress"))
+			case err != nil:
+				encodeError(w, r, errs.ErrInternal.Wrap(err))
+			case existing == nil:
+				serve(next, store, client, key, w, r)
+			case existing.Fingerprint != fingerprint:
+				encodeError(w, r, errs.ErrIdempotencyKey)
+			case existing.Response == nil:
+				encodeError(w, r, errs.ErrRequestInFlight)
+			default:
+				replay(w, existing.Response)
+			}
+		})
+	}
+}
+
+// serve handles a request whose key was reserved and stores its response. The key is released if the response is
+// retryable or the handler panics.
+func serve(next http.Handler, store Store, client string, key string, w http.ResponseWriter, r *http.Request) {
+	rec := &recorder{ResponseWriter: w, before: w.Header().Clone()}
+	stored := false
+	defer func() {
+		if !stored {
+			store.Release(client, key)
+		}
+	}()
+
+	next.ServeHTTP(rec, r)
+
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+		rec.header = rec.changedHeader()
+	}
+	if retryable(rec.status) {
+		return
+	}
+	stored = store.Complete(client, key, &Response{Status: rec.status, Header: rec.header, Body: rec.body.Bytes()}) == nil
+}
+
+// retryable reports whether a response with status asks the client to retry, such as a rate limited request or an
+// unavailable dependency
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusRequestTimeout ||
+		status >= http.StatusInternalServerError
+}
+
+// replay writes a stored response
+func replay(w http.ResponseWriter, res *Response) {
+	for k, v := range res.Header {
+		w.Header()[k] = append([]string(nil), v...)
+	}
+	w.Header().Set(ReplayedHeader, "true")
+	w.WriteHeader(res.Status)
+	w.Write(res.Body)
+}
+
+// fingerprint identifies a request by its method, path and body
+func fingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.RequestURI() + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// encodeError writes err as problem details
+func encodeError(w http.ResponseWriter, r *http.Request, err error) {
+	errs.EncodeProblem(kithttp.PopulateRequestContext(r.Context(), r), err, w)
+}
+
+// recorder copies a response as it is written
+type recorder struct {
+	http.ResponseWriter
+
+	// before holds the headers set by outer middleware, they are not part of the stored response
+	before http.Header
+
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+		rec.header = rec.changedHeader()
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// changedHeader returns the headers set by the handler
+func (rec *recorder) changedHeader() http.Header {
+	changed := make(http.Header)
+	for k, v := range rec.ResponseWriter.Header() {
+		if !equal(rec.before[k], v) {
+			changed[k] = append([]string(nil), v...)
+		}
+	}
+	return changed
+}
+
+// equal reports whether two header values are the same
+func equal(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,139 @@
+package idempotency_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	errs "github.com/bnelz/gokit-base/errors"
+	"github.com/bnelz/gokit-base/idempotency"
+	"github.com/bnelz/gokit-base/inmemory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// do sends a request through h with the given idempotency key from the client at the given address
+func do(h http.Handler, method string, body string, key string, ip string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/api/v1/users", strings.NewReader(body))
+	r.RemoteAddr = ip + ":4321"
+	r.Header.Set(idempotency.Header, key)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func problemCode(t *testing.T, w *httptest.ResponseRecorder) errs.Code {
+	var p errs.Problem
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &p))
+	return p.Code
+}
+
+func TestIdempotency_ReplaysFirstResponse(t *testing.T) {
+	calls := 0
+	h := idempotency.New(inmemory.NewInMemIdempotencyStore(10, 10), idempotency.Options{})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Header().Set("Location", "/api/v1/users/1")
+			w.WriteHeader(http.StatusCreated)
+			w.Write(body)
+		}),
+	)
+
+	first := do(h, "POST", `{"id":1}`, "k1", "10.0.0.1")
+	second := do(h, "POST", `{"id":1}`, "k1", "10.0.0.1")
+
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, http.StatusCreated, second.Code)
+	assert.Equal(t, first.Body.String(), second.Body.String())
+	assert.Equal(t, `{"id":1}`, second.Body.String())
+	assert.Equal(t, "/api/v1/users/1", second.Header().Get("Location"))
+	assert.Equal(t, "true", second.Header().Get(idempotency.ReplayedHeader))
+	assert.Empty(t, first.Header().Get(idempotency.ReplayedHeader))
+
+	// Keys are scoped to the client and only apply to the configured methods
+	do(h, "POST", `{"id":1}`, "k1", "10.0.0.2")
+	do(h, "GET", "", "k1", "10.0.0.1")
+	assert.Equal(t, 3, calls)
+}
+
+func TestIdempotency_RejectsKeyReusedForAnotherRequest(t *testing.T) {
+	h := idempotency.New(inmemory.NewInMemIdempotencyStore(10, 10), idempotency.Options{})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusCreated) }),
+	)
+
+	do(h, "POST", `{"id":1}`, "k1", "10.0.0.1")
+	w := do(h, "POST", `{"id":2}`, "k1", "10.0.0.1")
+
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Equal(t, errs.CodeIdempotencyKey, problemCode(t, w))
+}
+
+func TestIdempotency_RetryableResponsesAreNotStored(t *testing.T) {
+	for _, status := range []int{http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusGatewayTimeout} {
+		fail := true
+		h := idempotency.New(inmemory.NewInMemIdempotencyStore(10, 10), idempotency.Options{})(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if fail {
+					fail = false
+					w.WriteHeader(status)
+					return
+				}
+				w.WriteHeader(http.StatusCreated)
+			}),
+		)
+
+		assert.Equal(t, status, do(h, "POST", `{}`, "k1", "10.0.0.1").Code)
+		w := do(h, "POST", `{}`, "k1", "10.0.0.1")
+		assert.Equal(t, http.StatusCreated, w.Code, status)
+		assert.Empty(t, w.Header().Get(idempotency.ReplayedHeader), status)
+	}
+}
+
+func TestIdempotency_RejectsConcurrentRetry(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	h := idempotency.New(inmemory.NewInMemIdempotencyStore(10, 10), idempotency.Options{})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			w.WriteHeader(http.StatusCreated)
+		}),
+	)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- do(h, "POST", `{}`, "k1", "10.0.0.1") }()
+	<-started
+
+	w := do(h, "POST", `{}`, "k1", "10.0.0.1")
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, errs.CodeRequestInFlight, problemCode(t, w))
+
+	close(release)
+	assert.Equal(t, http.StatusCreated, (<-done).Code)
+}
+
+func TestIdempotency_BoundsBodiesAndSkipsExemptPaths(t *testing.T) {
+	calls := 0
+	h := idempotency.New(inmemory.NewInMemIdempotencyStore(10, 10), idempotency.Options{
+		MaxBodyBytes: 8,
+		ExemptPaths:  []string{"/api/v1/users:import"},
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	w := do(h, "POST", `{"id":12345}`, "k1", "10.0.0.1")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Equal(t, errs.CodePayloadTooLarge, problemCode(t, w))
+	assert.Equal(t, 0, calls)
+
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest("POST", "/api/v1/users:import", strings.NewReader(`{"users":[]}`))
+		r.Header.Set(idempotency.Header, "k2")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	assert.Equal(t, 2, calls)
+}
@@ -0,0 +1,64 @@
+package inmemory
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/bnelz/gokit-base/users"
+)
+
+// inMemAuditStore is an implementation of an audit store in local memory
+type inMemAuditStore struct {
+	mtx     *sync.RWMutex
+	entries map[int][]*users.AuditEntry
+
+	// lastID is the ID of the most recently appended entry
+	lastID int
+}
+
+// NewInMemAuditStore returns a new audit store for storage in local memory. The repositories of this package keep
+// the entries committed by their transactions themselves.
+func NewInMemAuditStore() users.AuditStore {
+	return newInMemAuditStore()
+}
+
+func newInMemAuditStore() *inMemAuditStore {
+	return &inMemAuditStore{
+		mtx:     new(sync.RWMutex),
+		entries: make(map[int][]*users.AuditEntry),
+	}
+}
+
+// Append stores a copy of entry so it cannot be changed afterwards
+func (as *inMemAuditStore) Append(_ context.Context, entry *users.AuditEntry) error {
+	as.mtx.Lock()
+	defer as.mtx.Unlock()
+
+	as.lastID++
+	entry.ID = as.lastID
+	as.entries[entry.UserID] = append(as.entries[entry.UserID], copyEntry(entry))
+	return nil
+}
+
+// History returns copies of a user's entries, which are kept in ID order
+func (as *inMemAuditStore) History(_ context.Context, userID int, afterID int, limit int) ([]*users.AuditEntry, error) {
+	as.mtx.RLock()
+	defer as.mtx.RUnlock()
+
+	entries := as.entries[userID]
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].ID > afterID })
+
+	history := []*users.AuditEntry{}
+	for ; i < len(entries) && len(history) < limit; i++ {
+		history = append(history, copyEntry(entries[i]))
+	}
+	return history, nil
+}
+
+// copyEntry returns a deep copy of e
+func copyEntry(e *users.AuditEntry) *users.AuditEntry {
+	c := *e
+	c.Changes = append([]users.FieldChange(nil), e.Changes...)
+	return &c
+}
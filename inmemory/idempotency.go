@@ -0,0 +1,166 @@
+package inmemory
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/bnelz/gokit-base/idempotency"
+)
+
+// idempotencySweepInterval is how often expired idempotency keys are removed
+const idempotencySweepInterval = time.Minute
+
+// inMemIdempotencyStore is an implementation of an idempotency key store in local memory
+type inMemIdempotencyStore struct {
+	mtx *sync.Mutex
+
+	// size bounds the number of keys and perClient the number of keys of a client. order lists every key from the
+	// oldest reservation to the newest, clients lists the keys of each client in the same order.
+	size      int
+	perClient int
+	entries   map[idempotencyScope]*idempotencyKey
+	order     *list.List
+	clients   map[string]*list.List
+
+	// now is the clock entries expire by
+	now func() time.Time
+
+	// nextSweep is when expired entries are next removed
+	nextSweep time.Time
+}
+
+// idempotencyScope is a key chosen by a client
+type idempotencyScope struct {
+	client string
+	key    string
+}
+
+// idempotencyKey is a key of the store along with its entry and its elements in the order of the store and of
+// its client
+type idempotencyKey struct {
+	scope idempotencyScope
+	entry idempotency.Entry
+
+	inStore  *list.Element
+	inClient *list.Element
+}
+
+// NewInMemIdempotencyStore returns a new idempotency key store in local memory holding up to size keys, 100000 if
+// size is not positive, and up to perClient keys of a client, 1000 if perClient is not positive. The oldest
+// completed key is forgotten to make room for another, so a flood of keys cannot exhaust memory: a client holding
+// perClient keys makes room among its own so it cannot push out the keys of others. Keys of requests in progress
+// are never forgotten, a client with perClient requests in progress cannot reserve another key.
+func NewInMemIdempotencyStore(size int, perClient int) idempotency.Store {
+	if size <= 0 {
+		size = 100000
+	}
+	if perClient <= 0 {
+		perClient = 1000
+	}
+	return &inMemIdempotencyStore{
+		mtx:       new(sync.Mutex),
+		size:      size,
+		perClient: perClient,
+		entries:   make(map[idempotencyScope]*idempotencyKey),
+		order:     list.New(),
+		clients:   make(map[string]*list.List),
+		now:       time.Now,
+	}
+}
+
+// Reserve claims key unless an entry that has not expired holds it
+func (is *inMemIdempotencyStore) Reserve(client string, key string, fingerprint string, ttl time.Duration) (*idempotency.Entry, error) {
+	is.mtx.Lock()
+	defer is.mtx.Unlock()
+
+	now := is.now()
+	is.sweep(now)
+
+	scope := idempotencyScope{client, key}
+	if k, ok := is.entries[scope]; ok {
+		if now.Before(k.entry.ExpiresAt) {
+			e := k.entry
+			return &e, nil
+		}
+		is.remove(k)
+	}
+
+	if own := is.clients[client]; own != nil && own.Len() >= is.perClient && !is.evict(own) {
+		return nil, idempotency.ErrTooManyKeys
+	}
+	for is.order.Len() >= is.size {
+		if !is.evict(is.order) {
+			break
+		}
+	}
+
+	own := is.clients[client]
+	if own == nil {
+		own = list.New()
+		is.clients[client] = own
+	}
+	k := &idempotencyKey{scope: scope, entry: idempotency.Entry{Fingerprint: fingerprint, ExpiresAt: now.Add(ttl)}}
+	k.inStore = is.order.PushBack(k)
+	k.inClient = own.PushBack(k)
+	is.entries[scope] = k
+	return nil, nil
+}
+
+// Complete stores the response of a reserved key
+func (is *inMemIdempotencyStore) Complete(client string, key string, res *idempotency.Response) error {
+	is.mtx.Lock()
+	defer is.mtx.Unlock()
+
+	if k, ok := is.entries[idempotencyScope{client, key}]; ok {
+		k.entry.Response = res
+	}
+	return nil
+}
+
+// Release removes a key
+func (is *inMemIdempotencyStore) Release(client string, key string) error {
+	is.mtx.Lock()
+	defer is.mtx.Unlock()
+
+	if k, ok := is.entries[idempotencyScope{client, key}]; ok {
+		is.remove(k)
+	}
+	return nil
+}
+
+// sweep removes expired entries at most once per sweep interval. The caller must hold mtx.
+func (is *inMemIdempotencyStore) sweep(now time.Time) {
+	if now.Before(is.nextSweep) {
+		return
+	}
+	for _, k := range is.entries {
+		if !now.Before(k.entry.ExpiresAt) {
+			is.remove(k)
+		}
+	}
+	is.nextSweep = now.Add(idempotencySweepInterval)
+}
+
+// evict forgets the oldest completed key of order and reports whether there was one. The caller must hold mtx.
+func (is *inMemIdempotencyStore) evict(order *list.List) bool {
+	for el := order.Front(); el != nil; el = el.Next() {
+		if k := el.Value.(*idempotencyKey); k.entry.Response != nil {
+			is.remove(k)
+			return true
+		}
+	}
+	return false
+}
+
+// remove forgets k. The caller must hold mtx.
+func (is *inMemIdempotencyStore) remove(k *idempotencyKey) {
+	is.order.Remove(k.inStore)
+	delete(is.entries, k.scope)
+
+	own := is.clients[k.scope.client]
+	own.Remove(k.inClient)
+	if own.Len() == 0 {
+		delete(is.clients, k.scope.client)
+	}
+}
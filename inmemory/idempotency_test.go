@@ -0,0 +1,63 @@
+package inmemory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bnelz/gokit-base/idempotency"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// reserve reserves and completes keys of client
+func reserve(t *testing.T, is idempotency.Store, client string, keys ...string) {
+	for _, key := range keys {
+		existing, err := is.Reserve(client, key, "f", time.Hour)
+		require.NoError(t, err)
+		assert.Nil(t, existing)
+		require.NoError(t, is.Complete(client, key, &idempotency.Response{Status: 201}))
+	}
+}
+
+func TestInMemIdempotencyStore_ForgetsOldestKeyWhenFull(t *testing.T) {
+	is := NewInMemIdempotencyStore(2, 10)
+	reserve(t, is, "alice", "a")
+	reserve(t, is, "bob", "b", "c")
+
+	// a made room for c, b is still held
+	existing, _ := is.Reserve("alice", "a", "f", time.Hour)
+	assert.Nil(t, existing)
+	existing, _ = is.Reserve("bob", "c", "f", time.Hour)
+	assert.NotNil(t, existing)
+	assert.Len(t, is.(*inMemIdempotencyStore).entries, 2)
+}
+
+func TestInMemIdempotencyStore_ClientsMakeRoomAmongTheirOwnKeys(t *testing.T) {
+	is := NewInMemIdempotencyStore(10, 2)
+	reserve(t, is, "alice", "a")
+	reserve(t, is, "mallory", "m1", "m2", "m3", "m4")
+
+	existing, _ := is.Reserve("alice", "a", "f", time.Hour)
+	assert.NotNil(t, existing)
+	existing, _ = is.Reserve("mallory", "m1", "f", time.Hour)
+	assert.Nil(t, existing)
+}
+
+func TestInMemIdempotencyStore_NeverForgetsRequestsInProgress(t *testing.T) {
+	is := NewInMemIdempotencyStore(1, 1)
+
+	existing, err := is.Reserve("alice", "a", "f", time.Hour)
+	require.NoError(t, err)
+	assert.Nil(t, existing)
+
+	// The store is full of a request in progress, other clients still get keys
+	_, err = is.Reserve("alice", "b", "f", time.Hour)
+	assert.Equal(t, idempotency.ErrTooManyKeys, err)
+	existing, err = is.Reserve("bob", "b", "f", time.Hour)
+	require.NoError(t, err)
+	assert.Nil(t, existing)
+
+	existing, _ = is.Reserve("alice", "a", "f", time.Hour)
+	require.NotNil(t, existing)
+	assert.Nil(t, existing.Response)
+}
@@ -1,9 +1,15 @@
 package inmemory
 
 import (
+	"context"
+	"fmt"
+	"sort"
 	"sync"
+	"time"
 
 	errs "github.com/bnelz/gokit-base/errors"
+	"github.com/bnelz/gokit-base/events"
+	"github.com/bnelz/gokit-base/outbox"
 	"github.com/bnelz/gokit-base/users"
 )
 
@@ -11,43 +17,502 @@ import (
 type inMemUserRepository struct {
 	mtx   *sync.RWMutex
 	users map[int]*users.User
+
+	// lastID is the highest ID allocated or stored so far
+	lastID int
+
+	// now is the clock used to stamp deletions
+	now func() time.Time
+
+	// journal holds the users changed by the running transaction as they were before it, nil outside transactions
+	journal map[int]*users.User
+
+	// outbox holds the events of committed transactions until every consumer relayed them, cursors holds the ID
+	// of the last record each consumer relayed and leases the process relaying to it
+	outbox       []outbox.Record
+	lastRecordID int64
+	cursors      map[string]int64
+	leases       map[string]lease
+
+	// inMemAuditStore keeps the audit entries committed by transactions
+	*inMemAuditStore
+}
+
+// lease is a consumer leased to an owner until a point in time
+type lease struct {
+	owner string
+	until time.Time
+}
+
+// InMemUserRepository is a user repository that also allocates monotonic user IDs and keeps an outbox of the
+// events and the audit entries committed by its transactions
+type InMemUserRepository interface {
+	users.Repository
+	users.IDGenerator
+	users.Transactor
+	users.AuditStore
+	outbox.Store
 }
 
 // NewInMemUserRepository returns a new user repository for storage in local memory
-func NewInMemUserRepository() users.Repository {
+func NewInMemUserRepository() InMemUserRepository {
 	return &inMemUserRepository{
-		mtx:   new(sync.RWMutex),
-		users: make(map[int]*users.User),
+		mtx:     new(sync.RWMutex),
+		users:   make(map[int]*users.User),
+		now:     time.Now,
+		cursors: make(map[string]int64),
+		leases:  make(map[string]lease),
+
+		inMemAuditStore: newInMemAuditStore(),
 	}
 }
 
-// Store inserts a user into the local user map
-func (ir *inMemUserRepository) Store(user *users.User) error {
+// Insert adds a user to the local user map unless its ID is already taken
+func (ir *inMemUserRepository) Insert(_ context.Context, user *users.User) error {
 	ir.mtx.Lock()
-	ir.users[user.ID] = user
-	ir.mtx.Unlock()
-	return nil
+	defer ir.mtx.Unlock()
+	return ir.insert(user)
+}
+
+// Store inserts a user into the local user map, checking its version against the stored user first
+func (ir *inMemUserRepository) Store(_ context.Context, user *users.User) error {
+	ir.mtx.Lock()
+	defer ir.mtx.Unlock()
+	return ir.storeUser(user)
+}
+
+// Delete marks a user in the local user map as deleted, checking its version first
+func (ir *inMemUserRepository) Delete(_ context.Context, id int, version int) error {
+	ir.mtx.Lock()
+	defer ir.mtx.Unlock()
+	return ir.delete(id, version)
+}
+
+// Restore clears the deleted mark of a user, checking its version first
+func (ir *inMemUserRepository) Restore(_ context.Context, id int, version int) (*users.User, error) {
+	ir.mtx.Lock()
+	defer ir.mtx.Unlock()
+	return ir.restore(id, version)
+}
+
+// Purge removes users deleted before the cutoff from the local user map
+func (ir *inMemUserRepository) Purge(_ context.Context, deletedBefore time.Time) int {
+	ir.mtx.Lock()
+	defer ir.mtx.Unlock()
+	return ir.purge(deletedBefore)
+}
+
+// InsertBatch adds many users to the local user map while holding the lock once
+func (ir *inMemUserRepository) InsertBatch(_ context.Context, batch []*users.User, atomic bool) []error {
+	ir.mtx.Lock()
+	defer ir.mtx.Unlock()
+	return ir.insertBatch(batch, atomic)
+}
+
+// FindAfter returns a page of users ordered by ID
+func (ir *inMemUserRepository) FindAfter(_ context.Context, afterID int, limit int) []*users.User {
+	ir.mtx.RLock()
+	defer ir.mtx.RUnlock()
+	return ir.findAfter(afterID, limit)
 }
 
 // Find retrieves a single user from the repository
-func (ir *inMemUserRepository) Find(id int) (*users.User, error) {
+func (ir *inMemUserRepository) Find(_ context.Context, id int, includeDeleted bool) (*users.User, error) {
+	ir.mtx.RLock()
+	defer ir.mtx.RUnlock()
+	return ir.find(id, includeDeleted)
+}
+
+// FindAll retrieves all users from memory
+func (ir *inMemUserRepository) FindAll(_ context.Context, includeDeleted bool) []*users.User {
 	ir.mtx.RLock()
-	u := ir.users[id]
-	ir.mtx.RUnlock()
+	defer ir.mtx.RUnlock()
+	return ir.findAll(includeDeleted)
+}
 
-	if u == nil {
-		return nil, errs.ErrUserNotFound
+// NextID allocates the ID following the highest one seen so far
+func (ir *inMemUserRepository) NextID(_ context.Context) (int, error) {
+	ir.mtx.Lock()
+	defer ir.mtx.Unlock()
+
+	ir.lastID++
+	return ir.lastID, nil
+}
+
+// Transact holds the lock while fn runs so transactions are serialized. Users changed by fn are journaled and
+// restored if fn fails, panics or outlives ctx, the events it records only reach the outbox once it succeeds.
+func (ir *inMemUserRepository) Transact(ctx context.Context, fn func(repo users.Repository, record func(e events.Envelope), audit func(entry *users.AuditEntry)) error) error {
+	ir.mtx.Lock()
+	defer ir.mtx.Unlock()
+
+	ir.journal = make(map[int]*users.User)
+	committed := false
+	defer func() {
+		if !committed {
+			ir.rollback()
+		}
+		ir.journal = nil
+	}()
+
+	var recorded []events.Envelope
+	var audited []*users.AuditEntry
+	err := fn(&inMemUserTx{ir}, func(e events.Envelope) { recorded = append(recorded, e) }, func(entry *users.AuditEntry) {
+		audited = append(audited, entry)
+	})
+	if err != nil {
+		return err
+	}
+	// A transaction outliving its context is rolled back, like a database transaction would be
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	now := ir.now().UTC()
+	for _, e := range recorded {
+		ir.lastRecordID++
+		ir.outbox = append(ir.outbox, outbox.Record{ID: ir.lastRecordID, Event: e, CreatedAt: now})
 	}
-	return u, nil
+	for _, entry := range audited {
+		ir.Append(ctx, entry)
+	}
+	committed = true
+	return nil
 }
 
-// FindAll retrieves all users from memory
-func (ir *inMemUserRepository) FindAll() []*users.User {
+// Register starts the cursor of a new consumer after the last record committed so far
+func (ir *inMemUserRepository) Register(_ context.Context, consumer string) error {
+	ir.mtx.Lock()
+	defer ir.mtx.Unlock()
+
+	if _, ok := ir.cursors[consumer]; !ok {
+		ir.cursors[consumer] = ir.lastRecordID
+	}
+	return nil
+}
+
+// Pending returns the oldest records past the cursor of consumer
+func (ir *inMemUserRepository) Pending(_ context.Context, consumer string, limit int) ([]outbox.Record, error) {
+	ir.mtx.RLock()
+	defer ir.mtx.RUnlock()
+
+	cursor, ok := ir.cursors[consumer]
+	if !ok {
+		return nil, fmt.Errorf("outbox consumer %q is not registered", consumer)
+	}
+	pending := []outbox.Record{}
+	for _, r := range ir.outbox {
+		if len(pending) == limit {
+			break
+		}
+		if r.ID > cursor {
+			pending = append(pending, r)
+		}
+	}
+	return pending, nil
+}
+
+// MarkRelayed moves the cursor of consumer and drops the records every consumer relayed, once they are older than
+// outbox.MinRetention
+func (ir *inMemUserRepository) MarkRelayed(_ context.Context, consumer string, id int64) error {
+	ir.mtx.Lock()
+	defer ir.mtx.Unlock()
+
+	cursor, ok := ir.cursors[consumer]
+	if !ok {
+		return fmt.Errorf("outbox consumer %q is not registered", consumer)
+	}
+	if id > cursor {
+		ir.cursors[consumer] = id
+	}
+
+	relayed := ir.cursors[consumer]
+	for _, c := range ir.cursors {
+		if c < relayed {
+			relayed = c
+		}
+	}
+	retained := ir.now().Add(-outbox.MinRetention)
+	pending := ir.outbox[:0]
+	for _, r := range ir.outbox {
+		if r.ID > relayed || r.CreatedAt.After(retained) {
+			pending = append(pending, r)
+		}
+	}
+	ir.outbox = pending
+	return nil
+}
+
+// Acquire leases consumer to owner unless another owner holds an unexpired lease
+func (ir *inMemUserRepository) Acquire(_ context.Context, consumer string, owner string, ttl time.Duration) (bool, error) {
+	ir.mtx.Lock()
+	defer ir.mtx.Unlock()
+
+	if _, ok := ir.cursors[consumer]; !ok {
+		return false, fmt.Errorf("outbox consumer %q is not registered", consumer)
+	}
+	now := ir.now()
+	if l, ok := ir.leases[consumer]; ok && l.owner != owner && now.Before(l.until) {
+		return false, nil
+	}
+	ir.leases[consumer] = lease{owner: owner, until: now.Add(ttl)}
+	return true, nil
+}
+
+// Since returns the oldest records after the record with the given ID
+func (ir *inMemUserRepository) Since(_ context.Context, id int64, limit int) ([]outbox.Record, error) {
+	ir.mtx.RLock()
+	defer ir.mtx.RUnlock()
+
+	records := []outbox.Record{}
+	for _, r := range ir.outbox {
+		if len(records) == limit {
+			break
+		}
+		if r.ID > id {
+			records = append(records, r)
+		}
+	}
+	return records, nil
+}
+
+// LastID returns the ID of the last record committed so far
+func (ir *inMemUserRepository) LastID(_ context.Context) (int64, error) {
 	ir.mtx.RLock()
+	defer ir.mtx.RUnlock()
+	return ir.lastRecordID, nil
+}
+
+// insert adds a user unless its ID is already taken. The caller must hold mtx.
+func (ir *inMemUserRepository) insert(user *users.User) error {
+	if _, ok := ir.users[user.ID]; ok {
+		return errs.ErrUserExists
+	}
+	user.Version = 1
+	ir.store(user)
+	return nil
+}
+
+// storeUser stores a user after checking its version. The caller must hold mtx.
+func (ir *inMemUserRepository) storeUser(user *users.User) error {
+	current, ok := ir.users[user.ID]
+	if ok && current.Deleted() {
+		return errs.ErrUserNotFound
+	}
+	if user.Version != 0 {
+		if !ok {
+			return errs.ErrUserNotFound
+		}
+		if current.Version != user.Version {
+			return errs.ErrVersionConflict
+		}
+	}
+
+	user.Version = 1
+	if ok {
+		user.Version = current.Version + 1
+	}
+	ir.store(user)
+	return nil
+}
+
+// delete marks a user as deleted after checking its version. The caller must hold mtx.
+func (ir *inMemUserRepository) delete(id int, version int) error {
+	current, ok := ir.users[id]
+	if !ok || current.Deleted() {
+		return errs.ErrUserNotFound
+	}
+	if version != 0 && current.Version != version {
+		return errs.ErrVersionConflict
+	}
+
+	deleted := *current
+	now := ir.now().UTC()
+	deleted.DeletedAt = &now
+	deleted.Version++
+	ir.store(&deleted)
+	return nil
+}
+
+// restore clears the deleted mark of a user after checking its version. The caller must hold mtx.
+func (ir *inMemUserRepository) restore(id int, version int) (*users.User, error) {
+	current, ok := ir.users[id]
+	if !ok {
+		return nil, errs.ErrUserNotFound
+	}
+	if !current.Deleted() {
+		return nil, errs.ErrUserNotDeleted
+	}
+	if version != 0 && current.Version != version {
+		return nil, errs.ErrVersionConflict
+	}
+
+	restored := *current
+	restored.DeletedAt = nil
+	restored.Version++
+	ir.store(&restored)
+	return &restored, nil
+}
+
+// purge removes users deleted before the cutoff. The caller must hold mtx.
+func (ir *inMemUserRepository) purge(deletedBefore time.Time) int {
+	purged := 0
+	for id, u := range ir.users {
+		if u.Deleted() && u.DeletedAt.Before(deletedBefore) {
+			ir.remember(id)
+			delete(ir.users, id)
+			purged++
+		}
+	}
+	return purged
+}
+
+// insertBatch adds many users, or none of them if the batch is atomic and one fails. The caller must hold mtx.
+func (ir *inMemUserRepository) insertBatch(batch []*users.User, atomic bool) []error {
+	results := make([]error, len(batch))
+	seen := make(map[int]bool, len(batch))
+	failed := false
+	for i, u := range batch {
+		if _, ok := ir.users[u.ID]; ok || seen[u.ID] {
+			results[i] = errs.ErrUserExists
+			failed = true
+		}
+		seen[u.ID] = true
+	}
+
+	if atomic && failed {
+		for i := range results {
+			if results[i] == nil {
+				results[i] = errs.ErrImportAborted
+			}
+		}
+		return results
+	}
+
+	for i, u := range batch {
+		if results[i] == nil {
+			u.Version = 1
+			ir.store(u)
+		}
+	}
+	return results
+}
+
+// findAfter returns a page of users ordered by ID. The caller must hold mtx.
+func (ir *inMemUserRepository) findAfter(afterID int, limit int) []*users.User {
+	ids := make([]int, 0, len(ir.users))
+	for id, u := range ir.users {
+		if id > afterID && !u.Deleted() {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+
+	page := make([]*users.User, 0, len(ids))
+	for _, id := range ids {
+		u := *ir.users[id]
+		page = append(page, &u)
+	}
+	return page
+}
+
+// find returns a copy of a single user. The caller must hold mtx.
+func (ir *inMemUserRepository) find(id int, includeDeleted bool) (*users.User, error) {
+	u, ok := ir.users[id]
+	if !ok || (u.Deleted() && !includeDeleted) {
+		return nil, errs.ErrUserNotFound
+	}
+
+	// Hand out a copy so callers cannot modify stored users without going through Store
+	found := *u
+	return &found, nil
+}
+
+// findAll returns copies of every user. The caller must hold mtx.
+func (ir *inMemUserRepository) findAll(includeDeleted bool) []*users.User {
 	allUsers := []*users.User{}
 	for _, v := range ir.users {
-		allUsers = append(allUsers, v)
+		if v.Deleted() && !includeDeleted {
+			continue
+		}
+		u := *v
+		allUsers = append(allUsers, &u)
 	}
-	ir.mtx.RUnlock()
 	return allUsers
 }
+
+// store saves a copy of user and keeps ID allocation ahead of it. The caller must hold mtx.
+func (ir *inMemUserRepository) store(user *users.User) {
+	ir.remember(user.ID)
+	u := *user
+	ir.users[user.ID] = &u
+	if user.ID > ir.lastID {
+		ir.lastID = user.ID
+	}
+}
+
+// remember journals the user with the given ID before the running transaction first changes it. The caller must
+// hold mtx.
+func (ir *inMemUserRepository) remember(id int) {
+	if ir.journal == nil {
+		return
+	}
+	if _, ok := ir.journal[id]; !ok {
+		ir.journal[id] = ir.users[id]
+	}
+}
+
+// rollback restores the users journaled by the running transaction. IDs allocated by it stay allocated. The
+// caller must hold mtx.
+func (ir *inMemUserRepository) rollback() {
+	for id, u := range ir.journal {
+		if u == nil {
+			delete(ir.users, id)
+			continue
+		}
+		ir.users[id] = u
+	}
+}
+
+// inMemUserTx is the repository handed to a transaction, the lock is already held by Transact
+type inMemUserTx struct {
+	ir *inMemUserRepository
+}
+
+func (tx *inMemUserTx) Insert(_ context.Context, user *users.User) error {
+	return tx.ir.insert(user)
+}
+
+func (tx *inMemUserTx) Store(_ context.Context, user *users.User) error {
+	return tx.ir.storeUser(user)
+}
+
+func (tx *inMemUserTx) Delete(_ context.Context, id int, version int) error {
+	return tx.ir.delete(id, version)
+}
+
+func (tx *inMemUserTx) Restore(_ context.Context, id int, version int) (*users.User, error) {
+	return tx.ir.restore(id, version)
+}
+
+func (tx *inMemUserTx) Purge(_ context.Context, deletedBefore time.Time) int {
+	return tx.ir.purge(deletedBefore)
+}
+
+func (tx *inMemUserTx) Find(_ context.Context, id int, includeDeleted bool) (*users.User, error) {
+	return tx.ir.find(id, includeDeleted)
+}
+
+func (tx *inMemUserTx) FindAll(_ context.Context, includeDeleted bool) []*users.User {
+	return tx.ir.findAll(includeDeleted)
+}
+
+func (tx *inMemUserTx) InsertBatch(_ context.Context, batch []*users.User, atomic bool) []error {
+	return tx.ir.insertBatch(batch, atomic)
+}
+
+func (tx *inMemUserTx) FindAfter(_ context.Context, afterID int, limit int) []*users.User {
+	return tx.ir.findAfter(afterID, limit)
+}
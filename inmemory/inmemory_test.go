@@ -0,0 +1,12 @@
+package inmemory
+
+import (
+	"testing"
+
+	"github.com/bnelz/gokit-base/users"
+	"github.com/bnelz/gokit-base/users/userstest"
+)
+
+func TestInMemUserRepository_Conformance(t *testing.T) {
+	userstest.TestRepository(t, func() users.Repository { return NewInMemUserRepository() })
+}
@@ -0,0 +1,87 @@
+package inmemory
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/bnelz/gokit-base/ratelimit"
+)
+
+// rateLimitSweepInterval is how often idle token buckets are removed
+const rateLimitSweepInterval = time.Minute
+
+// bucket is a token bucket, refilled lazily when tokens are taken from it
+type bucket struct {
+	tokens float64
+	last   time.Time
+
+	// full is when the bucket fills up again, it can be forgotten after that
+	full time.Time
+}
+
+// inMemRateLimiter is an implementation of a token bucket store in local memory
+type inMemRateLimiter struct {
+	mtx     *sync.Mutex
+	buckets map[string]*bucket
+
+	// now is the clock buckets are refilled by
+	now func() time.Time
+
+	// nextSweep is when idle buckets are next removed
+	nextSweep time.Time
+}
+
+// NewInMemRateLimiter returns a new token bucket store in local memory, limits are enforced per instance
+func NewInMemRateLimiter() ratelimit.Limiter {
+	return &inMemRateLimiter{
+		mtx:     new(sync.Mutex),
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Take refills the bucket of key for the time elapsed since it was last used and takes a token from it
+func (rl *inMemRateLimiter) Take(key string, rule ratelimit.Rule) (ratelimit.Result, error) {
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+
+	now := rl.now()
+	rl.sweep(now)
+
+	burst := float64(rule.Burst)
+	perToken := rule.Period / time.Duration(rule.Limit)
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+float64(now.Sub(b.last))/float64(perToken))
+	b.last = now
+
+	res := ratelimit.Result{Limit: rule.Limit}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = time.Duration((1 - b.tokens) * float64(perToken))
+	}
+	res.Remaining = int(b.tokens)
+	res.Reset = time.Duration((burst - b.tokens) * float64(perToken))
+	b.full = now.Add(res.Reset)
+	return res, nil
+}
+
+// sweep removes buckets that are full again at most once per sweep interval. The caller must hold mtx.
+func (rl *inMemRateLimiter) sweep(now time.Time) {
+	if now.Before(rl.nextSweep) {
+		return
+	}
+	for key, b := range rl.buckets {
+		if !now.Before(b.full) {
+			delete(rl.buckets, key)
+		}
+	}
+	rl.nextSweep = now.Add(rateLimitSweepInterval)
+}
@@ -0,0 +1,37 @@
+package inmemory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bnelz/gokit-base/ratelimit"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInMemRateLimiter_Refills(t *testing.T) {
+	now := time.Unix(0, 0)
+	rl := NewInMemRateLimiter().(*inMemRateLimiter)
+	rl.now = func() time.Time { return now }
+	rule := ratelimit.Rule{Limit: 10, Period: 10 * time.Second, Burst: 2}
+
+	for i := 0; i < 2; i++ {
+		res, _ := rl.Take("k", rule)
+		assert.True(t, res.Allowed)
+	}
+	res, _ := rl.Take("k", rule)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 10, res.Limit)
+	assert.Equal(t, time.Second, res.RetryAfter)
+	assert.Equal(t, 2*time.Second, res.Reset)
+
+	// A token is added every second, up to the burst
+	now = now.Add(1500 * time.Millisecond)
+	res, _ = rl.Take("k", rule)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 0, res.Remaining)
+
+	now = now.Add(time.Hour)
+	res, _ = rl.Take("k", rule)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 1, res.Remaining)
+}
@@ -0,0 +1,107 @@
+package inmemory
+
+import (
+	"sort"
+	"sync"
+
+	errs "github.com/bnelz/gokit-base/errors"
+	"github.com/bnelz/gokit-base/webhooks"
+)
+
+// inMemWebhookRepository is an implementation of a webhook subscription repository in local memory
+type inMemWebhookRepository struct {
+	mtx           *sync.RWMutex
+	subscriptions map[string]*webhooks.Subscription
+}
+
+// NewInMemWebhookRepository returns a new webhook subscription repository for storage in local memory
+func NewInMemWebhookRepository() webhooks.Repository {
+	return &inMemWebhookRepository{
+		mtx:           new(sync.RWMutex),
+		subscriptions: make(map[string]*webhooks.Subscription),
+	}
+}
+
+// Insert adds a copy of a subscription to the local subscription map
+func (wr *inMemWebhookRepository) Insert(s *webhooks.Subscription) error {
+	wr.mtx.Lock()
+	defer wr.mtx.Unlock()
+
+	wr.subscriptions[s.ID] = copySubscription(s)
+	return nil
+}
+
+// Delete removes a subscription from the local subscription map
+func (wr *inMemWebhookRepository) Delete(id string) error {
+	wr.mtx.Lock()
+	defer wr.mtx.Unlock()
+
+	if _, ok := wr.subscriptions[id]; !ok {
+		return errs.ErrWebhookNotFound
+	}
+	delete(wr.subscriptions, id)
+	return nil
+}
+
+// Find retrieves a copy of a single subscription
+func (wr *inMemWebhookRepository) Find(id string) (*webhooks.Subscription, error) {
+	wr.mtx.RLock()
+	defer wr.mtx.RUnlock()
+
+	s, ok := wr.subscriptions[id]
+	if !ok {
+		return nil, errs.ErrWebhookNotFound
+	}
+	return copySubscription(s), nil
+}
+
+// FindAll returns copies of every subscription, oldest first
+func (wr *inMemWebhookRepository) FindAll() []*webhooks.Subscription {
+	wr.mtx.RLock()
+	defer wr.mtx.RUnlock()
+
+	all := []*webhooks.Subscription{}
+	for _, s := range wr.subscriptions {
+		all = append(all, copySubscription(s))
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].CreatedAt.Before(all[j].CreatedAt) })
+	return all
+}
+
+// copySubscription returns a deep copy of s
+func copySubscription(s *webhooks.Subscription) *webhooks.Subscription {
+	c := *s
+	c.Types = append(c.Types[:0:0], s.Types...)
+	return &c
+}
+
+// inMemDeadLetterQueue is an implementation of a webhook dead letter queue in local memory
+type inMemDeadLetterQueue struct {
+	mtx     *sync.RWMutex
+	letters map[string][]webhooks.DeadLetter
+}
+
+// NewInMemDeadLetterQueue returns a new webhook dead letter queue for storage in local memory
+func NewInMemDeadLetterQueue() webhooks.DeadLetterQueue {
+	return &inMemDeadLetterQueue{
+		mtx:     new(sync.RWMutex),
+		letters: make(map[string][]webhooks.DeadLetter),
+	}
+}
+
+// Push appends a dead letter to its subscription's list
+func (q *inMemDeadLetterQueue) Push(d webhooks.DeadLetter) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	q.letters[d.SubscriptionID] = append(q.letters[d.SubscriptionID], d)
+	return nil
+}
+
+// List returns a copy of a subscription's dead letters
+func (q *inMemDeadLetterQueue) List(subscriptionID string) []webhooks.DeadLetter {
+	q.mtx.RLock()
+	defer q.mtx.RUnlock()
+
+	return append([]webhooks.DeadLetter{}, q.letters[subscriptionID]...)
+}
@@ -0,0 +1,186 @@
+// Loadshed package bounds the number of requests served concurrently with an adaptive limit, shedding the excess
+package loadshed
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	errs "github.com/bnelz/gokit-base/errors"
+	"github.com/go-kit/kit/metrics"
+	kithttp "github.com/go-kit/kit/transport/http"
+)
+
+// Options configures the limiter
+type Options struct {
+	// InitialLimit, MinLimit and MaxLimit bound the number of requests served concurrently
+	InitialLimit int
+	MinLimit     int
+	MaxLimit     int
+
+	// LatencyThreshold is the latency above which a request is taken as a sign of overload
+	LatencyThreshold time.Duration
+
+	// Backoff is the factor the limit is multiplied by on overload, between 0 and 1
+	Backoff float64
+
+	// RetryAfter is sent to clients whose request was shed
+	RetryAfter time.Duration
+
+	// ExemptPaths lists paths that are never limited, e.g. health checks and long lived streams
+	ExemptPaths []string
+
+	// UnmeasuredPaths lists paths that are limited but do not adjust the limit, e.g. bulk exports and imports that
+	// are slow by design
+	UnmeasuredPaths []string
+}
+
+// Metrics reports the state of the limiter
+type Metrics struct {
+	// Limit is the current concurrency limit
+	Limit metrics.Gauge
+
+	// InFlight is the number of requests being served
+	InFlight metrics.Gauge
+
+	// Shed counts the requests rejected because the limit was reached
+	Shed metrics.Counter
+}
+
+// limiter adjusts its limit with AIMD: it grows by one for every fast request made while the limit is in use,
+// and shrinks by the backoff factor for every slow or overloaded one
+type limiter struct {
+	mtx      sync.Mutex
+	opts     Options
+	limit    float64
+	inFlight int
+	metrics  Metrics
+}
+
+// New returns middleware serving at most a limited number of requests at once. Requests over the limit are
+// answered with 503 and Retry-After.
+func New(opts Options, m Metrics) func(http.Handler) http.Handler {
+	if opts.MinLimit <= 0 {
+		opts.MinLimit = 1
+	}
+	if opts.MaxLimit < opts.MinLimit {
+		opts.MaxLimit = opts.MinLimit
+	}
+	if opts.InitialLimit < opts.MinLimit || opts.InitialLimit > opts.MaxLimit {
+		opts.InitialLimit = opts.MinLimit
+	}
+	if opts.Backoff <= 0 || opts.Backoff >= 1 {
+		opts.Backoff = 0.9
+	}
+	if opts.RetryAfter <= 0 {
+		opts.RetryAfter = time.Second
+	}
+
+	l := &limiter{opts: opts, limit: float64(opts.InitialLimit), metrics: m}
+	m.Limit.Set(l.limit)
+
+	exempt := make(map[string]bool, len(opts.ExemptPaths))
+	for _, p := range opts.ExemptPaths {
+		exempt[p] = true
+	}
+	unmeasured := make(map[string]bool, len(opts.UnmeasuredPaths))
+	for _, p := range opts.UnmeasuredPaths {
+		unmeasured[p] = true
+	}
+	retryAfter := strconv.Itoa(int(math.Ceil(opts.RetryAfter.Seconds())))
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if exempt[r.URL.Path] {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			inFlight, ok := l.acquire()
+			if !ok {
+				m.Shed.Add(1)
+				w.Header().Set("Retry-After", retryAfter)
+				errs.EncodeProblem(kithttp.PopulateRequestContext(r.Context(), r), errs.ErrOverloaded, w)
+				return
+			}
+
+			if unmeasured[r.URL.Path] {
+				defer l.leave()
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Slow requests and requests running out of time are signs of overload. Other 503s are not: they come
+			// from dependencies failing fast, such as an open circuit breaker, and say nothing of our own load.
+			sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+			start := time.Now()
+			defer func() {
+				overloaded := time.Since(start) > opts.LatencyThreshold || sw.status == http.StatusGatewayTimeout
+				l.release(inFlight, overloaded)
+			}()
+			next.ServeHTTP(sw, r)
+		})
+	}
+}
+
+// acquire admits a request if the limit allows it and returns the number of requests in flight including it
+func (l *limiter) acquire() (int, bool) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.inFlight >= int(l.limit) {
+		return l.inFlight, false
+	}
+	l.inFlight++
+	l.metrics.InFlight.Set(float64(l.inFlight))
+	return l.inFlight, true
+}
+
+// release ends a request that was admitted while inFlight requests were being served and adjusts the limit
+func (l *limiter) release(inFlight int, overloaded bool) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.inFlight--
+	l.metrics.InFlight.Set(float64(l.inFlight))
+
+	switch {
+	case overloaded:
+		l.limit = math.Max(float64(l.opts.MinLimit), l.limit*l.opts.Backoff)
+	case inFlight*2 >= int(l.limit):
+		// Only grow while the limit is in use, an idle server proves nothing about the load it can take
+		l.limit = math.Min(float64(l.opts.MaxLimit), l.limit+1)
+	default:
+		return
+	}
+	l.metrics.Limit.Set(l.limit)
+}
+
+// leave ends a request without adjusting the limit
+func (l *limiter) leave() {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.inFlight--
+	l.metrics.InFlight.Set(float64(l.inFlight))
+}
+
+// statusWriter records the status code of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// Flush lets streaming responses through, e.g. user exports
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
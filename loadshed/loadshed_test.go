@@ -0,0 +1,110 @@
+package loadshed
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	errs "github.com/bnelz/gokit-base/errors"
+	"github.com/go-kit/kit/metrics/generic"
+	"github.com/stretchr/testify/assert"
+)
+
+func newMetrics() Metrics {
+	return Metrics{
+		Limit:    generic.NewGauge("limit"),
+		InFlight: generic.NewGauge("in_flight"),
+		Shed:     generic.NewCounter("shed"),
+	}
+}
+
+func TestLoadShed_ShedsOverLimit(t *testing.T) {
+	m := newMetrics()
+	started, release := make(chan struct{}), make(chan struct{})
+	h := New(Options{InitialLimit: 1, MinLimit: 1, MaxLimit: 1, LatencyThreshold: time.Hour, ExemptPaths: []string{"/health"}}, m)(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				close(started)
+				<-release
+			}
+		}),
+	)
+
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow", nil))
+		close(done)
+	}()
+	<-started
+	assert.Equal(t, 1.0, m.InFlight.(*generic.Gauge).Value())
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/users", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Equal(t, errs.ProblemContentType, w.Header().Get("Content-Type"))
+	assert.Equal(t, 1.0, m.Shed.(*generic.Counter).Value())
+
+	// Exempt paths are served regardless
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	close(release)
+	<-done
+	assert.Equal(t, 0.0, m.InFlight.(*generic.Gauge).Value())
+}
+
+func TestLimiter_AIMD(t *testing.T) {
+	m := newMetrics()
+	l := &limiter{opts: Options{MinLimit: 2, MaxLimit: 4, Backoff: 0.5}, limit: 3, metrics: m}
+
+	// The limit only grows while it is in use
+	n, _ := l.acquire()
+	l.release(n, false)
+	assert.Equal(t, 3.0, l.limit)
+
+	l.acquire()
+	n, _ = l.acquire()
+	l.release(n, false)
+	assert.Equal(t, 4.0, l.limit)
+	n, _ = l.acquire()
+	l.release(n, false)
+	assert.Equal(t, 4.0, l.limit)
+
+	// It halves on overload, down to the minimum
+	n, _ = l.acquire()
+	l.release(n, true)
+	assert.Equal(t, 2.0, l.limit)
+	n, _ = l.acquire()
+	l.release(n, true)
+	assert.Equal(t, 2.0, l.limit)
+	assert.Equal(t, 2.0, m.Limit.(*generic.Gauge).Value())
+}
+
+func TestLoadShed_AdjustsOnOwnOverloadOnly(t *testing.T) {
+	m := newMetrics()
+	h := New(Options{InitialLimit: 4, MinLimit: 1, MaxLimit: 4, Backoff: 0.5, LatencyThreshold: 10 * time.Millisecond,
+		UnmeasuredPaths: []string{"/api/v1/users:export"}}, m)(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/api/v1/users:export":
+				time.Sleep(20 * time.Millisecond)
+			case "/unavailable":
+				w.WriteHeader(http.StatusServiceUnavailable)
+			case "/timeout":
+				w.WriteHeader(http.StatusGatewayTimeout)
+			}
+		}),
+	)
+
+	// Slow exports and dependencies failing fast leave the limit alone
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/v1/users:export", nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/unavailable", nil))
+	assert.Equal(t, 4.0, m.Limit.(*generic.Gauge).Value())
+	assert.Equal(t, 0.0, m.InFlight.(*generic.Gauge).Value())
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/timeout", nil))
+	assert.Equal(t, 2.0, m.Limit.(*generic.Gauge).Value())
+}
@@ -0,0 +1,187 @@
+package logger
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+)
+
+// OverflowPolicy decides what an AsyncWriter does with an entry when its buffer is full
+type OverflowPolicy int
+
+const (
+	// Block waits for room in the buffer
+	Block OverflowPolicy = iota
+
+	// DropOldest discards the oldest buffered entry to make room
+	DropOldest
+
+	// DropNewest discards the entry being written
+	DropNewest
+)
+
+// ParseOverflowPolicy returns the policy named by s: "block", "drop-oldest" or "drop-newest"
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch s {
+	case "", "block":
+		return Block, nil
+	case "drop-oldest":
+		return DropOldest, nil
+	case "drop-newest":
+		return DropNewest, nil
+	}
+	return Block, fmt.Errorf("unknown log overflow policy %q", s)
+}
+
+// AsyncOptions configures an AsyncWriter
+type AsyncOptions struct {
+	// BufferSize is the number of entries held before the overflow policy applies
+	BufferSize int
+
+	// FlushInterval is how often buffered output is flushed to the underlying writer
+	FlushInterval time.Duration
+
+	// Overflow is the policy applied when the buffer is full
+	Overflow OverflowPolicy
+}
+
+// AsyncWriter moves writes off the caller's goroutine. Entries are queued in a bounded buffer and written by
+// a background goroutine that flushes periodically and on Close.
+type AsyncWriter struct {
+	out     *bufio.Writer
+	entries chan []byte
+	flushes chan chan struct{}
+	policy  OverflowPolicy
+	dropped metrics.Counter
+
+	// mtx is held for reading by writes queueing an entry and for writing by Close, so every write either sees the
+	// writer closed or queues its entry before the buffer is drained for the last time
+	mtx     sync.RWMutex
+	closed  bool
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// NewAsyncWriter returns an AsyncWriter writing to w. Entries discarded by the overflow policy are counted by dropped.
+func NewAsyncWriter(w io.Writer, opts AsyncOptions, dropped metrics.Counter) *AsyncWriter {
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = 1
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = time.Second
+	}
+
+	a := &AsyncWriter{
+		out:     bufio.NewWriter(w),
+		entries: make(chan []byte, opts.BufferSize),
+		flushes: make(chan chan struct{}),
+		policy:  opts.Overflow,
+		dropped: dropped,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go a.run(opts.FlushInterval)
+	return a
+}
+
+// Write queues a copy of p for writing, it fails once the writer is closed
+func (a *AsyncWriter) Write(p []byte) (int, error) {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+	if a.closed {
+		return 0, os.ErrClosed
+	}
+
+	entry := make([]byte, len(p))
+	copy(entry, p)
+
+	switch a.policy {
+	case DropNewest:
+		select {
+		case a.entries <- entry:
+		default:
+			a.dropped.Add(1)
+		}
+	case DropOldest:
+		for {
+			select {
+			case a.entries <- entry:
+				return len(p), nil
+			default:
+			}
+			select {
+			case <-a.entries:
+				a.dropped.Add(1)
+			default:
+			}
+		}
+	default:
+		a.entries <- entry
+	}
+	return len(p), nil
+}
+
+// Flush blocks until everything queued so far has been written to the underlying writer
+func (a *AsyncWriter) Flush() {
+	ack := make(chan struct{})
+	select {
+	case a.flushes <- ack:
+		<-ack
+	case <-a.stopped:
+	}
+}
+
+// Close stops accepting entries, writes every entry accepted before and flushes the underlying writer
+func (a *AsyncWriter) Close() error {
+	a.mtx.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.done)
+	}
+	a.mtx.Unlock()
+
+	<-a.stopped
+	return nil
+}
+
+// run writes queued entries until the writer is closed
+func (a *AsyncWriter) run(interval time.Duration) {
+	defer close(a.stopped)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case entry := <-a.entries:
+			a.out.Write(entry)
+		case <-ticker.C:
+			a.out.Flush()
+		case ack := <-a.flushes:
+			a.drain()
+			a.out.Flush()
+			close(ack)
+		case <-a.done:
+			a.drain()
+			a.out.Flush()
+			return
+		}
+	}
+}
+
+// drain writes every entry currently in the buffer
+func (a *AsyncWriter) drain() {
+	for {
+		select {
+		case entry := <-a.entries:
+			a.out.Write(entry)
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package logger
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics/generic"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingWriter holds every write until release is closed
+type blockingWriter struct {
+	mtx     sync.Mutex
+	buf     bytes.Buffer
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.release
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.buf.Write(p)
+}
+
+func TestAsyncWriter_FlushesOnClose(t *testing.T) {
+	buf := &bytes.Buffer{}
+	a := NewAsyncWriter(buf, AsyncOptions{BufferSize: 8, FlushInterval: time.Hour}, generic.NewCounter("dropped"))
+
+	a.Write([]byte("one\n"))
+	a.Write([]byte("two\n"))
+	assert.NoError(t, a.Close())
+
+	assert.Equal(t, "one\ntwo\n", buf.String())
+	_, err := a.Write([]byte("three\n"))
+	assert.Error(t, err)
+}
+
+func TestAsyncWriter_CloseKeepsEveryAcceptedWrite(t *testing.T) {
+	buf := &bytes.Buffer{}
+	a := NewAsyncWriter(buf, AsyncOptions{BufferSize: 4, FlushInterval: time.Hour}, generic.NewCounter("dropped"))
+
+	const writers = 8
+	var (
+		wg       sync.WaitGroup
+		mtx      sync.Mutex
+		accepted int
+	)
+	wg.Add(writers)
+	for i := 0; i < writers; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				if _, err := a.Write([]byte("x\n")); err != nil {
+					return
+				}
+				mtx.Lock()
+				accepted++
+				mtx.Unlock()
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, a.Close())
+	wg.Wait()
+
+	assert.Equal(t, accepted*2, buf.Len())
+}
+
+func TestAsyncWriter_Flush(t *testing.T) {
+	buf := &bytes.Buffer{}
+	a := NewAsyncWriter(buf, AsyncOptions{BufferSize: 8, FlushInterval: time.Hour}, generic.NewCounter("dropped"))
+	defer a.Close()
+
+	a.Write([]byte("one\n"))
+	a.Flush()
+	assert.Equal(t, "one\n", buf.String())
+}
+
+func TestAsyncWriter_OverflowPolicies(t *testing.T) {
+	for name, tc := range map[string]struct {
+		policy OverflowPolicy
+		want   string
+	}{
+		"drop newest": {DropNewest, "b\n"},
+		"drop oldest": {DropOldest, "d\n"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := &blockingWriter{release: make(chan struct{})}
+			dropped := generic.NewCounter("dropped")
+			a := NewAsyncWriter(w, AsyncOptions{BufferSize: 1, FlushInterval: time.Hour, Overflow: tc.policy}, dropped)
+
+			// An entry larger than the bufio buffer bypasses it, parking the writer goroutine on the blocked writer
+			large := bytes.Repeat([]byte("x"), 8192)
+			a.Write(large)
+			for len(a.entries) > 0 {
+				time.Sleep(time.Millisecond)
+			}
+
+			a.Write([]byte("b\n"))
+			a.Write([]byte("c\n"))
+			a.Write([]byte("d\n"))
+			assert.Equal(t, float64(2), dropped.Value())
+
+			close(w.release)
+			a.Close()
+			assert.Equal(t, string(large)+tc.want, w.buf.String())
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package logger
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultComponent names the level applied to components without an override
+const DefaultComponent = "default"
+
+// componentKey is the log key identifying the component an entry was logged by
+const componentKey = "context_component"
+
+// String returns the configuration name of the level
+func (l LogLevel) String() string {
+	switch l {
+	case VERBOSE:
+		return "verbose"
+	case ERROR:
+		return "error"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// ParseLogLevel returns the level named by s: "verbose" or "error"
+func ParseLogLevel(s string) (LogLevel, error) {
+	switch s {
+	case "verbose":
+		return VERBOSE, nil
+	case "error":
+		return ERROR, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// ComponentLevel is the effective level of a single component
+type ComponentLevel struct {
+	Component string     `json:"component"`
+	Level     string     `json:"level"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// levelState is an immutable snapshot of the configured levels
+type levelState struct {
+	def       LogLevel
+	overrides map[string]LogLevel
+}
+
+// level returns the effective level for component
+func (s *levelState) level(component string) LogLevel {
+	if l, ok := s.overrides[component]; ok {
+		return l
+	}
+	return s.def
+}
+
+// pendingRevert restores a component's level when a temporary change expires
+type pendingRevert struct {
+	timer     *time.Timer
+	expiresAt time.Time
+	level     LogLevel
+	override  bool
+}
+
+// Levels holds the log level of every component. Reads are lock free so loggers can consult it on every entry;
+// changes may be temporary and revert on their own after a TTL.
+type Levels struct {
+	state atomic.Value // *levelState
+
+	// mtx serializes changes and guards reverts
+	mtx     sync.Mutex
+	reverts map[string]*pendingRevert
+}
+
+// NewLevels returns levels where every component logs at def
+func NewLevels(def LogLevel) *Levels {
+	l := &Levels{reverts: make(map[string]*pendingRevert)}
+	l.state.Store(&levelState{def: def, overrides: map[string]LogLevel{}})
+	return l
+}
+
+// Level returns the effective level for component
+func (l *Levels) Level(component string) LogLevel {
+	return l.load().level(component)
+}
+
+// Set changes the level of component, or of every component without an override when component is empty or
+// DefaultComponent. A positive ttl reverts the change once it elapses.
+func (l *Levels) Set(component string, level LogLevel, ttl time.Duration) {
+	if component == "" {
+		component = DefaultComponent
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	prevLevel, prevOverride := l.current(component)
+	if r, ok := l.reverts[component]; ok {
+		// A temporary change is already in place, reverting should restore what came before it
+		r.timer.Stop()
+		prevLevel, prevOverride = r.level, r.override
+		delete(l.reverts, component)
+	}
+
+	l.store(component, level, true)
+
+	if ttl > 0 {
+		r := &pendingRevert{expiresAt: time.Now().Add(ttl), level: prevLevel, override: prevOverride}
+		r.timer = time.AfterFunc(ttl, func() { l.revert(component, r) })
+		l.reverts[component] = r
+	}
+}
+
+// Snapshot lists the default level followed by every component override, sorted by component
+func (l *Levels) Snapshot() []ComponentLevel {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	s := l.load()
+	levels := []ComponentLevel{{Component: DefaultComponent, Level: s.def.String()}}
+	for c, lvl := range s.overrides {
+		levels = append(levels, ComponentLevel{Component: c, Level: lvl.String()})
+	}
+	sort.Slice(levels[1:], func(i, j int) bool { return levels[i+1].Component < levels[j+1].Component })
+
+	for i := range levels {
+		if r, ok := l.reverts[levels[i].Component]; ok {
+			expiresAt := r.expiresAt
+			levels[i].ExpiresAt = &expiresAt
+		}
+	}
+	return levels
+}
+
+// revert restores the level recorded by r unless a newer change superseded it
+func (l *Levels) revert(component string, r *pendingRevert) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.reverts[component] != r {
+		return
+	}
+	delete(l.reverts, component)
+	l.store(component, r.level, r.override)
+}
+
+// current returns the level configured for component and whether it is an override. The caller must hold mtx.
+func (l *Levels) current(component string) (LogLevel, bool) {
+	s := l.load()
+	if component == DefaultComponent {
+		return s.def, true
+	}
+	lvl, ok := s.overrides[component]
+	return lvl, ok
+}
+
+// store publishes a new state with the level of component changed. The caller must hold mtx.
+func (l *Levels) store(component string, level LogLevel, override bool) {
+	s := l.load()
+	next := &levelState{def: s.def, overrides: make(map[string]LogLevel, len(s.overrides)+1)}
+	for c, lvl := range s.overrides {
+		next.overrides[c] = lvl
+	}
+
+	switch {
+	case component == DefaultComponent:
+		next.def = level
+	case override:
+		next.overrides[component] = level
+	default:
+		delete(next.overrides, component)
+	}
+	l.state.Store(next)
+}
+
+// load returns the current state
+func (l *Levels) load() *levelState {
+	return l.state.Load().(*levelState)
+}
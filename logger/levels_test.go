@@ -0,0 +1,59 @@
+package logger
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLevels_ComponentOverrides(t *testing.T) {
+	l := NewLevels(ERROR)
+	l.Set("users", VERBOSE, 0)
+
+	assert.Equal(t, VERBOSE, l.Level("users"))
+	assert.Equal(t, ERROR, l.Level("http"))
+
+	l.Set(DefaultComponent, VERBOSE, 0)
+	assert.Equal(t, VERBOSE, l.Level("http"))
+}
+
+func TestLevels_RevertsAfterTTL(t *testing.T) {
+	l := NewLevels(ERROR)
+	l.Set("users", VERBOSE, 20*time.Millisecond)
+	l.Set("users", VERBOSE, 20*time.Millisecond)
+
+	snapshot := l.Snapshot()
+	assert.Len(t, snapshot, 2)
+	assert.Equal(t, "users", snapshot[1].Component)
+	assert.NotNil(t, snapshot[1].ExpiresAt)
+
+	assert.Eventually(t, func() bool { return l.Level("users") == ERROR }, time.Second, 5*time.Millisecond)
+	assert.Len(t, l.Snapshot(), 1)
+}
+
+func TestHerbertLogger_ConsultsComponentLevel(t *testing.T) {
+	levels := NewLevels(ERROR)
+	w := &capturingLogger{}
+	buf := &countingWriter{}
+	l := NewHerbertFormatLogger(w, buf, "", levels)
+
+	l.Log("context_component", "users", "message", "hello")
+	assert.Equal(t, 0, buf.writes)
+	assert.Nil(t, w.keyvals)
+
+	levels.Set("users", VERBOSE, 0)
+	l.Log("context_component", "users", "message", "hello")
+	assert.Equal(t, 1, buf.writes)
+	assert.NotNil(t, w.keyvals)
+}
+
+// countingWriter counts the writes it receives
+type countingWriter struct {
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return len(p), nil
+}
@@ -2,18 +2,28 @@ package logger
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
-	"strconv"
+	"os/signal"
+	"strings"
+	"time"
 
 	gklog "github.com/go-kit/kit/log"
 )
 
+// DefaultChannel is the Monolog channel used when no channel has been configured
+const DefaultChannel = "golang"
+
+// contextPrefix marks keys that belong in the Monolog record context
+const contextPrefix = "context_"
+
 // herbertLogger is a logging service wrapping gokit and custom logging logic
 type herbertLogger struct {
-	log    gklog.Logger
-	writer io.Writer
-	level  LogLevel
+	log     gklog.Logger
+	writer  io.Writer
+	channel string
+	levels  *Levels
 }
 
 // LogLevel represents the atreides logging level
@@ -24,42 +34,159 @@ const (
 	ERROR
 )
 
-// NewHerbertFormatLogger returns a wrapped gokit logger
-func NewHerbertFormatLogger(log gklog.Logger, file string, level LogLevel) gklog.Logger {
-	f, _ := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
-	return &herbertLogger{log: log, writer: f, level: level}
+// Reopener describes a log output that can be reopened, e.g. after logrotate has moved the log file
+type Reopener interface {
+	Reopen() error
+}
+
+// NewHerbertFormatLogger returns a wrapped gokit logger writing Monolog formatted records to w. Each record is
+// filtered by the current level of the component that logged it before it reaches w or the wrapped logger.
+func NewHerbertFormatLogger(log gklog.Logger, w io.Writer, channel string, levels *Levels) gklog.Logger {
+	if channel == "" {
+		channel = DefaultChannel
+	}
+	return &herbertLogger{log: log, writer: w, channel: channel, levels: levels}
 }
 
+// OpenLogFile opens a rotating log file for herbert output. If the file cannot be opened a warning is logged
+// and stderr is returned instead.
+func OpenLogFile(path string, rotate RotateOptions, log gklog.Logger) io.WriteCloser {
+	f, err := NewFile(path, rotate)
+	if err != nil {
+		log.Log("message", "unable to open log file, falling back to stderr", "context_path", path, "error", err)
+		return nopCloser{os.Stderr}
+	}
+	return f
+}
+
+// ReopenOnSignal reopens w whenever one of sigs is received, typically SIGHUP from logrotate.
+// Writers that cannot be reopened are ignored.
+func ReopenOnSignal(w io.Writer, log gklog.Logger, sigs ...os.Signal) {
+	r, ok := w.(Reopener)
+	if !ok {
+		return
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sigs...)
+	go func() {
+		for range c {
+			if err := r.Reopen(); err != nil {
+				log.Log("message", "unable to reopen log file", "error", err)
+			}
+		}
+	}()
+}
+
+// nopCloser keeps shared writers such as stderr open when the log output is closed
+type nopCloser struct {
+	io.Writer
+}
+
+// Close is a no-op
+func (nopCloser) Close() error { return nil }
+
 // Log writes a log entry
 func (l *herbertLogger) Log(keyvals ...interface{}) error {
+	r := newRecord(l.channel, keyvals...)
+
+	level := l.levels.Level(component(keyvals))
+	if level == ERROR && r.Level < monologError {
+		return nil
+	}
 
-	var logData map[string]string
-	logData = make(map[string]string)
+	serialized, _ := json.Marshal(r)
+	l.writer.Write(append(serialized, '\n'))
+	return l.log.Log(keyvals...)
+}
 
-	logData["channel"] = "golang"
+// newRecord builds a Monolog record from gokit keyvals. Keys prefixed with "context_" are grouped under the
+// record context, "message" and "timestamp" populate the message and datetime and everything else lands in extra.
+func newRecord(channel string, keyvals ...interface{}) record {
+	r := record{
+		Context: map[string]interface{}{},
+		Level:   monologInfo,
+		Channel: channel,
+		Extra:   map[string]interface{}{},
+	}
 
-	var hasError = false
+	datetime := time.Now().UTC()
 	for i := 0; i < len(keyvals); i += 2 {
-		key := keyvals[i].(string)
-		val := keyvals[i+1]
-		switch val.(type) {
-		case string:
-			logData[key] = val.(string)
-		case int:
-			logData[key] = strconv.Itoa(val.(int))
-		case bool:
-			logData[key] = strconv.FormatBool(val.(bool))
-		case error:
-			hasError = true
-			logData[key] = val.(error).Error()
+		key := fmt.Sprint(keyvals[i])
+		var val interface{} = gklog.ErrMissingValue
+		if i+1 < len(keyvals) {
+			val = keyvals[i+1]
+		}
+
+		if _, ok := val.(error); ok {
+			r.Level = monologError
+		}
+
+		switch {
+		case key == "message":
+			if val != nil {
+				r.Message = fmt.Sprint(formatValue(val))
+			}
+		case key == "timestamp":
+			if t, ok := timestamp(val); ok {
+				datetime = t
+				continue
+			}
+			r.Extra[key] = formatValue(val)
+		case strings.HasPrefix(key, contextPrefix):
+			r.Context[strings.TrimPrefix(key, contextPrefix)] = formatValue(val)
+		default:
+			r.Extra[key] = formatValue(val)
 		}
 	}
 
-	serialized, _ := json.Marshal(logData)
+	r.LevelName = levelNames[r.Level]
+	r.Datetime = datetime.Format(monologDateFormat)
+	return r
+}
 
-	if l.level == VERBOSE || (l.level == ERROR && hasError) {
-		l.writer.Write(append(serialized, '\n'))
+// timestamp returns the time held by a timestamp value: a time, a valuer such as gokit's DefaultTimestampUTC that
+// has not been bound yet or the RFC3339 text of a bound one
+func timestamp(val interface{}) (time.Time, bool) {
+	if v, ok := val.(gklog.Valuer); ok {
+		val = v()
 	}
+	switch v := val.(type) {
+	case time.Time:
+		return v, true
+	case fmt.Stringer:
+		t, err := time.Parse(time.RFC3339Nano, v.String())
+		return t, err == nil
+	}
+	return time.Time{}, false
+}
 
-	return l.log.Log(keyvals...)
+// component returns the component an entry was logged by, or the default component
+func component(keyvals []interface{}) string {
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if keyvals[i] == componentKey {
+			if c, ok := keyvals[i+1].(string); ok {
+				return c
+			}
+		}
+	}
+	return DefaultComponent
+}
+
+// formatValue converts a log value into something that serializes sensibly as JSON
+func formatValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case nil:
+		return nil
+	case string, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return v
+	case error:
+		return v.Error()
+	case time.Time:
+		return v.Format(monologDateFormat)
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
 }
@@ -0,0 +1,66 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	gklog "github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHerbertLogger_MonologRecordLayout(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := &herbertLogger{log: gklog.NewNopLogger(), writer: buf, channel: "gokit-base", levels: NewLevels(VERBOSE)}
+
+	ts := time.Date(2020, 12, 1, 10, 30, 0, 0, time.UTC)
+	err := l.Log(
+		"context_method", "CreateUser",
+		"context_id", 12,
+		"timestamp", ts,
+		"transport", "http",
+		"message", "created",
+	)
+	assert.NoError(t, err)
+
+	var r map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &r))
+	assert.Equal(t, "created", r["message"])
+	assert.Equal(t, map[string]interface{}{"method": "CreateUser", "id": float64(12)}, r["context"])
+	assert.Equal(t, float64(200), r["level"])
+	assert.Equal(t, "INFO", r["level_name"])
+	assert.Equal(t, "gokit-base", r["channel"])
+	assert.Equal(t, "2020-12-01T10:30:00.000000+00:00", r["datetime"])
+	assert.Equal(t, map[string]interface{}{"transport": "http"}, r["extra"])
+}
+
+func TestHerbertLogger_BoundTimestampSetsDatetime(t *testing.T) {
+	buf := &bytes.Buffer{}
+	var l gklog.Logger = &herbertLogger{log: gklog.NewNopLogger(), writer: buf, levels: NewLevels(VERBOSE)}
+	ts := time.Date(2020, 12, 1, 10, 30, 0, 123456000, time.UTC)
+	l = gklog.With(l, "timestamp", gklog.TimestampFormat(func() time.Time { return ts }, time.RFC3339Nano))
+
+	assert.NoError(t, l.Log("message", "created"))
+
+	var r map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &r))
+	assert.Equal(t, "2020-12-01T10:30:00.123456+00:00", r["datetime"])
+	assert.Empty(t, r["extra"])
+}
+
+func TestHerbertLogger_ErrorLevelFiltering(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := &herbertLogger{log: gklog.NewNopLogger(), writer: buf, channel: DefaultChannel, levels: NewLevels(ERROR)}
+
+	l.Log("message", "nothing to see here")
+	assert.Equal(t, 0, buf.Len())
+
+	l.Log("message", errors.New("boom"))
+	var r record
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &r))
+	assert.Equal(t, "boom", r.Message)
+	assert.Equal(t, monologError, r.Level)
+	assert.Equal(t, "ERROR", r.LevelName)
+}
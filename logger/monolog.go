@@ -0,0 +1,41 @@
+package logger
+
+// monologLevel is a Monolog (RFC 5424 derived) severity
+type monologLevel int
+
+const (
+	monologDebug     monologLevel = 100
+	monologInfo      monologLevel = 200
+	monologNotice    monologLevel = 250
+	monologWarning   monologLevel = 300
+	monologError     monologLevel = 400
+	monologCritical  monologLevel = 500
+	monologAlert     monologLevel = 550
+	monologEmergency monologLevel = 600
+)
+
+// monologDateFormat matches the datetime layout produced by Monolog's JsonFormatter
+const monologDateFormat = "2006-01-02T15:04:05.000000-07:00"
+
+// levelNames maps Monolog severities to their level_name
+var levelNames = map[monologLevel]string{
+	monologDebug:     "DEBUG",
+	monologInfo:      "INFO",
+	monologNotice:    "NOTICE",
+	monologWarning:   "WARNING",
+	monologError:     "ERROR",
+	monologCritical:  "CRITICAL",
+	monologAlert:     "ALERT",
+	monologEmergency: "EMERGENCY",
+}
+
+// record is the standard Monolog JSON record layout consumed by our PHP log pipeline
+type record struct {
+	Message   string                 `json:"message"`
+	Context   map[string]interface{} `json:"context"`
+	Level     monologLevel           `json:"level"`
+	LevelName string                 `json:"level_name"`
+	Channel   string                 `json:"channel"`
+	Datetime  string                 `json:"datetime"`
+	Extra     map[string]interface{} `json:"extra"`
+}
@@ -0,0 +1,123 @@
+package logger
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+
+	gklog "github.com/go-kit/kit/log"
+)
+
+// RedactedValue replaces masked log values
+const RedactedValue = "[REDACTED]"
+
+// RedactAction describes how a sensitive log value is redacted
+type RedactAction int
+
+const (
+	// Mask replaces the value with RedactedValue
+	Mask RedactAction = iota
+
+	// Hash replaces the value with an HMAC-SHA256 digest so equal values can still be correlated. The digest is
+	// keyed with a secret so values cannot be recovered by hashing guesses.
+	Hash
+
+	// Drop removes the key and value from the entry entirely
+	Drop
+)
+
+// ParseRedactAction returns the action named by s: "mask", "hash" or "drop"
+func ParseRedactAction(s string) (RedactAction, error) {
+	switch s {
+	case "", "mask":
+		return Mask, nil
+	case "hash":
+		return Hash, nil
+	case "drop":
+		return Drop, nil
+	}
+	return Mask, fmt.Errorf("unknown log redaction action %q", s)
+}
+
+// Redaction is a rule matching log keys by exact name or by pattern
+type Redaction struct {
+	// Key is an exact log key to redact e.g. "context_fname"
+	Key string
+
+	// Pattern matches log keys to redact when Key is empty
+	Pattern *regexp.Regexp
+
+	// Action is applied to the values of matching keys
+	Action RedactAction
+}
+
+// DefaultRedactions masks personal user data and is applied in production after the configured rules
+var DefaultRedactions = []Redaction{
+	{Key: "context_fname", Action: Mask},
+	{Key: "context_lname", Action: Mask},
+}
+
+// matches reports whether the rule applies to key
+func (r Redaction) matches(key string) bool {
+	if r.Key != "" {
+		return r.Key == key
+	}
+	return r.Pattern != nil && r.Pattern.MatchString(key)
+}
+
+// redactingLogger scrubs sensitive values before any wrapped logger sees them
+type redactingLogger struct {
+	next       gklog.Logger
+	redactions []Redaction
+	hashKey    []byte
+}
+
+// NewRedactingLogger returns a logger applying the first matching redaction to each key before logging to next.
+// Hashed values are keyed with hashKey.
+func NewRedactingLogger(next gklog.Logger, redactions []Redaction, hashKey []byte) gklog.Logger {
+	if len(redactions) == 0 {
+		return next
+	}
+	return &redactingLogger{next: next, redactions: redactions, hashKey: hashKey}
+}
+
+// Log redacts keyvals and passes them on
+func (l *redactingLogger) Log(keyvals ...interface{}) error {
+	redacted := make([]interface{}, 0, len(keyvals))
+	for i := 0; i < len(keyvals); i += 2 {
+		key := keyvals[i]
+		var val interface{} = gklog.ErrMissingValue
+		if i+1 < len(keyvals) {
+			val = keyvals[i+1]
+		}
+
+		r, ok := l.match(fmt.Sprint(key))
+		if !ok {
+			redacted = append(redacted, key, val)
+			continue
+		}
+
+		switch r.Action {
+		case Drop:
+		case Hash:
+			mac := hmac.New(sha256.New, l.hashKey)
+			mac.Write([]byte(fmt.Sprint(val)))
+			redacted = append(redacted, key, "hmac-sha256:"+hex.EncodeToString(mac.Sum(nil)))
+		default:
+			redacted = append(redacted, key, RedactedValue)
+		}
+	}
+	return l.next.Log(redacted...)
+}
+
+// match returns the first redaction applying to key
+func (l *redactingLogger) match(key string) (Redaction, bool) {
+	for _, r := range l.redactions {
+		if r.matches(key) {
+			return r, true
+		}
+	}
+	return Redaction{}, false
+}
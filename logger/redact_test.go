@@ -0,0 +1,45 @@
+package logger
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// capturingLogger records the keyvals of the last entry
+type capturingLogger struct {
+	keyvals []interface{}
+}
+
+func (l *capturingLogger) Log(keyvals ...interface{}) error {
+	l.keyvals = keyvals
+	return nil
+}
+
+func TestRedactingLogger(t *testing.T) {
+	next := &capturingLogger{}
+	l := NewRedactingLogger(next, []Redaction{
+		{Key: "context_fname", Action: Mask},
+		{Key: "context_lname", Action: Hash},
+		{Pattern: regexp.MustCompile(`^context_(ssn|password)$`), Action: Drop},
+	}, []byte("key"))
+
+	l.Log(
+		"context_fname", "Bob",
+		"context_lname", "YourUncle",
+		"context_password", "hunter2",
+		"context_color", "Blue",
+	)
+
+	assert.Equal(t, []interface{}{
+		"context_fname", RedactedValue,
+		"context_lname", "hmac-sha256:3a591b51668b555c5c48d94ac2f84df96bcec9c8a80ed5d61aeb707b70e9d6f3",
+		"context_color", "Blue",
+	}, next.keyvals)
+}
+
+func TestNewRedactingLogger_NoRules(t *testing.T) {
+	next := &capturingLogger{}
+	assert.Equal(t, next, NewRedactingLogger(next, nil, nil))
+}
@@ -0,0 +1,239 @@
+package logger
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is appended to rotated file names, it sorts lexically in chronological order
+const backupTimeFormat = "20060102T150405.000000"
+
+// RotateOptions describes when a log file is rotated and how many rotated files are retained
+type RotateOptions struct {
+	// MaxSize is the size in bytes a file may reach before it is rotated, zero disables size based rotation
+	MaxSize int64
+
+	// MaxAge is how long a file is written to before it is rotated, zero disables age based rotation
+	MaxAge time.Duration
+
+	// MaxBackups is the number of rotated files to retain, zero retains all of them
+	MaxBackups int
+
+	// Compress gzips rotated files
+	Compress bool
+}
+
+// File is a log file writer supporting size and age based rotation and reopening, e.g. after logrotate
+type File struct {
+	path string
+	opts RotateOptions
+
+	mtx      sync.Mutex
+	f        *os.File
+	size     int64
+	openedAt time.Time
+
+	// wg tracks in flight compression and pruning of rotated files
+	wg sync.WaitGroup
+
+	// now is the clock used for rotation decisions
+	now func() time.Time
+}
+
+// NewFile opens path for appending and returns a rotating log file
+func NewFile(path string, opts RotateOptions) (*File, error) {
+	f := &File{path: path, opts: opts, now: time.Now}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Write appends p to the file, rotating it first if p would exceed the size limit or the file is too old
+func (f *File) Write(p []byte) (int, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if f.f == nil {
+		return 0, os.ErrClosed
+	}
+
+	if f.shouldRotate(int64(len(p))) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.f.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Reopen closes and reopens the file at its configured path. Call this after an external tool has moved it.
+func (f *File) Reopen() error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if f.f != nil {
+		f.f.Close()
+	}
+	return f.open()
+}
+
+// Rotate forces a rotation of the current file
+func (f *File) Rotate() error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.rotate()
+}
+
+// Close closes the file and waits for any pending compression of rotated files
+func (f *File) Close() error {
+	f.mtx.Lock()
+	var err error
+	if f.f != nil {
+		err = f.f.Close()
+		f.f = nil
+	}
+	f.mtx.Unlock()
+
+	f.wg.Wait()
+	return err
+}
+
+// open opens the file at path and records its current size. The caller must hold mtx.
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		f.f = nil
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		f.f = nil
+		return err
+	}
+
+	f.f = file
+	f.size = info.Size()
+	f.openedAt = f.now()
+	return nil
+}
+
+// shouldRotate reports whether writing n more bytes requires a rotation first. The caller must hold mtx.
+func (f *File) shouldRotate(n int64) bool {
+	if f.opts.MaxSize > 0 && f.size > 0 && f.size+n > f.opts.MaxSize {
+		return true
+	}
+	return f.opts.MaxAge > 0 && f.now().Sub(f.openedAt) >= f.opts.MaxAge
+}
+
+// rotate moves the current file aside, opens a fresh one and cleans up old backups. The caller must hold mtx.
+func (f *File) rotate() error {
+	if f.f != nil {
+		f.f.Close()
+		f.f = nil
+	}
+
+	backup := fmt.Sprintf("%s.%s", f.path, f.now().UTC().Format(backupTimeFormat))
+	if err := os.Rename(f.path, backup); err != nil && !os.IsNotExist(err) {
+		f.open()
+		return err
+	}
+
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		if f.opts.Compress {
+			compress(backup)
+		}
+		f.prune()
+	}()
+	return nil
+}
+
+// prune removes the oldest rotated files beyond MaxBackups
+func (f *File) prune() {
+	if f.opts.MaxBackups <= 0 {
+		return
+	}
+
+	backups := f.backups()
+	if len(backups) <= f.opts.MaxBackups {
+		return
+	}
+	for _, b := range backups[:len(backups)-f.opts.MaxBackups] {
+		os.Remove(b)
+		os.Remove(b + ".gz")
+	}
+}
+
+// backups lists rotated files for this path without their ".gz" suffix, oldest first. A backup being compressed
+// is listed once although both the original and its compressed copy may exist for a moment.
+func (f *File) backups() []string {
+	matches, _ := filepath.Glob(f.path + ".*")
+
+	seen := make(map[string]bool, len(matches))
+	var backups []string
+	for _, m := range matches {
+		b := strings.TrimSuffix(m, ".gz")
+		if _, err := time.Parse(backupTimeFormat, strings.TrimPrefix(b, f.path+".")); err != nil || seen[b] {
+			continue
+		}
+		seen[b] = true
+		backups = append(backups, b)
+	}
+	sort.Strings(backups)
+	return backups
+}
+
+// compress gzips the file at path and removes the original. The compressed copy is written under a temporary name
+// and only renamed once complete, so a partial copy is never taken for a backup.
+func compress(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := path + ".gz.tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		gz.Close()
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path+".gz"); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(path)
+}
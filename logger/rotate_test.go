@@ -0,0 +1,112 @@
+package logger
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gklog "github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFile_RotatesOnSizeAndPrunesBackups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "herbert")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	f, err := NewFile(path, RotateOptions{MaxSize: 10, MaxBackups: 2, Compress: true})
+	require.NoError(t, err)
+
+	clock := time.Date(2020, 12, 1, 0, 0, 0, 0, time.UTC)
+	f.now = func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	}
+
+	for i := 0; i < 5; i++ {
+		_, err := f.Write([]byte("0123456789"))
+		require.NoError(t, err)
+	}
+	require.NoError(t, f.Close())
+
+	backups := f.backups()
+	assert.Len(t, backups, 2)
+	for _, b := range backups {
+		assert.FileExists(t, b+".gz")
+		assert.NoFileExists(t, b)
+	}
+
+	d, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(d))
+}
+
+func TestFile_CountsBackupsBeingCompressedOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "herbert")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	f := &File{path: path, opts: RotateOptions{MaxBackups: 1}}
+	older := path + ".20201201T000001.000000"
+	newer := path + ".20201201T000002.000000"
+	for _, name := range []string{older + ".gz", newer, newer + ".gz", newer + ".gz.tmp"} {
+		require.NoError(t, ioutil.WriteFile(name, nil, 0666))
+	}
+
+	assert.Equal(t, []string{older, newer}, f.backups())
+	f.prune()
+	assert.NoFileExists(t, older+".gz")
+	assert.FileExists(t, newer)
+}
+
+func TestFile_RotatesOnAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "herbert")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	f, err := NewFile(path, RotateOptions{MaxAge: time.Hour})
+	require.NoError(t, err)
+
+	clock := time.Now()
+	f.now = func() time.Time { return clock }
+	f.openedAt = clock
+
+	f.Write([]byte("first\n"))
+	clock = clock.Add(2 * time.Hour)
+	f.Write([]byte("second\n"))
+	require.NoError(t, f.Close())
+
+	assert.Len(t, f.backups(), 1)
+	d, _ := ioutil.ReadFile(path)
+	assert.Equal(t, "second\n", string(d))
+}
+
+func TestFile_Reopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "herbert")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	f, err := NewFile(path, RotateOptions{})
+	require.NoError(t, err)
+
+	f.Write([]byte("before\n"))
+	require.NoError(t, os.Rename(path, path+".1"))
+	require.NoError(t, f.Reopen())
+	f.Write([]byte("after\n"))
+	require.NoError(t, f.Close())
+
+	d, _ := ioutil.ReadFile(path)
+	assert.Equal(t, "after\n", string(d))
+}
+
+func TestOpenLogFile_FallsBackToStderr(t *testing.T) {
+	w := OpenLogFile("/nonexistent/dir/app.log", RotateOptions{}, gklog.NewNopLogger())
+	assert.Equal(t, nopCloser{os.Stderr}, w)
+}
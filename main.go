@@ -1,23 +1,40 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
 	"flag"
 	"sync"
 
 	"fmt"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"github.com/bnelz/gokit-base/admin"
+	"github.com/bnelz/gokit-base/build"
 	"github.com/bnelz/gokit-base/config"
+	"github.com/bnelz/gokit-base/cors"
+	"github.com/bnelz/gokit-base/deadline"
+	"github.com/bnelz/gokit-base/events"
 	"github.com/bnelz/gokit-base/health"
+	"github.com/bnelz/gokit-base/idempotency"
 	"github.com/bnelz/gokit-base/inmemory"
+	"github.com/bnelz/gokit-base/loadshed"
 	hb "github.com/bnelz/gokit-base/logger"
+	"github.com/bnelz/gokit-base/outbox"
+	"github.com/bnelz/gokit-base/ratelimit"
+	"github.com/bnelz/gokit-base/sqlstore"
 	"github.com/bnelz/gokit-base/users"
+	"github.com/bnelz/gokit-base/webhooks"
 	"github.com/go-kit/kit/log"
 	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	_ "github.com/lib/pq"
 	stdprometheus "github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -28,6 +45,9 @@ type serializedLogger struct {
 	log.Logger
 }
 
+// shutdownTimeout bounds how long in-flight requests may take to finish on shutdown
+const shutdownTimeout = 15 * time.Second
+
 // aConfig is the application configuration object
 var aConfig *config.Config
 
@@ -37,8 +57,9 @@ func main() {
 
 	// HTTP listener configuration
 	var (
-		port     = c.Env.HTTPPort
-		httpAddr = flag.String("http.addr", ":"+port, "HTTP Listen Address")
+		port      = c.Env.HTTPPort
+		httpAddr  = flag.String("http.addr", ":"+port, "HTTP Listen Address")
+		adminAddr = flag.String("admin.addr", ":"+c.AdminPort(), "Admin HTTP Listen Address")
 	)
 
 	flag.Parse()
@@ -46,25 +67,188 @@ func main() {
 	// Create and configure the logger
 	var logger log.Logger
 	logger = log.NewLogfmtLogger(os.Stderr)
-	logger = hb.NewHerbertFormatLogger(logger, c.Env.LogPath, c.LogLevel())
+	logFile := hb.OpenLogFile(c.Env.LogPath, c.LogRotation(), logger)
+	defer logFile.Close()
+	hb.ReopenOnSignal(logFile, logger, syscall.SIGHUP)
+	logBuffer, err := c.LogBuffer()
+	if err != nil {
+		panic(err)
+	}
+	logWriter := hb.NewAsyncWriter(logFile, logBuffer, kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Namespace: "api",
+		Subsystem: "logger",
+		Name:      "dropped_entries",
+		Help:      "Number of log entries dropped because the log buffer was full.",
+	}, []string{}))
+	defer logWriter.Close()
+	logLevels := hb.NewLevels(c.LogLevel())
+	logger = hb.NewHerbertFormatLogger(logger, logWriter, c.Env.LogChannel, logLevels)
 	logger = &serializedLogger{Logger: logger}
+	redactions, err := c.LogRedactions()
+	if err != nil {
+		panic(err)
+	}
+	logger = hb.NewRedactingLogger(logger, redactions, []byte(c.Env.LogHashKey))
 	logger = log.With(logger,
 		"context_environment", c.Env.ApplicationEnvironment,
 		"timestamp", log.DefaultTimestampUTC,
 	)
 
-	// Repository initialization
+	// Publish the running build for dashboards tracking rollouts
+	buildInfo := build.Get()
+	kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+		Namespace: "api",
+		Name:      "build_info",
+		Help:      "Build information of the running binary, always 1.",
+	}, []string{"version", "commit", "build_time", "go_version"}).With(buildInfo.Labels()...).Set(1)
+
+	// Repository initialization, users are stored in PostgreSQL when a database is configured. The repository also
+	// allocates user IDs and keeps the outbox of user events and the audit history of users.
 	var (
-		userRepo users.Repository
+		userRepo    users.Repository
+		userIDs     users.IDGenerator
+		userStore   users.Repository
+		userStoreTx users.Transactor
+		outboxStore outbox.Store
+		auditStore  users.AuditStore
 	)
 
 	fieldKeys := []string{"method"}
 
-	userRepo = inmemory.NewInMemUserRepository()
+	if c.Env.DatabaseURL != "" {
+		db, err := sql.Open("postgres", c.Env.DatabaseURL)
+		if err != nil {
+			panic(err)
+		}
+		defer db.Close()
+		if _, err := db.Exec(sqlstore.Schema); err != nil {
+			panic(err)
+		}
+		sqlUsers := sqlstore.NewUserRepository(db, log.With(logger, "context_component", "users"))
+		userStore, userIDs, userStoreTx, outboxStore, auditStore = sqlUsers, sqlUsers, sqlUsers, sqlUsers, sqlUsers
+	} else {
+		inMemUsers := inmemory.NewInMemUserRepository()
+		userStore, userIDs, userStoreTx, outboxStore, auditStore = inMemUsers, inMemUsers, inMemUsers, inMemUsers, inMemUsers
+	}
+
+	// Repository calls are retried on transient errors, and fail fast while repeated ones keep the breaker open.
+	// Reads and transactions share the breaker, readiness fails while it is open.
+	breakerFailures, breakerTimeout := c.RepositoryBreaker()
+	repoBreaker := users.NewBreaker("users_repository",
+		users.BreakerOptions{Failures: breakerFailures, OpenTimeout: breakerTimeout, HalfOpenCalls: 1},
+		kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: "api",
+			Subsystem: "users_repository",
+			Name:      "breaker_state",
+			Help:      "State of the user repository circuit breaker: 0 closed, 1 half open, 2 open.",
+		}, []string{}),
+		log.With(logger, "context_component", "users"),
+	)
+	retryAttempts, retryBackoff := c.RepositoryRetries()
+	repoRetries := users.RetryOptions{Attempts: retryAttempts, BaseBackoff: retryBackoff, MaxBackoff: time.Second}
+	userRepo = users.NewRetryingRepository(repoRetries, users.NewCircuitBreakingRepository(repoBreaker, userStore))
+	userTx := users.NewRetryingTransactor(repoRetries, users.NewCircuitBreakingTransactor(repoBreaker, userStoreTx))
+
+	// Users are read through a cache, writes invalidate the users they touch
+	cacheSize, cacheTTL, cacheNegativeTTL := c.UserCache()
+	userCache := users.NewCache(users.CacheOptions{Size: cacheSize, TTL: cacheTTL, NegativeTTL: cacheNegativeTTL}, users.CacheMetrics{
+		Hits: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "api",
+			Subsystem: "users_cache",
+			Name:      "hits_total",
+			Help:      "Number of user lookups served from the cache.",
+		}, []string{}),
+		Misses: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "api",
+			Subsystem: "users_cache",
+			Name:      "misses_total",
+			Help:      "Number of user lookups read through to the repository.",
+		}, []string{}),
+		Evictions: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "api",
+			Subsystem: "users_cache",
+			Name:      "evictions_total",
+			Help:      "Number of cached user lookups evicted to keep the cache within its size.",
+		}, []string{}),
+	})
+	userRepo = users.NewCachingRepository(userCache, userRepo)
+	userTx = users.NewCachingTransactor(userCache, userTx)
+
+	// Permanently remove soft deleted users once their retention period is over
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	retention, purgeInterval := c.UserPurge()
+	go users.RunPurge(ctx, userRepo, retention, purgeInterval, log.With(logger, "context_component", "users"))
+
+	// Webhook subscribers receive user events over HTTP. The dispatcher is closed after the relays so events
+	// being relayed still reach it.
+	webhookRepo := inmemory.NewInMemWebhookRepository()
+	webhookDLQ := inmemory.NewInMemDeadLetterQueue()
+	dispatcher := webhooks.NewDispatcher(webhookRepo, webhookDLQ, webhooks.NewClient(), c.Webhooks(),
+		log.With(logger, "context_component", "webhooks"),
+		kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "api",
+			Subsystem: "webhooks",
+			Name:      "deliveries_total",
+			Help:      "Number of webhook delivery attempts by result.",
+		}, []string{"result"}),
+	)
+	defer dispatcher.Close()
+
+	// Admin UIs follow user changes as Server-Sent Events identified by their outbox record IDs. The server write
+	// timeout ends a stream every five minutes, browsers reconnect to any instance and resume with Last-Event-ID.
+	userEvents := events.NewStream(c.EventStream())
+
+	// User events are committed to the repository outbox along with the writes causing them. Every consumer has a
+	// relay of its own, so a slow or failing consumer only holds back itself. Webhooks are relayed from a durable
+	// cursor by one instance at a time, the cursor only moves past an event once every delivery of it was made or
+	// dead lettered. Delivery is at least once, receivers deduplicate by event ID. Every instance streams every
+	// event to its own clients from a cursor of its own.
+	relayed := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Namespace: "api",
+		Subsystem: "outbox",
+		Name:      "relayed_total",
+		Help:      "Number of outbox events relayed by consumer.",
+	}, []string{"consumer"})
+	relayLogger := log.With(logger, "context_component", "outbox")
+	relays := []*outbox.Relay{
+		outbox.NewRelay(outboxStore, "webhooks", func(ctx context.Context, rec outbox.Record, ack func()) error {
+			return dispatcher.Dispatch(ctx, rec.Event, ack)
+		}, c.Outbox(), relayLogger, relayed),
+		outbox.NewLocalRelay(outboxStore, "event-stream", func(_ context.Context, rec outbox.Record, ack func()) error {
+			if err := userEvents.Push(rec.ID, rec.Event); err != nil {
+				return err
+			}
+			ack()
+			return nil
+		}, c.Outbox(), relayLogger, relayed),
+	}
+
+	// Every consumer is registered before any relay runs so no record is trimmed before all of them saw it. The
+	// relays stop before the consumers are closed.
+	relayCtx, stopRelays := context.WithCancel(ctx)
+	var relaying sync.WaitGroup
+	for _, r := range relays {
+		if err := r.Register(relayCtx); err != nil {
+			panic(err)
+		}
+	}
+	for _, r := range relays {
+		relaying.Add(1)
+		go func(r *outbox.Relay) {
+			defer relaying.Done()
+			r.Run(relayCtx)
+		}(r)
+	}
+	defer func() {
+		stopRelays()
+		relaying.Wait()
+	}()
 
 	// Initialize the users service and wrap it with our middlewares
 	var us users.Service
-	us = users.NewService(userRepo)
+	us = users.NewService(userRepo, userIDs, auditStore, userTx)
+	us = users.NewValidatingService(us)
 	us = users.NewLoggingService(log.With(logger, "context_component", "users"), us)
 	us = users.NewInstrumentingService(
 		kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
@@ -86,47 +270,143 @@ func main() {
 	httpLogger := log.With(logger, "context_component", "http")
 	mux := http.NewServeMux()
 
-	mux.Handle("/api/v1/users", users.MakeHandler(us, httpLogger))
-	mux.Handle("/api/v1/users/", users.MakeHandler(us, httpLogger))
+	// Clients retrying creates and updates send an Idempotency-Key so the retries are not applied twice. Imports
+	// are exempt, their bodies are too large to buffer.
+	idempotent := c.Idempotency()
+	idempotent.ExemptPaths = []string{"/api/v1/users:import"}
+	usersHandler := idempotency.New(inmemory.NewInMemIdempotencyStore(c.Env.IdempotencyMaxKeys, c.Env.IdempotencyMaxKeysPerClient), idempotent)(
+		users.MakeHandler(us, httpLogger, c.Clients(),
+			ratelimit.NewPolicy(inmemory.NewInMemRateLimiter(), c.RateLimits(), httpLogger),
+			deadline.NewPolicy(c.Deadlines()),
+		),
+	)
+	mux.Handle("/api/v1/users", usersHandler)
+	mux.Handle("/api/v1/users/", usersHandler)
+	mux.Handle("/api/v1/users:import", usersHandler)
+	mux.Handle("/api/v1/users:export", usersHandler)
+	mux.Handle("/api/v1/users/events", userEvents)
 	mux.Handle("/api/v1/health", health.MakeHandler(httpLogger))
+	mux.Handle("/api/v1/version", build.MakeHandler(buildInfo, httpLogger))
 
-	http.Handle("/", accessControl(mux))
-	http.Handle("/metrics", promhttp.Handler())
+	// Operational endpoints are only served on the admin listener
+	adminLogger := log.With(logger, "context_component", "admin")
+	adminMux := http.NewServeMux()
+
+	adminMux.Handle("/metrics", promhttp.Handler())
+	adminMux.Handle("/health/", health.MakeProbeHandler(adminLogger, users.BreakerReady(repoBreaker)))
+	adminMux.Handle("/admin/", admin.MakeHandler(logLevels, adminLogger))
+	adminUsersHandler := users.MakeAdminHandler(us, adminLogger)
+	adminMux.Handle("/admin/users", adminUsersHandler)
+	adminMux.Handle("/admin/users/", adminUsersHandler)
+	webhooksHandler := webhooks.MakeHandler(webhooks.NewService(webhookRepo, webhookDLQ, dispatcher), adminLogger)
+	adminMux.Handle("/admin/webhooks", webhooksHandler)
+	adminMux.Handle("/admin/webhooks/", webhooksHandler)
+	adminMux.Handle("/admin/build", build.MakeHandler(buildInfo, adminLogger))
+	adminMux.HandleFunc("/debug/pprof/", pprof.Index)
+	adminMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	adminMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	adminMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	adminMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	// The public listener sheds requests over an adaptive concurrency limit. Health checks and the long lived
+	// event stream are exempt, bulk imports and exports are slow by design and do not adjust the limit. Admin routes
+	// are served on their own listener.
+	shedding := c.LoadShedding()
+	shedding.ExemptPaths = []string{"/api/v1/health", "/api/v1/users/events"}
+	shedding.UnmeasuredPaths = []string{"/api/v1/users:import", "/api/v1/users:export"}
+	limited := loadshed.New(shedding, loadshed.Metrics{
+		Limit: kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: "api",
+			Subsystem: "concurrency",
+			Name:      "limit",
+			Help:      "Current number of requests the public listener serves at once.",
+		}, []string{}),
+		InFlight: kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: "api",
+			Subsystem: "concurrency",
+			Name:      "in_flight",
+			Help:      "Number of requests being served by the public listener.",
+		}, []string{}),
+		Shed: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "api",
+			Subsystem: "concurrency",
+			Name:      "shed_total",
+			Help:      "Number of requests rejected because the concurrency limit was reached.",
+		}, []string{}),
+	})(mux)
 
+	corsPolicy, err := c.CORS()
+	if err != nil {
+		panic(err)
+	}
 	srv := http.Server{
 		WriteTimeout: 300 * time.Second,
 		ReadTimeout:  300 * time.Second,
 		Addr:         *httpAddr,
+		Handler:      requestID(cors.New(corsPolicy)(limited)),
+	}
+	srv.RegisterOnShutdown(userEvents.Close)
+
+	adminSrv := http.Server{
+		WriteTimeout: 300 * time.Second,
+		ReadTimeout:  300 * time.Second,
+		Addr:         *adminAddr,
+		Handler:      adminMux,
 	}
 
 	// Define the atreides logging channels
-	errs := make(chan error, 2)
+	errs := make(chan error, 3)
 	go func() {
-		logger.Log("transport", "http", "address", *httpAddr, "message", "listening")
+		logger.Log(
+			"transport", "http",
+			"address", *httpAddr,
+			"version", buildInfo.Version,
+			"commit", buildInfo.Commit,
+			"build_time", buildInfo.BuildTime,
+			"go_version", buildInfo.GoVersion,
+			"message", "listening",
+		)
 		errs <- srv.ListenAndServe()
 	}()
 	go func() {
-		c := make(chan os.Signal)
-		signal.Notify(c, syscall.SIGINT)
+		logger.Log("transport", "http", "address", *adminAddr, "message", "admin listening")
+		errs <- adminSrv.ListenAndServe()
+	}()
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 		errs <- fmt.Errorf("%s", <-c)
 	}()
 
 	logger.Log("terminated", <-errs)
+
+	// Stop accepting connections and let in-flight requests finish
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Log("transport", "http", "message", err)
+	}
+	if err := adminSrv.Shutdown(shutdownCtx); err != nil {
+		logger.Log("transport", "http", "message", err)
+	}
 }
 
 func setConfig(c *config.Config) {
 	aConfig = c
 }
 
-func accessControl(h http.Handler) http.Handler {
+// requestID ensures every request carries an X-Request-Id, generating one when the client did not send it, and
+// echoes it on the response so errors can be correlated with logs
+func requestID(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type")
-
-		if r.Method == "OPTIONS" {
-			return
+		id := r.Header.Get("X-Request-Id")
+		if id == "" {
+			b := make([]byte, 16)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+			r.Header.Set("X-Request-Id", id)
 		}
+		w.Header().Set("X-Request-Id", id)
 
 		h.ServeHTTP(w, r)
 	})
@@ -0,0 +1,329 @@
+// Outbox package relays events recorded by repository transactions, so an event exists if and only if the write
+// that caused it was committed
+package outbox
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/bnelz/gokit-base/events"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+)
+
+// Record is an event committed to the outbox along with the write that caused it
+type Record struct {
+	// ID orders the records of an outbox
+	ID int64
+
+	Event     events.Envelope
+	CreatedAt time.Time
+}
+
+// MinRetention is how long records are kept at least once every registered consumer relayed them, so consumers
+// following the outbox from process memory read them before they are trimmed
+const MinRetention = time.Minute
+
+// Store is the set of behavior an outbox must conform to. Records are written by repository transactions and read
+// by every consumer at its own pace, each registered consumer has a durable cursor marking the records it relayed.
+type Store interface {
+	// Register starts a cursor for consumer at the end of the outbox unless it has one already. Records are kept
+	// until every registered consumer relayed them.
+	Register(ctx context.Context, consumer string) error
+
+	// Pending returns up to limit records consumer has not relayed, oldest first
+	Pending(ctx context.Context, consumer string, limit int) ([]Record, error)
+
+	// MarkRelayed moves the cursor of consumer past the record with the given ID
+	MarkRelayed(ctx context.Context, consumer string, id int64) error
+
+	// Acquire leases consumer to owner for ttl unless another owner holds an unexpired lease, and reports whether
+	// owner holds it. Renewing a held lease extends it.
+	Acquire(ctx context.Context, consumer string, owner string, ttl time.Duration) (bool, error)
+
+	// Since returns up to limit records after the record with the given ID, oldest first, without moving any cursor
+	Since(ctx context.Context, id int64, limit int) ([]Record, error)
+
+	// LastID returns the ID of the last record committed so far, zero if there is none
+	LastID(ctx context.Context) (int64, error)
+}
+
+// Handler hands a record to a consumer. A consumer done with the record when Handler returns calls ack before
+// returning, one finishing it in the background calls ack once its outcome is known, e.g. once a delivery that
+// is being retried succeeded or was given up on. A failing Handler must not call ack. Records that failed or were
+// never acknowledged are handed over again, after a restart at the latest.
+type Handler func(ctx context.Context, rec Record, ack func()) error
+
+// Events returns a Handler calling h with the event of every record and acknowledging the records h handled
+func Events(h events.Handler) Handler {
+	return func(ctx context.Context, rec Record, ack func()) error {
+		if err := h(ctx, rec.Event); err != nil {
+			return err
+		}
+		ack()
+		return nil
+	}
+}
+
+// RelayOptions configures a Relay
+type RelayOptions struct {
+	// BatchSize is the number of records read from the outbox at a time
+	BatchSize int
+
+	// Interval is how often the outbox is checked for pending records
+	Interval time.Duration
+
+	// Window is the number of records handed to the consumer and not acknowledged yet, further records wait
+	Window int
+
+	// Lease is how long a process keeps relaying to a registered consumer after it last renewed its lease. Another
+	// process takes over once it expired.
+	Lease time.Duration
+}
+
+// Relay drains an outbox into the handler of one consumer. The cursor of a registered consumer only moves past a
+// record once it and every record before it were acknowledged, so a failure or a crash in between relays them
+// again: delivery is at least once and consumers deduplicate by event ID. Every consumer has a relay of its own
+// so a slow or failing consumer only holds back itself, and a registered consumer is relayed to by one process at
+// a time, the one holding its lease.
+type Relay struct {
+	store    Store
+	consumer string
+	sink     Handler
+	opts     RelayOptions
+	logger   log.Logger
+	relayed  metrics.Counter
+
+	// local relays keep their cursor in process memory, owner identifies the process leasing registered consumers
+	local bool
+	owner string
+
+	// position is the ID of the last record handed to the sink. Until synced, the next records are read from the
+	// cursor of the consumer instead.
+	position int64
+	synced   bool
+
+	// mtx guards the records handed to the sink and not acknowledged yet. Acknowledgements made before the lease
+	// was lost are of an older generation and ignored. watermark is the last record acknowledged along with every
+	// record before it, unmarked counts those the cursor was not moved past yet.
+	mtx         sync.Mutex
+	generation  int
+	outstanding []int64
+	acked       map[int64]bool
+	watermark   int64
+	unmarked    int
+}
+
+// NewRelay returns a relay handing the records of store to the sink of the registered consumer. Relayed records
+// are counted by relayed with a consumer label.
+func NewRelay(store Store, consumer string, sink Handler, opts RelayOptions, logger log.Logger, relayed metrics.Counter) *Relay {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+	if opts.Window <= 0 {
+		opts.Window = 1000
+	}
+	if opts.Lease <= 0 {
+		opts.Lease = 30 * time.Second
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return &Relay{
+		store:    store,
+		consumer: consumer,
+		sink:     sink,
+		opts:     opts,
+		logger:   log.With(logger, "context_consumer", consumer),
+		relayed:  relayed.With("consumer", consumer),
+		owner:    hex.EncodeToString(b),
+		acked:    make(map[int64]bool),
+	}
+}
+
+// NewLocalRelay returns a relay handing the records of store to a consumer of this process, e.g. its connected
+// clients, from a cursor kept in memory that starts at the end of the outbox. Every process relays every record
+// to its own local consumer. Local consumers are not registered, so records they did not read within
+// MinRetention after every registered consumer relayed them are skipped.
+func NewLocalRelay(store Store, consumer string, sink Handler, opts RelayOptions, logger log.Logger, relayed metrics.Counter) *Relay {
+	r := NewRelay(store, consumer, sink, opts, logger, relayed)
+	r.local = true
+	return r
+}
+
+// Register registers the consumer of the relay with the store, or starts the cursor of a local consumer at the
+// end of the outbox. Consumers are registered before any of them runs so records are not trimmed before every
+// consumer saw them.
+func (r *Relay) Register(ctx context.Context) error {
+	if r.local {
+		id, err := r.store.LastID(ctx)
+		if err != nil {
+			return err
+		}
+		r.position, r.synced = id, true
+		return nil
+	}
+	return r.store.Register(ctx, r.consumer)
+}
+
+// Run relays pending records every interval until ctx is done
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := r.RelayPending(ctx); err != nil {
+			r.logger.Log("message", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RelayPending hands records to the sink until none are pending or the window is full, and returns how many
+// records were acknowledged and marked as relayed. It stops at the first record the sink fails to handle, that
+// record and the ones after it are handed over again on the next call. A relay whose registered consumer is
+// leased to another process relays nothing.
+func (r *Relay) RelayPending(ctx context.Context) (int, error) {
+	if !r.local {
+		held, err := r.store.Acquire(ctx, r.consumer, r.owner, r.opts.Lease)
+		if err != nil {
+			return 0, err
+		}
+		if !held {
+			r.reset()
+			return 0, nil
+		}
+	}
+
+	relayed := 0
+	for ctx.Err() == nil {
+		n, err := r.mark(ctx)
+		relayed += n
+		if err != nil {
+			return relayed, err
+		}
+
+		limit := r.room()
+		if limit == 0 {
+			return relayed, nil
+		}
+		if limit > r.opts.BatchSize {
+			limit = r.opts.BatchSize
+		}
+		var records []Record
+		if r.synced {
+			records, err = r.store.Since(ctx, r.position, limit)
+		} else {
+			records, err = r.store.Pending(ctx, r.consumer, limit)
+		}
+		if err != nil || len(records) == 0 {
+			return relayed, err
+		}
+
+		for _, rec := range records {
+			if err := r.sink(ctx, rec, r.handOver(rec.ID)); err != nil {
+				r.withdraw(rec.ID)
+				n, _ := r.mark(ctx)
+				return relayed + n, err
+			}
+			r.position, r.synced = rec.ID, true
+		}
+	}
+	return relayed, ctx.Err()
+}
+
+// handOver adds a record to the outstanding ones and returns its acknowledgement
+func (r *Relay) handOver(id int64) func() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.outstanding = append(r.outstanding, id)
+	generation := r.generation
+	var once sync.Once
+	return func() { once.Do(func() { r.ack(generation, id) }) }
+}
+
+// ack acknowledges a record and moves the watermark past the records acknowledged along with every record
+// before them
+func (r *Relay) ack(generation int, id int64) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if generation != r.generation {
+		return
+	}
+	r.acked[id] = true
+	for len(r.outstanding) > 0 && r.acked[r.outstanding[0]] {
+		r.watermark = r.outstanding[0]
+		delete(r.acked, r.watermark)
+		r.outstanding = r.outstanding[1:]
+		r.unmarked++
+	}
+}
+
+// withdraw removes the last record handed over after the sink failed to handle it
+func (r *Relay) withdraw(id int64) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if n := len(r.outstanding); n > 0 && r.outstanding[n-1] == id {
+		r.outstanding = r.outstanding[:n-1]
+	}
+}
+
+// room returns how many more records may be handed over
+func (r *Relay) room() int {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if n := r.opts.Window - len(r.outstanding); n > 0 {
+		return n
+	}
+	return 0
+}
+
+// mark moves the cursor of a registered consumer to the watermark and returns the number of records it moved past
+func (r *Relay) mark(ctx context.Context) (int, error) {
+	r.mtx.Lock()
+	watermark, n, generation := r.watermark, r.unmarked, r.generation
+	r.mtx.Unlock()
+	if n == 0 {
+		return 0, nil
+	}
+
+	if !r.local {
+		if err := r.store.MarkRelayed(ctx, r.consumer, watermark); err != nil {
+			return 0, err
+		}
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if generation != r.generation {
+		return 0, nil
+	}
+	r.unmarked -= n
+	r.relayed.Add(float64(n))
+	return n, nil
+}
+
+// reset forgets the records handed over once the lease was lost, another process relays them again
+func (r *Relay) reset() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.generation++
+	r.outstanding, r.acked = nil, make(map[int64]bool)
+	r.watermark, r.unmarked = 0, 0
+	r.position, r.synced = 0, false
+}
@@ -0,0 +1,298 @@
+package outbox_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	errs "github.com/bnelz/gokit-base/errors"
+	"github.com/bnelz/gokit-base/events"
+	"github.com/bnelz/gokit-base/inmemory"
+	"github.com/bnelz/gokit-base/outbox"
+	"github.com/bnelz/gokit-base/users"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// crashingStore fails to mark records as relayed, as if the process died right after handing them to the sink
+type crashingStore struct {
+	outbox.Store
+}
+
+func (crashingStore) MarkRelayed(context.Context, string, int64) error { return errors.New("crashed") }
+
+// newRepo returns a repository with the test consumer registered
+func newRepo(t *testing.T) inmemory.InMemUserRepository {
+	repo := inmemory.NewInMemUserRepository()
+	require.NoError(t, repo.Register(context.Background(), "test"))
+	return repo
+}
+
+func newService(repo inmemory.InMemUserRepository) users.Service {
+	return users.NewService(repo, repo, repo, repo)
+}
+
+// relay returns a relay of the test consumer
+func relay(store outbox.Store, sink outbox.Handler) *outbox.Relay {
+	return outbox.NewRelay(store, "test", sink, outbox.RelayOptions{BatchSize: 10}, log.NewNopLogger(), discard.NewCounter())
+}
+
+func TestRelay_RedeliversAfterCrash(t *testing.T) {
+	repo := newRepo(t)
+	_, err := newService(repo).CreateUser(context.Background(), 1, "Ada", "Lovelace", "")
+	require.NoError(t, err)
+
+	var handled []events.Envelope
+	sink := outbox.Events(func(_ context.Context, e events.Envelope) error {
+		handled = append(handled, e)
+		return nil
+	})
+
+	// The event reaches the consumer but the crash leaves it pending
+	crashed := outbox.NewRelay(crashingStore{repo}, "test", sink, outbox.RelayOptions{Lease: time.Millisecond},
+		log.NewNopLogger(), discard.NewCounter())
+	_, err = crashed.RelayPending(context.Background())
+	assert.Error(t, err)
+	pending, _ := repo.Pending(context.Background(), "test", 10)
+	assert.Len(t, pending, 1)
+
+	// Once the lease of the crashed process expired it is relayed again, consumers deduplicate by event ID
+	time.Sleep(5 * time.Millisecond)
+	n, err := relay(repo, sink).RelayPending(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	pending, _ = repo.Pending(context.Background(), "test", 10)
+	assert.Empty(t, pending)
+
+	require.Len(t, handled, 2)
+	assert.Equal(t, handled[0].ID, handled[1].ID)
+}
+
+func TestRelay_CursorWaitsForAcknowledgements(t *testing.T) {
+	repo := newRepo(t)
+	us := newService(repo)
+	for id := 1; id <= 3; id++ {
+		_, err := us.CreateUser(context.Background(), id, "Ada", "Lovelace", "")
+		require.NoError(t, err)
+	}
+
+	// The consumer finishes records in the background, in any order
+	acks := map[int]func(){}
+	r := relay(repo, func(_ context.Context, rec outbox.Record, ack func()) error {
+		acks[rec.Event.Data.(events.UserCreated).UserID] = ack
+		return nil
+	})
+	n, err := r.RelayPending(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+	require.Len(t, acks, 3)
+
+	// Records are only marked as relayed along with every record before them
+	acks[2]()
+	n, _ = r.RelayPending(context.Background())
+	assert.Equal(t, 0, n)
+	pending, _ := repo.Pending(context.Background(), "test", 10)
+	assert.Len(t, pending, 3)
+
+	acks[1]()
+	n, _ = r.RelayPending(context.Background())
+	assert.Equal(t, 2, n)
+	pending, _ = repo.Pending(context.Background(), "test", 10)
+	require.Len(t, pending, 1)
+	assert.Equal(t, 3, pending[0].Event.Data.(events.UserCreated).UserID)
+
+	// Records handed over are not handed over again while the process runs
+	assert.Len(t, acks, 3)
+}
+
+func TestRelay_LeaseHolderRelaysAlone(t *testing.T) {
+	repo := newRepo(t)
+	_, err := newService(repo).CreateUser(context.Background(), 1, "Ada", "Lovelace", "")
+	require.NoError(t, err)
+
+	calls := 0
+	sink := outbox.Events(func(context.Context, events.Envelope) error {
+		calls++
+		return nil
+	})
+	first, second := relay(repo, sink), relay(repo, sink)
+
+	// The process holding the lease relays, the other waits for it to expire
+	n, err := first.RelayPending(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	_, err = newService(repo).CreateUser(context.Background(), 2, "Grace", "Hopper", "")
+	require.NoError(t, err)
+	n, err = second.RelayPending(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, 1, calls)
+
+	held, err := repo.Acquire(context.Background(), "unknown", "owner", time.Minute)
+	assert.Error(t, err)
+	assert.False(t, held)
+}
+
+func TestLocalRelay_FollowsFromTheEnd(t *testing.T) {
+	repo := newRepo(t)
+	us := newService(repo)
+	_, err := us.CreateUser(context.Background(), 1, "Ada", "Lovelace", "")
+	require.NoError(t, err)
+
+	var handled []outbox.Record
+	sink := func(_ context.Context, rec outbox.Record, ack func()) error {
+		handled = append(handled, rec)
+		ack()
+		return nil
+	}
+	local := outbox.NewLocalRelay(repo, "stream", sink, outbox.RelayOptions{}, log.NewNopLogger(), discard.NewCounter())
+	require.NoError(t, local.Register(context.Background()))
+
+	// Records committed before the process started are skipped, every later one is relayed once
+	_, err = us.CreateUser(context.Background(), 2, "Grace", "Hopper", "")
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = local.RelayPending(context.Background())
+		require.NoError(t, err)
+	}
+	require.Len(t, handled, 1)
+	assert.Equal(t, int64(2), handled[0].ID)
+
+	// Local consumers hold no record back from registered consumers
+	pending, _ := repo.Pending(context.Background(), "test", 10)
+	assert.Len(t, pending, 2)
+}
+
+func TestRelay_StopsAtFailingRecord(t *testing.T) {
+	repo := newRepo(t)
+	us := newService(repo)
+	for id := 1; id <= 3; id++ {
+		_, err := us.CreateUser(context.Background(), id, "Ada", "Lovelace", "")
+		require.NoError(t, err)
+	}
+
+	calls := 0
+	sink := outbox.Events(func(_ context.Context, e events.Envelope) error {
+		calls++
+		if e.Data.(events.UserCreated).UserID == 2 {
+			return errors.New("unavailable")
+		}
+		return nil
+	})
+
+	n, err := relay(repo, sink).RelayPending(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 2, calls)
+
+	// The failed record and the ones after it are still pending, in order
+	pending, _ := repo.Pending(context.Background(), "test", 10)
+	require.Len(t, pending, 2)
+	assert.Equal(t, 2, pending[0].Event.Data.(events.UserCreated).UserID)
+	assert.Equal(t, 3, pending[1].Event.Data.(events.UserCreated).UserID)
+}
+
+func TestRelay_ConsumersRelayIndependently(t *testing.T) {
+	repo := inmemory.NewInMemUserRepository()
+	failing := outbox.NewRelay(repo, "failing", outbox.Events(func(context.Context, events.Envelope) error {
+		return errors.New("unavailable")
+	}), outbox.RelayOptions{BatchSize: 10}, log.NewNopLogger(), discard.NewCounter())
+	var handled []events.Envelope
+	healthy := outbox.NewRelay(repo, "healthy", outbox.Events(func(_ context.Context, e events.Envelope) error {
+		handled = append(handled, e)
+		return nil
+	}), outbox.RelayOptions{BatchSize: 10}, log.NewNopLogger(), discard.NewCounter())
+	require.NoError(t, failing.Register(context.Background()))
+	require.NoError(t, healthy.Register(context.Background()))
+
+	_, err := newService(repo).CreateUser(context.Background(), 1, "Ada", "Lovelace", "")
+	require.NoError(t, err)
+
+	// The failing consumer does not hold back the healthy one
+	_, err = failing.RelayPending(context.Background())
+	assert.Error(t, err)
+	n, err := healthy.RelayPending(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Len(t, handled, 1)
+
+	// The record is kept for the failing consumer only
+	pending, err := repo.Pending(context.Background(), "healthy", 10)
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+	pending, err = repo.Pending(context.Background(), "failing", 10)
+	require.NoError(t, err)
+	assert.Len(t, pending, 1)
+
+	_, err = repo.Pending(context.Background(), "unknown", 10)
+	assert.Error(t, err)
+}
+
+func TestTransact_FailedWriteRecordsNoEvent(t *testing.T) {
+	repo := newRepo(t)
+	us := newService(repo)
+	_, err := us.CreateUser(context.Background(), 1, "Ada", "Lovelace", "")
+	require.NoError(t, err)
+	require.NoError(t, repo.MarkRelayed(context.Background(), "test", 1))
+
+	_, err = us.UpdateUserColor(context.Background(), 1, "blue", 7)
+	assert.True(t, errors.Is(err, errs.ErrVersionConflict))
+
+	pending, _ := repo.Pending(context.Background(), "test", 10)
+	assert.Empty(t, pending)
+	history, _ := repo.History(context.Background(), 1, 0, 10)
+	require.Len(t, history, 1)
+	assert.Equal(t, users.OperationCreate, history[0].Operation)
+}
+
+func TestTransact_CrashDiscardsWritesAndEvents(t *testing.T) {
+	repo := newRepo(t)
+	_, err := newService(repo).CreateUser(context.Background(), 1, "Ada", "Lovelace", "")
+	require.NoError(t, err)
+	require.NoError(t, repo.MarkRelayed(context.Background(), "test", 1))
+
+	assert.Panics(t, func() {
+		repo.Transact(context.Background(), func(tx users.Repository, record func(events.Envelope), audit func(*users.AuditEntry)) error {
+			require.NoError(t, tx.Insert(context.Background(), users.New(2, "Grace", "Hopper")))
+			require.NoError(t, tx.Delete(context.Background(), 1, 0))
+			record(events.NewEnvelope(events.UserCreated{UserID: 2}, ""))
+			audit(&users.AuditEntry{UserID: 2, Operation: users.OperationCreate})
+			panic("crash")
+		})
+	})
+
+	_, err = repo.Find(context.Background(), 2, true)
+	assert.True(t, errors.Is(err, errs.ErrUserNotFound))
+	u, err := repo.Find(context.Background(), 1, false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, u.Version)
+	pending, _ := repo.Pending(context.Background(), "test", 10)
+	assert.Empty(t, pending)
+	history, _ := repo.History(context.Background(), 2, 0, 10)
+	assert.Empty(t, history)
+}
+
+func TestTransact_AtomicImportFailureRecordsNoEvent(t *testing.T) {
+	repo := newRepo(t)
+	us := newService(repo)
+	_, err := us.CreateUser(context.Background(), 2, "Ada", "Lovelace", "")
+	require.NoError(t, err)
+	require.NoError(t, repo.MarkRelayed(context.Background(), "test", 1))
+
+	results := us.ImportUsers(context.Background(), []users.User{
+		{ID: 1, FirstName: "Grace", LastName: "Hopper"},
+		{ID: 2, FirstName: "Alan", LastName: "Turing"},
+	}, true)
+	require.Len(t, results, 2)
+	assert.Error(t, results[0].Error)
+	assert.Error(t, results[1].Error)
+
+	_, err = repo.Find(context.Background(), 1, true)
+	assert.True(t, errors.Is(err, errs.ErrUserNotFound))
+	pending, _ := repo.Pending(context.Background(), "test", 10)
+	assert.Empty(t, pending)
+}
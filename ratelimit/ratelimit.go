@@ -0,0 +1,211 @@
+// Ratelimit package limits the rate of requests each client makes to each route with token buckets
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bnelz/gokit-base/auth"
+	errs "github.com/bnelz/gokit-base/errors"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	kitratelimit "github.com/go-kit/kit/ratelimit"
+	kithttp "github.com/go-kit/kit/transport/http"
+)
+
+// Client key sources, tried in the order they are configured
+const (
+	// KeyAPIKey identifies clients by their X-API-Key header, if it carries one of the configured API keys
+	KeyAPIKey = "api_key"
+
+	// KeyJWTSubject identifies clients by the subject of a valid bearer token
+	KeyJWTSubject = "jwt_subject"
+
+	// KeyIP identifies clients by their remote IP address
+	KeyIP = "ip"
+)
+
+// DefaultRoute names the rule applied to routes without a rule of their own
+const DefaultRoute = "default"
+
+// Rule allows Limit requests per Period, with bursts of up to Burst requests
+type Rule struct {
+	Limit  int
+	Period time.Duration
+
+	// Burst is the size of the bucket, it defaults to Limit
+	Burst int
+}
+
+// Result describes the state of a bucket after a request took from it
+type Result struct {
+	Allowed bool
+
+	// Limit is the number of requests allowed per period of the rule and Remaining the number of requests left in
+	// the bucket
+	Limit     int
+	Remaining int
+
+	// Reset is how long the bucket takes to fill up again
+	Reset time.Duration
+
+	// RetryAfter is how long a limited client has to wait for its next request to be allowed
+	RetryAfter time.Duration
+}
+
+// Limiter is the set of behavior a store of token buckets must conform to. Buckets are kept in process by the
+// inmemory implementation, a shared store lets several instances enforce the same limits.
+type Limiter interface {
+	// Take takes a token from the bucket of key, which is filled according to rule
+	Take(key string, rule Rule) (Result, error)
+}
+
+// Options configures a Policy
+type Options struct {
+	// Rules maps route names to their rule, DefaultRoute applies to the other routes. Routes without a rule are
+	// not limited.
+	Rules map[string]Rule
+
+	// Keys lists the sources a client is identified by, the first one present in a request is used. Defaults to
+	// the JWT subject, then the remote IP. Clients none of them identifies are identified by their remote IP.
+	Keys []string
+
+	// APIKeys lists the API keys issued to clients. Other keys are ignored, so clients cannot escape their limit
+	// by sending a new key with every request.
+	APIKeys []string
+
+	// JWTSecret verifies the HMAC signature of bearer tokens, their subject is ignored without it
+	JWTSecret []byte
+}
+
+// Policy limits the requests of each client to each route of a transport. A nil policy limits nothing.
+type Policy struct {
+	limiter Limiter
+	opts    Options
+	apiKeys map[string]bool
+	logger  log.Logger
+}
+
+// NewPolicy returns a policy taking tokens from limiter. Limiter errors are logged and let requests through.
+func NewPolicy(limiter Limiter, opts Options, logger log.Logger) *Policy {
+	if len(opts.Keys) == 0 {
+		opts.Keys = []string{KeyJWTSubject, KeyIP}
+	}
+	apiKeys := make(map[string]bool, len(opts.APIKeys))
+	for _, k := range opts.APIKeys {
+		apiKeys[k] = true
+	}
+	return &Policy{limiter: limiter, opts: opts, apiKeys: apiKeys, logger: logger}
+}
+
+// contextKey is the type of the request context keys of this package
+type contextKey int
+
+const (
+	clientKey contextKey = iota
+	resultKey
+)
+
+// PopulateClient is a go-kit ServerBefore function identifying the client making a request
+func (p *Policy) PopulateClient(ctx context.Context, r *http.Request) context.Context {
+	if p == nil {
+		return ctx
+	}
+	ctx = context.WithValue(ctx, resultKey, new(Result))
+	return context.WithValue(ctx, clientKey, p.client(r))
+}
+
+// Middleware limits the requests made to the endpoint of route. Limited requests fail with ErrRateLimited.
+func (p *Policy) Middleware(route string) endpoint.Middleware {
+	if p == nil {
+		return func(next endpoint.Endpoint) endpoint.Endpoint { return next }
+	}
+	rule, ok := p.opts.Rules[route]
+	if !ok {
+		rule, ok = p.opts.Rules[DefaultRoute]
+	}
+	if !ok || rule.Limit <= 0 || rule.Period <= 0 {
+		return func(next endpoint.Endpoint) endpoint.Endpoint { return next }
+	}
+	if rule.Burst <= 0 {
+		rule.Burst = rule.Limit
+	}
+
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			allower := kitratelimit.AllowerFunc(func() bool { return p.take(ctx, route, rule) })
+			response, err := kitratelimit.NewErroringLimiter(allower)(next)(ctx, request)
+			if err == kitratelimit.ErrLimited {
+				return nil, errs.ErrRateLimited
+			}
+			return response, err
+		}
+	}
+}
+
+// SetHeaders is a go-kit ServerAfter function describing the client's bucket in RateLimit-* headers
+func (p *Policy) SetHeaders(ctx context.Context, w http.ResponseWriter) context.Context {
+	if res, ok := ctx.Value(resultKey).(*Result); ok && res.Limit > 0 {
+		h := w.Header()
+		h.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+		h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		h.Set("RateLimit-Reset", seconds(res.Reset))
+		if !res.Allowed {
+			h.Set("Retry-After", seconds(res.RetryAfter))
+		}
+	}
+	return ctx
+}
+
+// ErrorEncoder wraps next so error responses carry the RateLimit-* headers, and Retry-After if the request was
+// limited
+func (p *Policy) ErrorEncoder(next kithttp.ErrorEncoder) kithttp.ErrorEncoder {
+	return func(ctx context.Context, err error, w http.ResponseWriter) {
+		p.SetHeaders(ctx, w)
+		next(ctx, err, w)
+	}
+}
+
+// take takes a token for the client in ctx and records the result for SetHeaders
+func (p *Policy) take(ctx context.Context, route string, rule Rule) bool {
+	client, _ := ctx.Value(clientKey).(string)
+	res, err := p.limiter.Take(route+"\x00"+client, rule)
+	if err != nil {
+		p.logger.Log("route", route, "err", err)
+		return true
+	}
+	if slot, ok := ctx.Value(resultKey).(*Result); ok {
+		*slot = res
+	}
+	return res.Allowed
+}
+
+// client identifies the client making r by the first configured key source present in r, or by its remote IP so
+// unidentified clients do not share a bucket
+func (p *Policy) client(r *http.Request) string {
+	for _, source := range p.opts.Keys {
+		var key string
+		switch source {
+		case KeyAPIKey:
+			if k := r.Header.Get("X-API-Key"); p.apiKeys[k] {
+				key = k
+			}
+		case KeyJWTSubject:
+			key = auth.Subject(r, p.opts.JWTSecret)
+		case KeyIP:
+			key = auth.RemoteIP(r)
+		}
+		if key != "" {
+			return source + ":" + key
+		}
+	}
+	return KeyIP + ":" + auth.RemoteIP(r)
+}
+
+// seconds formats d as a whole number of seconds, rounded up
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
@@ -0,0 +1,119 @@
+package ratelimit_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	errs "github.com/bnelz/gokit-base/errors"
+	"github.com/bnelz/gokit-base/inmemory"
+	"github.com/bnelz/gokit-base/ratelimit"
+	"github.com/go-kit/kit/log"
+	kithttp "github.com/go-kit/kit/transport/http"
+	jwt "github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newHandler(p *ratelimit.Policy) http.Handler {
+	return kithttp.NewServer(
+		p.Middleware("create_user")(func(context.Context, interface{}) (interface{}, error) { return nil, nil }),
+		func(context.Context, *http.Request) (interface{}, error) { return nil, nil },
+		func(context.Context, http.ResponseWriter, interface{}) error { return nil },
+		kithttp.ServerErrorEncoder(p.ErrorEncoder(errs.EncodeProblem)),
+		kithttp.ServerBefore(p.PopulateClient),
+		kithttp.ServerAfter(p.SetHeaders),
+	)
+}
+
+func do(h http.Handler, ip string, header string, value string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/api/v1/users", nil)
+	r.RemoteAddr = ip + ":4321"
+	if header != "" {
+		r.Header.Set(header, value)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestPolicy_LimitsPerClient(t *testing.T) {
+	h := newHandler(ratelimit.NewPolicy(inmemory.NewInMemRateLimiter(), ratelimit.Options{
+		Rules: map[string]ratelimit.Rule{ratelimit.DefaultRoute: {Limit: 2, Period: time.Hour}},
+	}, log.NewNopLogger()))
+
+	w := do(h, "10.0.0.1", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "1800", w.Header().Get("RateLimit-Reset"))
+
+	assert.Equal(t, http.StatusOK, do(h, "10.0.0.1", "", "").Code)
+	w = do(h, "10.0.0.1", "", "")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "1800", w.Header().Get("Retry-After"))
+	assert.Equal(t, errs.ProblemContentType, w.Header().Get("Content-Type"))
+
+	// Other addresses have buckets of their own
+	assert.Equal(t, http.StatusOK, do(h, "10.0.0.2", "", "").Code)
+}
+
+func TestPolicy_KeysByKnownAPIKeys(t *testing.T) {
+	h := newHandler(ratelimit.NewPolicy(inmemory.NewInMemRateLimiter(), ratelimit.Options{
+		Rules:   map[string]ratelimit.Rule{ratelimit.DefaultRoute: {Limit: 1, Period: time.Hour}},
+		Keys:    []string{ratelimit.KeyAPIKey, ratelimit.KeyIP},
+		APIKeys: []string{"k1"},
+	}, log.NewNopLogger()))
+
+	assert.Equal(t, http.StatusOK, do(h, "10.0.0.1", "", "").Code)
+
+	// An issued key has a bucket of its own, unknown keys are limited by address
+	assert.Equal(t, http.StatusOK, do(h, "10.0.0.1", "X-API-Key", "k1").Code)
+	assert.Equal(t, http.StatusTooManyRequests, do(h, "10.0.0.1", "X-API-Key", "k2").Code)
+}
+
+func TestPolicy_LimitsUnidentifiedClientsByAddress(t *testing.T) {
+	h := newHandler(ratelimit.NewPolicy(inmemory.NewInMemRateLimiter(), ratelimit.Options{
+		Rules:   map[string]ratelimit.Rule{ratelimit.DefaultRoute: {Limit: 60, Period: time.Minute, Burst: 1}},
+		Keys:    []string{ratelimit.KeyAPIKey},
+		APIKeys: []string{"k1"},
+	}, log.NewNopLogger()))
+
+	// Clients without an API key do not share one bucket
+	w := do(h, "10.0.0.1", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "60", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, http.StatusTooManyRequests, do(h, "10.0.0.1", "", "").Code)
+	assert.Equal(t, http.StatusOK, do(h, "10.0.0.2", "", "").Code)
+}
+
+func TestPolicy_KeysByJWTSubject(t *testing.T) {
+	secret := []byte("secret")
+	h := newHandler(ratelimit.NewPolicy(inmemory.NewInMemRateLimiter(), ratelimit.Options{
+		Rules:     map[string]ratelimit.Rule{"create_user": {Limit: 1, Period: time.Hour}},
+		Keys:      []string{ratelimit.KeyJWTSubject, ratelimit.KeyIP},
+		JWTSecret: secret,
+	}, log.NewNopLogger()))
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{Subject: "ada"}).SignedString(secret)
+	require.NoError(t, err)
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{Subject: "ada"}).SignedString([]byte("x"))
+	require.NoError(t, err)
+
+	// The subject is limited wherever it calls from, a forged token falls back to the address
+	assert.Equal(t, http.StatusOK, do(h, "10.0.0.1", "Authorization", "Bearer "+token).Code)
+	assert.Equal(t, http.StatusTooManyRequests, do(h, "10.0.0.2", "Authorization", "Bearer "+token).Code)
+	assert.Equal(t, http.StatusOK, do(h, "10.0.0.2", "Authorization", "Bearer "+forged).Code)
+}
+
+func TestPolicy_NilLimitsNothing(t *testing.T) {
+	h := newHandler(nil)
+	for i := 0; i < 3; i++ {
+		w := do(h, "10.0.0.1", "", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Header().Get("RateLimit-Limit"))
+	}
+}
@@ -0,0 +1,55 @@
+package sqlstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/bnelz/gokit-base/users"
+)
+
+// Append records entry and assigns its ID. Entries recording the writes of a transaction are appended by Transact.
+func (r *UserRepository) Append(ctx context.Context, entry *users.AuditEntry) error {
+	return r.appendEntry(ctx, r.q, entry)
+}
+
+// History returns a page of the entries of a user ordered by ID
+func (r *UserRepository) History(ctx context.Context, userID int, afterID int, limit int) ([]*users.AuditEntry, error) {
+	rows, err := r.q.QueryContext(ctx, `
+		SELECT id, user_id, actor, timestamp, operation, version, changes FROM audit_entries
+		WHERE user_id = $1 AND id > $2 ORDER BY id LIMIT $3`,
+		userID, afterID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []*users.AuditEntry{}
+	for rows.Next() {
+		var e users.AuditEntry
+		var changes []byte
+		if err := rows.Scan(&e.ID, &e.UserID, &e.Actor, &e.Timestamp, &e.Operation, &e.Version, &changes); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(changes, &e.Changes); err != nil {
+			return nil, fmt.Errorf("audit entry %d: %v", e.ID, err)
+		}
+		e.Timestamp = e.Timestamp.UTC()
+		history = append(history, &e)
+	}
+	return history, rows.Err()
+}
+
+// appendEntry inserts entry through q and assigns its ID
+func (r *UserRepository) appendEntry(ctx context.Context, q queryer, entry *users.AuditEntry) error {
+	changes, err := json.Marshal(entry.Changes)
+	if err != nil {
+		return err
+	}
+	return q.QueryRowContext(ctx, `
+		INSERT INTO audit_entries (user_id, actor, timestamp, operation, version, changes)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		entry.UserID, entry.Actor, entry.Timestamp, string(entry.Operation), entry.Version, changes,
+	).Scan(&entry.ID)
+}
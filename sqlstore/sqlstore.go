@@ -0,0 +1,567 @@
+// Sqlstore package implements the user repository, its transactional outbox and its audit history on a PostgreSQL
+// database
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	errs "github.com/bnelz/gokit-base/errors"
+	"github.com/bnelz/gokit-base/events"
+	"github.com/bnelz/gokit-base/outbox"
+	"github.com/bnelz/gokit-base/users"
+	"github.com/go-kit/kit/log"
+)
+
+// Schema creates the tables used by the store. Outbox records are kept until every consumer in outbox_cursors
+// relayed them, the process relaying to a consumer holds its lease until lease_until.
+const Schema = `
+CREATE SEQUENCE IF NOT EXISTS users_id_seq;
+
+CREATE TABLE IF NOT EXISTS users (
+	id         INTEGER PRIMARY KEY,
+	first_name TEXT NOT NULL,
+	last_name  TEXT NOT NULL,
+	fav_color  TEXT NOT NULL DEFAULT '',
+	version    INTEGER NOT NULL,
+	deleted_at TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS outbox (
+	id         BIGSERIAL PRIMARY KEY,
+	event_id   TEXT NOT NULL UNIQUE,
+	event_type TEXT NOT NULL,
+	payload    JSONB NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS outbox_cursors (
+	consumer    TEXT PRIMARY KEY,
+	position    BIGINT NOT NULL,
+	owner       TEXT NOT NULL DEFAULT '',
+	lease_until TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS audit_entries (
+	id        BIGSERIAL PRIMARY KEY,
+	user_id   INTEGER NOT NULL,
+	actor     TEXT NOT NULL,
+	timestamp TIMESTAMPTZ NOT NULL,
+	operation TEXT NOT NULL,
+	version   INTEGER NOT NULL,
+	changes   JSONB NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS audit_entries_user_id ON audit_entries (user_id, id);
+`
+
+// userColumns are the columns scanned by scanUser
+const userColumns = "id, first_name, last_name, fav_color, version, deleted_at"
+
+// outboxLock is the advisory lock serializing the transactions writing to the outbox
+const outboxLock = 7_001_044
+
+// errBatchFailed rolls back an atomic batch in which a user could not be inserted
+var errBatchFailed = errors.New("batch insert failed")
+
+// queryer is implemented by both *sql.DB and *sql.Tx
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// UserRepository is a user repository stored in PostgreSQL. It allocates IDs from a sequence and records events in
+// an outbox table and audit entries in an audit table within the transaction of the writes causing them.
+type UserRepository struct {
+	db *sql.DB
+
+	// q runs the queries, it is tx within a transaction and db otherwise
+	q  queryer
+	tx *sql.Tx
+
+	// logger reports the errors of methods that cannot return one
+	logger log.Logger
+}
+
+// NewUserRepository returns a user repository stored in db, which must have the tables created by Schema
+func NewUserRepository(db *sql.DB, logger log.Logger) *UserRepository {
+	return &UserRepository{db: db, q: db, logger: logger}
+}
+
+// Insert adds a user unless its ID is already taken and moves the ID sequence past it
+func (r *UserRepository) Insert(ctx context.Context, user *users.User) error {
+	return r.insert(ctx, r.q, user)
+}
+
+// Store upserts a user, checking its version against the stored user first
+func (r *UserRepository) Store(ctx context.Context, user *users.User) error {
+	var version int
+	var err error
+	if user.Version == 0 {
+		err = r.q.QueryRowContext(ctx, `
+			INSERT INTO users (id, first_name, last_name, fav_color, version) VALUES ($1, $2, $3, $4, 1)
+			ON CONFLICT (id) DO UPDATE
+				SET first_name = $2, last_name = $3, fav_color = $4, version = users.version + 1
+				WHERE users.deleted_at IS NULL
+			RETURNING version`,
+			user.ID, user.FirstName, user.LastName, user.FavoriteColor,
+		).Scan(&version)
+	} else {
+		err = r.q.QueryRowContext(ctx, `
+			UPDATE users SET first_name = $2, last_name = $3, fav_color = $4, version = version + 1
+			WHERE id = $1 AND version = $5 AND deleted_at IS NULL
+			RETURNING version`,
+			user.ID, user.FirstName, user.LastName, user.FavoriteColor, user.Version,
+		).Scan(&version)
+	}
+	if err == sql.ErrNoRows {
+		return r.missed(ctx, user.ID, user.Version, false)
+	}
+	if err != nil {
+		return errs.ErrInternal.Wrap(err)
+	}
+	if err := r.advanceSequence(ctx, r.q, user.ID); err != nil {
+		return err
+	}
+
+	user.Version = version
+	return nil
+}
+
+// Delete marks a user as deleted, checking its version first
+func (r *UserRepository) Delete(ctx context.Context, id int, version int) error {
+	res, err := r.q.ExecContext(ctx, `
+		UPDATE users SET deleted_at = $3, version = version + 1
+		WHERE id = $1 AND ($2 = 0 OR version = $2) AND deleted_at IS NULL`,
+		id, version, time.Now().UTC(),
+	)
+	if err != nil {
+		return errs.ErrInternal.Wrap(err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errs.ErrInternal.Wrap(err)
+	} else if n == 0 {
+		return r.missed(ctx, id, version, false)
+	}
+	return nil
+}
+
+// Restore clears the deleted mark of a user, checking its version first
+func (r *UserRepository) Restore(ctx context.Context, id int, version int) (*users.User, error) {
+	u, err := scanUser(r.q.QueryRowContext(ctx, `
+		UPDATE users SET deleted_at = NULL, version = version + 1
+		WHERE id = $1 AND ($2 = 0 OR version = $2) AND deleted_at IS NOT NULL
+		RETURNING `+userColumns,
+		id, version,
+	))
+	if err == sql.ErrNoRows {
+		return nil, r.missed(ctx, id, version, true)
+	}
+	if err != nil {
+		return nil, errs.ErrInternal.Wrap(err)
+	}
+	return u, nil
+}
+
+// Purge removes users deleted before the cutoff
+func (r *UserRepository) Purge(ctx context.Context, deletedBefore time.Time) int {
+	res, err := r.q.ExecContext(ctx, `DELETE FROM users WHERE deleted_at < $1`, deletedBefore)
+	if err != nil {
+		r.logger.Log("method", "Purge", "err", err)
+		return 0
+	}
+	n, _ := res.RowsAffected()
+	return int(n)
+}
+
+// Find retrieves a single user. Within a transaction the row is locked until the transaction ends, so concurrent
+// read-modify-write transactions of the same user run one after the other instead of losing an update.
+func (r *UserRepository) Find(ctx context.Context, id int, includeDeleted bool) (*users.User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = $1`
+	if r.tx != nil {
+		query += ` FOR UPDATE`
+	}
+	u, err := scanUser(r.q.QueryRowContext(ctx, query, id))
+	if err == sql.ErrNoRows || (err == nil && u.Deleted() && !includeDeleted) {
+		return nil, errs.ErrUserNotFound
+	}
+	if err != nil {
+		return nil, errs.ErrInternal.Wrap(err)
+	}
+	return u, nil
+}
+
+// FindAll retrieves all users, an empty slice is returned if the query fails
+func (r *UserRepository) FindAll(ctx context.Context, includeDeleted bool) []*users.User {
+	return r.findMany(ctx, "FindAll",
+		`SELECT `+userColumns+` FROM users WHERE $1 OR deleted_at IS NULL ORDER BY id`, includeDeleted,
+	)
+}
+
+// FindAfter returns a page of users ordered by ID, an empty page is returned if the query fails
+func (r *UserRepository) FindAfter(ctx context.Context, afterID int, limit int) []*users.User {
+	return r.findMany(ctx, "FindAfter",
+		`SELECT `+userColumns+` FROM users WHERE id > $1 AND deleted_at IS NULL ORDER BY id LIMIT $2`, afterID, limit,
+	)
+}
+
+// InsertBatch adds many users. An atomic batch is inserted in a transaction of its own, or under a savepoint when
+// the repository is already bound to one.
+func (r *UserRepository) InsertBatch(ctx context.Context, batch []*users.User, atomic bool) []error {
+	if !atomic {
+		return r.insertEach(ctx, r.q, batch)
+	}
+
+	var results []error
+	err := r.atomically(ctx, "insert_batch", func(q queryer) error {
+		results = r.insertEach(ctx, q, batch)
+		for _, err := range results {
+			if err != nil {
+				return errBatchFailed
+			}
+		}
+		return nil
+	})
+
+	if results == nil {
+		results = make([]error, len(batch))
+	}
+	for i := range results {
+		switch {
+		case results[i] != nil:
+		case err == errBatchFailed:
+			results[i] = errs.ErrImportAborted
+		case err != nil:
+			results[i] = errs.ErrInternal.Wrap(err)
+		}
+	}
+	return results
+}
+
+// NextID allocates an ID from the users sequence
+func (r *UserRepository) NextID(ctx context.Context) (int, error) {
+	var id int
+	if err := r.q.QueryRowContext(ctx, `SELECT nextval('users_id_seq')`).Scan(&id); err != nil {
+		return 0, errs.ErrInternal.Wrap(err)
+	}
+	return id, nil
+}
+
+// Transact runs fn in a database transaction. The events it records are inserted into the outbox table and the
+// entries it audits into the audit table before the transaction commits.
+func (r *UserRepository) Transact(ctx context.Context, fn func(repo users.Repository, record func(e events.Envelope), audit func(entry *users.AuditEntry)) error) error {
+	if r.tx != nil {
+		return errs.ErrInternal.WithDetail("nested transaction")
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errs.ErrInternal.Wrap(err)
+	}
+	// Rolling back a committed transaction is a no-op, this undoes failed and panicking transactions
+	defer tx.Rollback()
+
+	var recorded []events.Envelope
+	var audited []*users.AuditEntry
+	repo := &UserRepository{db: r.db, q: tx, tx: tx, logger: r.logger}
+	err = fn(repo, func(e events.Envelope) { recorded = append(recorded, e) }, func(entry *users.AuditEntry) {
+		audited = append(audited, entry)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range audited {
+		if err := r.appendEntry(ctx, tx, entry); err != nil {
+			return errs.ErrInternal.Wrap(err)
+		}
+	}
+
+	// Consumers read the outbox with a cursor on its ID, so records must commit in ID order: the lock held until
+	// commit keeps a transaction from committing a lower ID after a higher one became visible
+	if len(recorded) > 0 {
+		if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, outboxLock); err != nil {
+			return errs.ErrInternal.Wrap(err)
+		}
+	}
+
+	now := time.Now().UTC()
+	for _, e := range recorded {
+		payload, err := json.Marshal(e)
+		if err != nil {
+			return errs.ErrInternal.Wrap(err)
+		}
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO outbox (event_id, event_type, payload, created_at) VALUES ($1, $2, $3, $4)`,
+			e.ID, string(e.Type), payload, now,
+		); err != nil {
+			return errs.ErrInternal.Wrap(err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errs.ErrInternal.Wrap(err)
+	}
+	return nil
+}
+
+// Register starts the cursor of a new consumer after the last record committed so far
+func (r *UserRepository) Register(ctx context.Context, consumer string) error {
+	_, err := r.q.ExecContext(ctx, `
+		INSERT INTO outbox_cursors (consumer, position) SELECT $1, COALESCE(MAX(id), 0) FROM outbox
+		ON CONFLICT (consumer) DO NOTHING`,
+		consumer,
+	)
+	return err
+}
+
+// Pending returns the oldest records past the cursor of consumer
+func (r *UserRepository) Pending(ctx context.Context, consumer string, limit int) ([]outbox.Record, error) {
+	return r.records(ctx, `
+		SELECT o.id, o.payload, o.created_at FROM outbox o
+		JOIN outbox_cursors c ON c.consumer = $1 AND o.id > c.position
+		ORDER BY o.id LIMIT $2`,
+		consumer, limit,
+	)
+}
+
+// Since returns the oldest records after the record with the given ID
+func (r *UserRepository) Since(ctx context.Context, id int64, limit int) ([]outbox.Record, error) {
+	return r.records(ctx, `SELECT id, payload, created_at FROM outbox WHERE id > $1 ORDER BY id LIMIT $2`, id, limit)
+}
+
+// LastID returns the ID of the last record committed so far. Records every consumer relayed may have been
+// deleted, the cursors still point past them.
+func (r *UserRepository) LastID(ctx context.Context) (int64, error) {
+	var id int64
+	err := r.q.QueryRowContext(ctx, `
+		SELECT GREATEST(
+			COALESCE((SELECT MAX(id) FROM outbox), 0),
+			COALESCE((SELECT MAX(position) FROM outbox_cursors), 0)
+		)`,
+	).Scan(&id)
+	return id, err
+}
+
+// Acquire leases consumer to owner unless another owner holds an unexpired lease. Leases expire by the database
+// clock so processes on hosts with skewed clocks agree on them.
+func (r *UserRepository) Acquire(ctx context.Context, consumer string, owner string, ttl time.Duration) (bool, error) {
+	res, err := r.q.ExecContext(ctx, `
+		UPDATE outbox_cursors SET owner = $2, lease_until = now() + $3::bigint * interval '1 microsecond'
+		WHERE consumer = $1 AND (owner = $2 OR lease_until IS NULL OR lease_until < now())`,
+		consumer, owner, ttl.Microseconds(),
+	)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return false, err
+	} else if n > 0 {
+		return true, nil
+	}
+
+	var registered bool
+	if err := r.q.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM outbox_cursors WHERE consumer = $1)`, consumer,
+	).Scan(&registered); err != nil {
+		return false, err
+	}
+	if !registered {
+		return false, fmt.Errorf("outbox consumer %q is not registered", consumer)
+	}
+	return false, nil
+}
+
+// MarkRelayed moves the cursor of consumer and deletes the records every consumer relayed, once they are older
+// than outbox.MinRetention
+func (r *UserRepository) MarkRelayed(ctx context.Context, consumer string, id int64) error {
+	res, err := r.q.ExecContext(ctx,
+		`UPDATE outbox_cursors SET position = GREATEST(position, $2) WHERE consumer = $1`, consumer, id,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("outbox consumer %q is not registered", consumer)
+	}
+
+	_, err = r.q.ExecContext(ctx,
+		`DELETE FROM outbox WHERE id <= (SELECT MIN(position) FROM outbox_cursors) AND created_at < $1`,
+		time.Now().UTC().Add(-outbox.MinRetention),
+	)
+	return err
+}
+
+// records runs a query returning outbox records
+func (r *UserRepository) records(ctx context.Context, query string, args ...interface{}) ([]outbox.Record, error) {
+	rows, err := r.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []outbox.Record{}
+	for rows.Next() {
+		var rec outbox.Record
+		var payload []byte
+		if err := rows.Scan(&rec.ID, &payload, &rec.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(payload, &rec.Event); err != nil {
+			return nil, fmt.Errorf("outbox record %d: %v", rec.ID, err)
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// insert adds a user through q
+func (r *UserRepository) insert(ctx context.Context, q queryer, user *users.User) error {
+	res, err := q.ExecContext(ctx, `
+		INSERT INTO users (id, first_name, last_name, fav_color, version) VALUES ($1, $2, $3, $4, 1)
+		ON CONFLICT (id) DO NOTHING`,
+		user.ID, user.FirstName, user.LastName, user.FavoriteColor,
+	)
+	if err != nil {
+		return errs.ErrInternal.Wrap(err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errs.ErrInternal.Wrap(err)
+	} else if n == 0 {
+		return errs.ErrUserExists
+	}
+	if err := r.advanceSequence(ctx, q, user.ID); err != nil {
+		return err
+	}
+
+	user.Version = 1
+	return nil
+}
+
+// insertEach inserts every user of batch through q and returns a result per user
+func (r *UserRepository) insertEach(ctx context.Context, q queryer, batch []*users.User) []error {
+	results := make([]error, len(batch))
+	for i, u := range batch {
+		results[i] = r.insert(ctx, q, u)
+	}
+	return results
+}
+
+// advanceSequence keeps IDs allocated by NextID ahead of the IDs stored by clients
+func (r *UserRepository) advanceSequence(ctx context.Context, q queryer, id int) error {
+	_, err := q.ExecContext(ctx, `
+		SELECT setval('users_id_seq', $1) FROM users_id_seq
+		WHERE last_value < $1 OR NOT is_called`,
+		id,
+	)
+	if err != nil {
+		return errs.ErrInternal.Wrap(err)
+	}
+	return nil
+}
+
+// atomically runs fn in a transaction, or under a savepoint named name if the repository is bound to one
+func (r *UserRepository) atomically(ctx context.Context, name string, fn func(q queryer) error) error {
+	if r.tx != nil {
+		if _, err := r.tx.ExecContext(ctx, `SAVEPOINT `+name); err != nil {
+			return err
+		}
+		if err := fn(r.tx); err != nil {
+			if _, rbErr := r.tx.ExecContext(ctx, `ROLLBACK TO SAVEPOINT `+name); rbErr != nil {
+				return rbErr
+			}
+			return err
+		}
+		_, err := r.tx.ExecContext(ctx, `RELEASE SAVEPOINT `+name)
+		return err
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// missed explains why a write matching no row failed: the user does not exist, is not in the expected deleted
+// state or has another version
+func (r *UserRepository) missed(ctx context.Context, id int, version int, wantDeleted bool) error {
+	u, err := scanUser(r.q.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE id = $1`, id))
+	switch {
+	case err == sql.ErrNoRows:
+		return errs.ErrUserNotFound
+	case err != nil:
+		return errs.ErrInternal.Wrap(err)
+	case u.Deleted() && !wantDeleted:
+		return errs.ErrUserNotFound
+	case !u.Deleted() && wantDeleted:
+		return errs.ErrUserNotDeleted
+	case version == 0 && !wantDeleted:
+		// An upsert without a version only misses deleted users
+		return errs.ErrUserNotFound
+	default:
+		return errs.ErrVersionConflict
+	}
+}
+
+// findMany runs a query returning users, logging its error under method
+func (r *UserRepository) findMany(ctx context.Context, method string, query string, args ...interface{}) []*users.User {
+	found := []*users.User{}
+	rows, err := r.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		r.logger.Log("method", method, "err", err)
+		return found
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			r.logger.Log("method", method, "err", err)
+			return []*users.User{}
+		}
+		found = append(found, u)
+	}
+	if err := rows.Err(); err != nil {
+		r.logger.Log("method", method, "err", err)
+		return []*users.User{}
+	}
+	return found
+}
+
+// scanner is implemented by both *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanUser reads the userColumns of a row
+func scanUser(row scanner) (*users.User, error) {
+	var u users.User
+	var deletedAt sql.NullTime
+	if err := row.Scan(&u.ID, &u.FirstName, &u.LastName, &u.FavoriteColor, &u.Version, &deletedAt); err != nil {
+		return nil, err
+	}
+	if deletedAt.Valid {
+		t := deletedAt.Time.UTC()
+		u.DeletedAt = &t
+	}
+	return &u, nil
+}
+
+var (
+	_ users.Repository  = (*UserRepository)(nil)
+	_ users.IDGenerator = (*UserRepository)(nil)
+	_ users.Transactor  = (*UserRepository)(nil)
+	_ outbox.Store      = (*UserRepository)(nil)
+)
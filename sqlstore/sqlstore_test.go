@@ -0,0 +1,248 @@
+package sqlstore_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	errs "github.com/bnelz/gokit-base/errors"
+	"github.com/bnelz/gokit-base/events"
+	"github.com/bnelz/gokit-base/outbox"
+	"github.com/bnelz/gokit-base/sqlstore"
+	"github.com/bnelz/gokit-base/users"
+	"github.com/bnelz/gokit-base/users/userstest"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics/discard"
+	_ "github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// These tests run against the PostgreSQL database of DATABASE_URL, which they empty, and are skipped without one
+
+var ctx = context.Background()
+
+// newRepo returns a repository on an empty database
+func newRepo(t *testing.T) *sqlstore.UserRepository {
+	url := os.Getenv("DATABASE_URL")
+	if url == "" {
+		t.Skip("DATABASE_URL is not set")
+	}
+
+	db, err := sql.Open("postgres", url)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	_, err = db.Exec(`DROP TABLE IF EXISTS users, outbox, outbox_cursors, audit_entries; DROP SEQUENCE IF EXISTS users_id_seq`)
+	require.NoError(t, err)
+	_, err = db.Exec(sqlstore.Schema)
+	require.NoError(t, err)
+
+	return sqlstore.NewUserRepository(db, log.NewNopLogger())
+}
+
+func newService(repo *sqlstore.UserRepository) users.Service {
+	return users.NewService(repo, repo, repo, repo)
+}
+
+// crashingStore fails to mark records as relayed, as if the process died right after handing them to the sink
+type crashingStore struct {
+	outbox.Store
+}
+
+func (crashingStore) MarkRelayed(context.Context, string, int64) error { return errors.New("crashed") }
+
+func TestUserRepository(t *testing.T) {
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL is not set")
+	}
+	userstest.TestRepository(t, func() users.Repository { return newRepo(t) })
+}
+
+func TestRelay_RedeliversAfterCrash(t *testing.T) {
+	repo := newRepo(t)
+	require.NoError(t, repo.Register(ctx, "test"))
+	_, err := newService(repo).CreateUser(ctx, 1, "Ada", "Lovelace", "")
+	require.NoError(t, err)
+
+	var handled []events.Envelope
+	sink := outbox.Events(func(_ context.Context, e events.Envelope) error {
+		handled = append(handled, e)
+		return nil
+	})
+	opts := outbox.RelayOptions{BatchSize: 10, Lease: time.Millisecond}
+
+	_, err = outbox.NewRelay(crashingStore{repo}, "test", sink, opts, log.NewNopLogger(), discard.NewCounter()).
+		RelayPending(ctx)
+	assert.Error(t, err)
+	pending, err := repo.Pending(ctx, "test", 10)
+	require.NoError(t, err)
+	assert.Len(t, pending, 1)
+
+	// Once the lease of the crashed process expired another process relays the record again
+	time.Sleep(5 * time.Millisecond)
+	n, err := outbox.NewRelay(repo, "test", sink, opts, log.NewNopLogger(), discard.NewCounter()).RelayPending(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	pending, err = repo.Pending(ctx, "test", 10)
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+
+	require.Len(t, handled, 2)
+	assert.Equal(t, handled[0].ID, handled[1].ID)
+}
+
+func TestRelay_LeaseHolderRelaysAlone(t *testing.T) {
+	repo := newRepo(t)
+	require.NoError(t, repo.Register(ctx, "test"))
+
+	held, err := repo.Acquire(ctx, "test", "first", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, held)
+	held, err = repo.Acquire(ctx, "test", "second", time.Minute)
+	require.NoError(t, err)
+	assert.False(t, held)
+	held, err = repo.Acquire(ctx, "test", "first", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, held)
+
+	_, err = repo.Acquire(ctx, "unknown", "first", time.Minute)
+	assert.Error(t, err)
+}
+
+func TestOutbox_SinceAndLastID(t *testing.T) {
+	repo := newRepo(t)
+	require.NoError(t, repo.Register(ctx, "test"))
+	us := newService(repo)
+	for id := 1; id <= 3; id++ {
+		_, err := us.CreateUser(ctx, id, "Ada", "Lovelace", "")
+		require.NoError(t, err)
+	}
+
+	last, err := repo.LastID(ctx)
+	require.NoError(t, err)
+	records, err := repo.Since(ctx, last-2, 10)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, 2, records[0].Event.Data.(events.UserCreated).UserID)
+	assert.Equal(t, last, records[1].ID)
+
+	// Records are kept for consumers following the outbox from memory after every cursor moved past them
+	require.NoError(t, repo.MarkRelayed(ctx, "test", last))
+	records, err = repo.Since(ctx, 0, 10)
+	require.NoError(t, err)
+	assert.Len(t, records, 3)
+	id, err := repo.LastID(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, last, id)
+}
+
+func TestRelay_ConsumersRelayIndependently(t *testing.T) {
+	repo := newRepo(t)
+	require.NoError(t, repo.Register(ctx, "failing"))
+	require.NoError(t, repo.Register(ctx, "healthy"))
+	_, err := newService(repo).CreateUser(ctx, 1, "Ada", "Lovelace", "")
+	require.NoError(t, err)
+
+	_, err = outbox.NewRelay(repo, "failing", outbox.Events(func(context.Context, events.Envelope) error {
+		return errors.New("unavailable")
+	}), outbox.RelayOptions{}, log.NewNopLogger(), discard.NewCounter()).RelayPending(ctx)
+	assert.Error(t, err)
+	n, err := outbox.NewRelay(repo, "healthy", outbox.Events(func(context.Context, events.Envelope) error {
+		return nil
+	}), outbox.RelayOptions{}, log.NewNopLogger(), discard.NewCounter()).RelayPending(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	// The record is kept until the failing consumer relays it too
+	pending, err := repo.Pending(ctx, "failing", 10)
+	require.NoError(t, err)
+	assert.Len(t, pending, 1)
+	_, err = repo.Pending(ctx, "unknown", 10)
+	assert.Error(t, err)
+}
+
+func TestTransact_CrashDiscardsWritesAndEvents(t *testing.T) {
+	repo := newRepo(t)
+	require.NoError(t, repo.Register(ctx, "test"))
+	_, err := newService(repo).CreateUser(ctx, 1, "Ada", "Lovelace", "")
+	require.NoError(t, err)
+	require.NoError(t, repo.MarkRelayed(ctx, "test", 1))
+
+	assert.Panics(t, func() {
+		repo.Transact(ctx, func(tx users.Repository, record func(events.Envelope), audit func(*users.AuditEntry)) error {
+			require.NoError(t, tx.Insert(ctx, users.New(2, "Grace", "Hopper")))
+			require.NoError(t, tx.Delete(ctx, 1, 0))
+			record(events.NewEnvelope(events.UserCreated{UserID: 2}, ""))
+			audit(&users.AuditEntry{UserID: 2, Operation: users.OperationCreate, Timestamp: time.Now()})
+			panic("crash")
+		})
+	})
+
+	_, err = repo.Find(ctx, 2, true)
+	assert.True(t, errors.Is(err, errs.ErrUserNotFound))
+	u, err := repo.Find(ctx, 1, false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, u.Version)
+	pending, err := repo.Pending(ctx, "test", 10)
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+	history, err := repo.History(ctx, 2, 0, 10)
+	require.NoError(t, err)
+	assert.Empty(t, history)
+}
+
+func TestAudit_CommitsWithWrites(t *testing.T) {
+	repo := newRepo(t)
+	us := newService(repo)
+	_, err := us.CreateUser(users.WithActor(ctx, "alice"), 1, "Ada", "Lovelace", "")
+	require.NoError(t, err)
+	_, err = us.UpdateUserColor(ctx, 1, "blue", 7)
+	assert.True(t, errors.Is(err, errs.ErrVersionConflict))
+	_, err = us.UpdateUserColor(ctx, 1, "blue", 1)
+	require.NoError(t, err)
+
+	history, err := us.UserHistory(ctx, 1, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, "alice", history[0].Actor)
+	assert.Equal(t, users.OperationCreate, history[0].Operation)
+	assert.Equal(t, []users.FieldChange{{Field: "fav_color", Before: nil, After: "blue"}}, history[1].Changes)
+	assert.Equal(t, 2, history[1].Version)
+
+	history, err = us.UserHistory(ctx, 1, history[0].ID, 10)
+	require.NoError(t, err)
+	assert.Len(t, history, 1)
+}
+
+func TestTransact_ConcurrentUpdatesAreNotLost(t *testing.T) {
+	repo := newRepo(t)
+	require.NoError(t, repo.Insert(ctx, users.New(1, "Ada", "Lovelace")))
+
+	// Every transaction reads the user and stores it with the version it read
+	const writers = 10
+	var wg sync.WaitGroup
+	wg.Add(writers)
+	for i := 0; i < writers; i++ {
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, repo.Transact(ctx, func(tx users.Repository, _ func(events.Envelope), _ func(*users.AuditEntry)) error {
+				u, err := tx.Find(ctx, 1, false)
+				if err != nil {
+					return err
+				}
+				u.FirstName += "!"
+				return tx.Store(ctx, u)
+			}))
+		}()
+	}
+	wg.Wait()
+
+	u, err := repo.Find(ctx, 1, false)
+	require.NoError(t, err)
+	assert.Equal(t, 1+writers, u.Version)
+	assert.Equal(t, "Ada!!!!!!!!!!", u.FirstName)
+}
@@ -0,0 +1,95 @@
+package users
+
+import (
+	"context"
+	"time"
+)
+
+// Operation names a change recorded in the audit history of a user
+type Operation string
+
+const (
+	OperationCreate  Operation = "create"
+	OperationUpdate  Operation = "update"
+	OperationDelete  Operation = "delete"
+	OperationRestore Operation = "restore"
+)
+
+// AnonymousActor is recorded as the actor of changes made by requests that did not identify themselves
+const AnonymousActor = "anonymous"
+
+// FieldChange is the value of a single field before and after a change, nil when the field had no value
+type FieldChange struct {
+	Field  string      `json:"field"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// AuditEntry is an immutable record of a change to a user
+type AuditEntry struct {
+	// ID orders the entries of a store, it is assigned when the entry is appended
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	Actor     string    `json:"actor"`
+	Timestamp time.Time `json:"timestamp"`
+	Operation Operation `json:"operation"`
+
+	// Version is the version of the user after the change
+	Version int           `json:"version"`
+	Changes []FieldChange `json:"changes"`
+}
+
+// AuditStore is the set of behavior a store of audit entries must conform to. Entries can only be appended, they
+// are never changed or removed. Stores that are also a Transactor commit the entries of its transactions.
+type AuditStore interface {
+	// Append records entry and assigns its ID
+	Append(ctx context.Context, entry *AuditEntry) error
+
+	// History returns up to limit entries of a user with an ID greater than afterID, oldest first
+	History(ctx context.Context, userID int, afterID int, limit int) ([]*AuditEntry, error)
+}
+
+// actorKey is the context key of the actor making a request
+type actorKey struct{}
+
+// WithActor returns a copy of ctx carrying the actor making the request
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the actor making the request, AnonymousActor if there is none
+func ActorFromContext(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok && actor != "" {
+		return actor
+	}
+	return AnonymousActor
+}
+
+// diffUsers lists the fields that differ between before and after, a nil user has no field values
+func diffUsers(before *User, after *User) []FieldChange {
+	fields := func(u *User) []interface{} {
+		if u == nil {
+			return []interface{}{nil, nil, nil, nil}
+		}
+		values := []interface{}{u.FirstName, u.LastName, u.FavoriteColor, nil}
+		if u.DeletedAt != nil {
+			values[3] = *u.DeletedAt
+		}
+		for i, v := range values {
+			if v == "" {
+				values[i] = nil
+			}
+		}
+		return values
+	}
+
+	names := []string{"first_name", "last_name", "fav_color", "deleted_at"}
+	b, a := fields(before), fields(after)
+	changes := []FieldChange{}
+	for i, name := range names {
+		if b[i] != a[i] {
+			changes = append(changes, FieldChange{Field: name, Before: b[i], After: a[i]})
+		}
+	}
+	return changes
+}
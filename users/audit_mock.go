@@ -0,0 +1,52 @@
+// Mocks of the interfaces in users/audit.go, maintained by hand in the layout of MockGen output. Update them along
+// with the interfaces.
+
+package users
+
+import (
+	context "context"
+
+	gomock "github.com/golang/mock/gomock"
+)
+
+// Mock of AuditStore interface
+type MockAuditStore struct {
+	ctrl     *gomock.Controller
+	recorder *_MockAuditStoreRecorder
+}
+
+// Recorder for MockAuditStore (not exported)
+type _MockAuditStoreRecorder struct {
+	mock *MockAuditStore
+}
+
+func NewMockAuditStore(ctrl *gomock.Controller) *MockAuditStore {
+	mock := &MockAuditStore{ctrl: ctrl}
+	mock.recorder = &_MockAuditStoreRecorder{mock}
+	return mock
+}
+
+func (_m *MockAuditStore) EXPECT() *_MockAuditStoreRecorder {
+	return _m.recorder
+}
+
+func (_m *MockAuditStore) Append(ctx context.Context, entry *AuditEntry) error {
+	ret := _m.ctrl.Call(_m, "Append", ctx, entry)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockAuditStoreRecorder) Append(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Append", arg0, arg1)
+}
+
+func (_m *MockAuditStore) History(ctx context.Context, userID int, afterID int, limit int) ([]*AuditEntry, error) {
+	ret := _m.ctrl.Call(_m, "History", ctx, userID, afterID, limit)
+	ret0, _ := ret[0].([]*AuditEntry)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockAuditStoreRecorder) History(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "History", arg0, arg1, arg2, arg3)
+}
@@ -0,0 +1,142 @@
+package users
+
+import (
+	"context"
+	"time"
+
+	errs "github.com/bnelz/gokit-base/errors"
+	"github.com/bnelz/gokit-base/events"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+	"github.com/sony/gobreaker"
+)
+
+// BreakerOptions configures the circuit breaker of a repository
+type BreakerOptions struct {
+	// Failures is the number of consecutive transient errors opening the breaker, it defaults to 5
+	Failures uint32
+
+	// OpenTimeout is how long the breaker fails calls fast before letting trial calls through
+	OpenTimeout time.Duration
+
+	// HalfOpenCalls is the number of trial calls let through, the breaker closes once they all succeed
+	HalfOpenCalls uint32
+}
+
+// NewBreaker returns a circuit breaker opening after consecutive transient errors. Its state is reported to the
+// state gauge as 0 when closed, 1 when half open and 2 when open.
+func NewBreaker(name string, opts BreakerOptions, state metrics.Gauge, logger log.Logger) *gobreaker.CircuitBreaker {
+	if opts.Failures == 0 {
+		opts.Failures = 5
+	}
+	state.Set(float64(gobreaker.StateClosed))
+	return gobreaker.NewCircuitBreaker(gobreaker.Settings{
+		Name:        name,
+		MaxRequests: opts.HalfOpenCalls,
+		Timeout:     opts.OpenTimeout,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return counts.ConsecutiveFailures >= opts.Failures
+		},
+		IsSuccessful: func(err error) bool { return !Transient(err) },
+		OnStateChange: func(name string, from gobreaker.State, to gobreaker.State) {
+			state.Set(float64(to))
+			logger.Log("breaker", name, "from", from.String(), "to", to.String())
+		},
+	})
+}
+
+// BreakerReady returns a readiness check failing with ErrUnavailable while cb is open
+func BreakerReady(cb *gobreaker.CircuitBreaker) func(ctx context.Context) error {
+	return func(context.Context) error {
+		if cb.State() == gobreaker.StateOpen {
+			return errs.ErrUnavailable.WithDetail(cb.Name() + " circuit breaker is open")
+		}
+		return nil
+	}
+}
+
+// breakingRepository fails the calls of a repository fast while its circuit breaker is open
+type breakingRepository struct {
+	cb *gobreaker.CircuitBreaker
+	Repository
+}
+
+// NewCircuitBreakingRepository returns a repository calling r through cb. Calls made while cb is open fail with
+// ErrUnavailable without reaching r. Methods that cannot report errors are passed through.
+func NewCircuitBreakingRepository(cb *gobreaker.CircuitBreaker, r Repository) Repository {
+	return &breakingRepository{cb, r}
+}
+
+func (r *breakingRepository) Insert(ctx context.Context, user *User) error {
+	return execute(r.cb, func() error { return r.Repository.Insert(ctx, user) })
+}
+
+func (r *breakingRepository) Store(ctx context.Context, user *User) error {
+	return execute(r.cb, func() error { return r.Repository.Store(ctx, user) })
+}
+
+func (r *breakingRepository) Delete(ctx context.Context, id int, version int) error {
+	return execute(r.cb, func() error { return r.Repository.Delete(ctx, id, version) })
+}
+
+func (r *breakingRepository) Restore(ctx context.Context, id int, version int) (u *User, err error) {
+	err = execute(r.cb, func() error {
+		u, err = r.Repository.Restore(ctx, id, version)
+		return err
+	})
+	return u, err
+}
+
+func (r *breakingRepository) Find(ctx context.Context, id int, includeDeleted bool) (u *User, err error) {
+	err = execute(r.cb, func() error {
+		u, err = r.Repository.Find(ctx, id, includeDeleted)
+		return err
+	})
+	return u, err
+}
+
+// InsertBatch counts a batch with a transient error in any row as a failure, every row fails while cb is open
+func (r *breakingRepository) InsertBatch(ctx context.Context, users []*User, atomic bool) []error {
+	var results []error
+	err := execute(r.cb, func() error {
+		results = r.Repository.InsertBatch(ctx, users, atomic)
+		for _, err := range results {
+			if Transient(err) {
+				return err
+			}
+		}
+		return nil
+	})
+	if results == nil {
+		results = make([]error, len(users))
+		for i := range results {
+			results[i] = err
+		}
+	}
+	return results
+}
+
+// breakingTransactor fails transactions fast while its circuit breaker is open
+type breakingTransactor struct {
+	cb *gobreaker.CircuitBreaker
+	Transactor
+}
+
+// NewCircuitBreakingTransactor returns a transactor running the transactions of tx through cb. Transactions
+// started while cb is open fail with ErrUnavailable.
+func NewCircuitBreakingTransactor(cb *gobreaker.CircuitBreaker, tx Transactor) Transactor {
+	return &breakingTransactor{cb, tx}
+}
+
+func (t *breakingTransactor) Transact(ctx context.Context, fn func(repo Repository, record func(e events.Envelope), audit func(entry *AuditEntry)) error) error {
+	return execute(t.cb, func() error { return t.Transactor.Transact(ctx, fn) })
+}
+
+// execute calls fn through cb, translating the rejections of an open breaker to ErrUnavailable
+func execute(cb *gobreaker.CircuitBreaker, fn func() error) error {
+	_, err := cb.Execute(func() (interface{}, error) { return nil, fn() })
+	if err == gobreaker.ErrOpenState || err == gobreaker.ErrTooManyRequests {
+		return errs.ErrUnavailable.Wrap(err)
+	}
+	return err
+}
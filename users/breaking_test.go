@@ -0,0 +1,69 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	errs "github.com/bnelz/gokit-base/errors"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics/generic"
+	"github.com/golang/mock/gomock"
+	"github.com/sony/gobreaker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreakingRepository_FailsFastWhileOpen(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	state := generic.NewGauge("breaker_state")
+	cb := NewBreaker("users_repository", BreakerOptions{Failures: 2, OpenTimeout: 20 * time.Millisecond}, state, log.NewNopLogger())
+	mockRepo := NewMockRepository(ctrl)
+	repo := NewCircuitBreakingRepository(cb, mockRepo)
+	ready := BreakerReady(cb)
+
+	// Permanent errors do not count against the repository
+	mockRepo.EXPECT().Find(gomock.Any(), 1, false).Return(nil, errs.ErrUserNotFound).Times(3)
+	for i := 0; i < 3; i++ {
+		repo.Find(context.Background(), 1, false)
+	}
+	assert.Equal(t, gobreaker.StateClosed, cb.State())
+	assert.NoError(t, ready(context.Background()))
+
+	mockRepo.EXPECT().Find(gomock.Any(), 1, false).Return(nil, errConnLost).Times(2)
+	for i := 0; i < 2; i++ {
+		repo.Find(context.Background(), 1, false)
+	}
+	assert.Equal(t, gobreaker.StateOpen, cb.State())
+	assert.Equal(t, float64(gobreaker.StateOpen), state.Value())
+	assert.True(t, errors.Is(ready(context.Background()), errs.ErrUnavailable))
+
+	// While open the repository is not called
+	_, err := repo.Find(context.Background(), 1, false)
+	assert.True(t, errors.Is(err, errs.ErrUnavailable))
+	results := repo.InsertBatch(context.Background(), []*User{New(1, "Ada", "Lovelace")}, false)
+	assert.True(t, errors.Is(results[0], errs.ErrUnavailable))
+
+	// A successful trial call closes it again
+	time.Sleep(30 * time.Millisecond)
+	mockRepo.EXPECT().Find(gomock.Any(), 1, false).Return(New(1, "Ada", "Lovelace"), nil)
+	_, err = repo.Find(context.Background(), 1, false)
+	assert.NoError(t, err)
+	assert.Equal(t, gobreaker.StateClosed, cb.State())
+	assert.Equal(t, float64(gobreaker.StateClosed), state.Value())
+}
+
+func TestCircuitBreakingRepository_RetriesStopAtOpenBreaker(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cb := NewBreaker("users_repository", BreakerOptions{Failures: 1, OpenTimeout: time.Minute}, generic.NewGauge("breaker_state"), log.NewNopLogger())
+	mockRepo := NewMockRepository(ctrl)
+	repo := NewRetryingRepository(retries, NewCircuitBreakingRepository(cb, mockRepo))
+
+	mockRepo.EXPECT().Delete(gomock.Any(), 1, 0).Return(errConnLost).Times(1)
+	err := repo.Delete(context.Background(), 1, 0)
+	assert.True(t, errors.Is(err, errs.ErrUnavailable))
+}
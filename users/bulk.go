@@ -0,0 +1,193 @@
+package users
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	errs "github.com/bnelz/gokit-base/errors"
+)
+
+const (
+	ndjsonContentType = "application/x-ndjson"
+	csvContentType    = "text/csv"
+
+	// maxImportRows bounds the size of a single import
+	maxImportRows = 10000
+
+	// importChunkSize is the number of rows passed to the service at a time by best-effort imports
+	importChunkSize = 500
+
+	// exportFlushRows is how many exported rows are written between flushes to the client
+	exportFlushRows = 100
+)
+
+// csvColumns is the header of exported CSV files and the columns understood in imported ones
+var csvColumns = []string{"id", "first_name", "last_name", "fav_color"}
+
+// userRow is a single decoded import row, Error is set when the row could not be decoded
+type userRow struct {
+	User  User
+	Error error
+}
+
+// userRowReader reads users from an import body, returning io.EOF after the last row
+type userRowReader interface {
+	Read() (userRow, error)
+}
+
+// newUserRowReader returns a reader for the body's content type, NDJSON or CSV
+func newUserRowReader(r *http.Request) (userRowReader, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		mediaType = ndjsonContentType
+	}
+
+	switch mediaType {
+	case ndjsonContentType, "application/jsonl", "application/json":
+		s := bufio.NewScanner(r.Body)
+		s.Buffer(make([]byte, 64*1024), 1024*1024)
+		return &ndjsonRowReader{s: s}, nil
+	case csvContentType:
+		return newCSVRowReader(r.Body)
+	}
+	return nil, errs.ErrInvalidArgument.WithDetail("imports must be " + ndjsonContentType + " or " + csvContentType)
+}
+
+// ndjsonRowReader reads one JSON encoded user per line
+type ndjsonRowReader struct {
+	s *bufio.Scanner
+}
+
+// Read decodes the next non-empty line
+func (nr *ndjsonRowReader) Read() (userRow, error) {
+	for nr.s.Scan() {
+		line := strings.TrimSpace(nr.s.Text())
+		if line == "" {
+			continue
+		}
+
+		var req userCreateRequest
+		if err := json.Unmarshal([]byte(line), &req); err != nil {
+			return userRow{Error: errs.ErrInvalidArgument.Wrap(err)}, nil
+		}
+		return userRow{User: User{
+			ID:            req.ID,
+			FirstName:     req.FirstName,
+			LastName:      req.LastName,
+			FavoriteColor: req.FavoriteColor,
+		}}, nil
+	}
+
+	if err := nr.s.Err(); err != nil {
+		return userRow{}, errs.ErrInvalidArgument.Wrap(err)
+	}
+	return userRow{}, io.EOF
+}
+
+// csvRowReader reads users from CSV with a header row naming the columns
+type csvRowReader struct {
+	r       *csv.Reader
+	columns map[string]int
+}
+
+// newCSVRowReader reads the header row of body
+func newCSVRowReader(body io.Reader) (*csvRowReader, error) {
+	r := csv.NewReader(body)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, errs.ErrInvalidArgument.WithDetail("CSV imports must start with a header row")
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, c := range header {
+		columns[strings.ToLower(strings.TrimSpace(c))] = i
+	}
+	return &csvRowReader{r: r, columns: columns}, nil
+}
+
+// Read decodes the next record
+func (cr *csvRowReader) Read() (userRow, error) {
+	record, err := cr.r.Read()
+	if err == io.EOF {
+		return userRow{}, io.EOF
+	}
+	if err != nil {
+		if _, ok := err.(*csv.ParseError); ok {
+			return userRow{Error: errs.ErrInvalidArgument.Wrap(err)}, nil
+		}
+		return userRow{}, errs.ErrInvalidArgument.Wrap(err)
+	}
+
+	field := func(name string) string {
+		if i, ok := cr.columns[name]; ok && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+
+	u := User{
+		FirstName:     field("first_name"),
+		LastName:      field("last_name"),
+		FavoriteColor: field("fav_color"),
+	}
+	if id := strings.TrimSpace(field("id")); id != "" {
+		if u.ID, err = strconv.Atoi(id); err != nil {
+			return userRow{Error: errs.ErrInvalidArgument.WithDetail("id must be an integer")}, nil
+		}
+	}
+	return userRow{User: u}, nil
+}
+
+// userRowWriter streams exported users
+type userRowWriter interface {
+	Write(u User) error
+	Flush() error
+}
+
+// newUserRowWriter returns a writer for the export format, writing the CSV header if needed
+func newUserRowWriter(format string, w io.Writer) (userRowWriter, error) {
+	if format == csvContentType {
+		cw := csv.NewWriter(w)
+		if err := cw.Write(csvColumns); err != nil {
+			return nil, err
+		}
+		return &csvRowWriter{w: cw}, nil
+	}
+	return &ndjsonRowWriter{enc: json.NewEncoder(w)}, nil
+}
+
+// ndjsonRowWriter writes one JSON encoded user per line
+type ndjsonRowWriter struct {
+	enc *json.Encoder
+}
+
+// Write encodes u on its own line
+func (nw *ndjsonRowWriter) Write(u User) error { return nw.enc.Encode(u) }
+
+// Flush is a no-op, the encoder writes through
+func (nw *ndjsonRowWriter) Flush() error { return nil }
+
+// csvRowWriter writes users as CSV records
+type csvRowWriter struct {
+	w *csv.Writer
+}
+
+// Write writes u as a record
+func (cw *csvRowWriter) Write(u User) error {
+	return cw.w.Write([]string{strconv.Itoa(u.ID), u.FirstName, u.LastName, u.FavoriteColor})
+}
+
+// Flush writes buffered records
+func (cw *csvRowWriter) Flush() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
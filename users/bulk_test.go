@@ -0,0 +1,95 @@
+package users
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	errs "github.com/bnelz/gokit-base/errors"
+	kitlog "github.com/go-kit/kit/log"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransport_ImportBestEffortCSV(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockService := NewMockService(ctrl)
+	h := MakeHandler(mockService, kitlog.NewNopLogger(), nil, nil, nil)
+
+	mockService.EXPECT().ImportUsers(gomock.Any(), []User{
+		{FirstName: "Bob", LastName: "YourUncle", FavoriteColor: "blue"},
+		{ID: 9, FirstName: "Alice", LastName: "Smith"},
+		{ID: 10, FirstName: "Dave", LastName: "Jones"},
+	}, false).Return([]ImportResult{{ID: 1}, {Error: errs.ErrUserExists}, {Error: errs.ErrInternal.Wrap(
+		errors.New(`pq: relation "users" does not exist`))}})
+
+	body := "first_name,last_name,fav_color,id\nBob,YourUncle,blue,\nCarol,X,red,seven\nAlice,Smith,,9\nDave,Jones,,10\n"
+	r := httptest.NewRequest("POST", "/api/v1/users:import?mode=best-effort", strings.NewReader(body))
+	r.Header.Set("Content-Type", "text/csv")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var res userImportResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Equal(t, 1, res.Created)
+	assert.Equal(t, 3, res.Failed)
+	assert.False(t, res.Aborted)
+	assert.Equal(t, "created", res.Results[0].Status)
+	assert.Equal(t, 1, res.Results[0].ID)
+	assert.Equal(t, errs.CodeInvalidArgument, res.Results[1].Error.Code)
+	assert.Equal(t, errs.CodeUserExists, res.Results[2].Error.Code)
+	assert.Equal(t, 3, res.Results[2].Row)
+
+	// The cause of internal errors is not exposed
+	assert.Equal(t, errs.CodeInternal, res.Results[3].Error.Code)
+	assert.Empty(t, res.Results[3].Error.Detail)
+}
+
+func TestTransport_ImportAtomicAbortsOnUndecodableRow(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	h := MakeHandler(NewMockService(ctrl), kitlog.NewNopLogger(), nil, nil, nil)
+
+	body := `{"first_name":"Bob","last_name":"YourUncle"}` + "\n" + `{"first_name":` + "\n"
+	r := httptest.NewRequest("POST", "/api/v1/users:import", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-ndjson")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	var res userImportResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.True(t, res.Aborted)
+	assert.Equal(t, 0, res.Created)
+	assert.Equal(t, "aborted", res.Results[0].Status)
+	assert.Equal(t, "failed", res.Results[1].Status)
+}
+
+func TestTransport_ExportCSV(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockService := NewMockService(ctrl)
+	h := MakeHandler(mockService, kitlog.NewNopLogger(), nil, nil, nil)
+
+	mockService.EXPECT().ExportUsers(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, fn func(User) error) error {
+		fn(User{ID: 1, FirstName: "Bob", LastName: "YourUncle", FavoriteColor: "blue"})
+		fn(User{ID: 2, FirstName: "Alice", LastName: "Smith, Jr."})
+		return nil
+	})
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/users:export?format=csv", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "id,first_name,last_name,fav_color\n1,Bob,YourUncle,blue\n2,Alice,\"Smith, Jr.\",\n", w.Body.String())
+}
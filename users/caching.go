@@ -0,0 +1,270 @@
+package users
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	errs "github.com/bnelz/gokit-base/errors"
+	"github.com/bnelz/gokit-base/events"
+	"github.com/go-kit/kit/metrics"
+	"golang.org/x/sync/singleflight"
+)
+
+// CacheOptions configures a user cache
+type CacheOptions struct {
+	// Size is the number of lookups kept, the least recently used one is evicted to make room for another
+	Size int
+
+	// TTL is how long a found user is served from the cache
+	TTL time.Duration
+
+	// NegativeTTL is how long a user that was not found is remembered, 0 disables negative caching
+	NegativeTTL time.Duration
+}
+
+// CacheMetrics reports the effectiveness of a user cache
+type CacheMetrics struct {
+	// Hits and Misses count the lookups served from the cache and from the repository
+	Hits   metrics.Counter
+	Misses metrics.Counter
+
+	// Evictions counts the lookups dropped to keep the cache within its size
+	Evictions metrics.Counter
+}
+
+// Cache is a bounded LRU of users looked up by ID. It is shared by the caching repository reading through it and
+// the caching transactor invalidating it.
+type Cache struct {
+	mtx     sync.Mutex
+	opts    CacheOptions
+	metrics CacheMetrics
+	lru     *list.List
+	entries map[cacheKey]*list.Element
+	loads   singleflight.Group
+	now     func() time.Time
+
+	// epoch is advanced by every invalidation, lookups loaded in an earlier epoch may be stale and are not kept
+	epoch uint64
+}
+
+// cacheKey identifies the result of a Find call
+type cacheKey struct {
+	id             int
+	includeDeleted bool
+}
+
+// cacheEntry is a cached Find result, user is nil if the user was not found
+type cacheEntry struct {
+	key     cacheKey
+	user    *User
+	expires time.Time
+}
+
+// NewCache returns an empty user cache, its size defaults to 10000 lookups
+func NewCache(opts CacheOptions, m CacheMetrics) *Cache {
+	if opts.Size <= 0 {
+		opts.Size = 10000
+	}
+	return &Cache{
+		opts:    opts,
+		metrics: m,
+		lru:     list.New(),
+		entries: make(map[cacheKey]*list.Element),
+		now:     time.Now,
+	}
+}
+
+// get returns the live entry of key and the current epoch
+func (c *Cache) get(key cacheKey) (*cacheEntry, uint64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, c.epoch
+	}
+	e := el.Value.(*cacheEntry)
+	if !c.now().Before(e.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return nil, c.epoch
+	}
+	c.lru.MoveToFront(el)
+	return e, c.epoch
+}
+
+// put caches a copy of the lookup of key loaded in epoch, unless the cache was invalidated since
+func (c *Cache) put(key cacheKey, u *User, epoch uint64) {
+	ttl := c.opts.TTL
+	if u == nil {
+		ttl = c.opts.NegativeTTL
+	} else {
+		u = cloneUser(u)
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if ttl <= 0 || epoch != c.epoch {
+		return
+	}
+	e := &cacheEntry{key: key, user: u, expires: c.now().Add(ttl)}
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.opts.Size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+		c.metrics.Evictions.Add(1)
+	}
+}
+
+// invalidate drops the lookups of the users with the given IDs, or every lookup if all is set
+func (c *Cache) invalidate(ids []int, all bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.epoch++
+	if all {
+		c.lru.Init()
+		c.entries = make(map[cacheKey]*list.Element)
+		return
+	}
+	for _, id := range ids {
+		for _, key := range []cacheKey{{id, false}, {id, true}} {
+			if el, ok := c.entries[key]; ok {
+				c.lru.Remove(el)
+				delete(c.entries, key)
+			}
+		}
+	}
+}
+
+// cachingRepository serves Find calls from a cache, reading through to the repository on misses
+type cachingRepository struct {
+	cache *Cache
+	Repository
+}
+
+// NewCachingRepository returns a repository caching the users r finds in c. Concurrent misses for the same lookup
+// share a single call to r, made with the context of the first one. Writes made through the repository invalidate
+// the users they touch, writes made in transactions need a caching transactor sharing c.
+func NewCachingRepository(c *Cache, r Repository) Repository {
+	return &cachingRepository{c, &invalidatingRepository{r, c.invalidate}}
+}
+
+// Find returns a copy of the cached user if there is one
+func (r *cachingRepository) Find(ctx context.Context, id int, includeDeleted bool) (*User, error) {
+	key := cacheKey{id, includeDeleted}
+	e, epoch := r.cache.get(key)
+	if e != nil {
+		r.cache.metrics.Hits.Add(1)
+		if e.user == nil {
+			return nil, errs.ErrUserNotFound
+		}
+		return cloneUser(e.user), nil
+	}
+	r.cache.metrics.Misses.Add(1)
+
+	// Loads of different epochs are not shared, a caller missing after a write must not get a user read before it
+	v, err, _ := r.cache.loads.Do(fmt.Sprintf("%d/%t/%d", id, includeDeleted, epoch), func() (interface{}, error) {
+		u, err := r.Repository.Find(ctx, id, includeDeleted)
+		switch {
+		case err == nil:
+			r.cache.put(key, u, epoch)
+		case errors.Is(err, errs.ErrUserNotFound):
+			r.cache.put(key, nil, epoch)
+		}
+		return u, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cloneUser(v.(*User)), nil
+}
+
+// cachingTransactor invalidates the users written by committed and failed transactions alike
+type cachingTransactor struct {
+	cache *Cache
+	Transactor
+}
+
+// NewCachingTransactor returns a transactor invalidating the users the transactions of tx write in c. Reads made
+// in transactions are not served from c.
+func NewCachingTransactor(c *Cache, tx Transactor) Transactor {
+	return &cachingTransactor{c, tx}
+}
+
+func (t *cachingTransactor) Transact(ctx context.Context, fn func(repo Repository, record func(e events.Envelope), audit func(entry *AuditEntry)) error) error {
+	var (
+		written []int
+		all     bool
+	)
+	defer func() { t.cache.invalidate(written, all) }()
+
+	return t.Transactor.Transact(ctx, func(repo Repository, record func(e events.Envelope), audit func(entry *AuditEntry)) error {
+		return fn(&invalidatingRepository{repo, func(ids []int, purged bool) {
+			written = append(written, ids...)
+			all = all || purged
+		}}, record, audit)
+	})
+}
+
+// invalidatingRepository reports the users written through a repository once the writes are made
+type invalidatingRepository struct {
+	Repository
+	written func(ids []int, all bool)
+}
+
+func (r *invalidatingRepository) Insert(ctx context.Context, user *User) error {
+	defer r.written([]int{user.ID}, false)
+	return r.Repository.Insert(ctx, user)
+}
+
+func (r *invalidatingRepository) Store(ctx context.Context, user *User) error {
+	defer r.written([]int{user.ID}, false)
+	return r.Repository.Store(ctx, user)
+}
+
+func (r *invalidatingRepository) Delete(ctx context.Context, id int, version int) error {
+	defer r.written([]int{id}, false)
+	return r.Repository.Delete(ctx, id, version)
+}
+
+func (r *invalidatingRepository) Restore(ctx context.Context, id int, version int) (*User, error) {
+	defer r.written([]int{id}, false)
+	return r.Repository.Restore(ctx, id, version)
+}
+
+func (r *invalidatingRepository) Purge(ctx context.Context, deletedBefore time.Time) int {
+	n := r.Repository.Purge(ctx, deletedBefore)
+	r.written(nil, n > 0)
+	return n
+}
+
+func (r *invalidatingRepository) InsertBatch(ctx context.Context, users []*User, atomic bool) []error {
+	ids := make([]int, len(users))
+	for i, u := range users {
+		ids[i] = u.ID
+	}
+	defer r.written(ids, false)
+	return r.Repository.InsertBatch(ctx, users, atomic)
+}
+
+// cloneUser returns a deep copy of u
+func cloneUser(u *User) *User {
+	c := *u
+	if u.DeletedAt != nil {
+		deletedAt := *u.DeletedAt
+		c.DeletedAt = &deletedAt
+	}
+	return &c
+}
@@ -0,0 +1,22 @@
+package users_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bnelz/gokit-base/inmemory"
+	"github.com/bnelz/gokit-base/users"
+	"github.com/bnelz/gokit-base/users/userstest"
+	"github.com/go-kit/kit/metrics/discard"
+)
+
+func TestCachingRepository_Conformance(t *testing.T) {
+	userstest.TestRepository(t, func() users.Repository {
+		cache := users.NewCache(users.CacheOptions{Size: 100, TTL: time.Minute, NegativeTTL: time.Minute}, users.CacheMetrics{
+			Hits:      discard.NewCounter(),
+			Misses:    discard.NewCounter(),
+			Evictions: discard.NewCounter(),
+		})
+		return users.NewCachingRepository(cache, inmemory.NewInMemUserRepository())
+	})
+}
@@ -0,0 +1,141 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	errs "github.com/bnelz/gokit-base/errors"
+	"github.com/bnelz/gokit-base/events"
+	"github.com/go-kit/kit/metrics/generic"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// passthroughTransactor runs transactions directly against a repository
+type passthroughTransactor struct {
+	repo Repository
+}
+
+func (tx passthroughTransactor) Transact(_ context.Context, fn func(Repository, func(events.Envelope), func(*AuditEntry)) error) error {
+	return fn(tx.repo, func(events.Envelope) {}, func(*AuditEntry) {})
+}
+
+func newTestCache(size int) (*Cache, CacheMetrics) {
+	m := CacheMetrics{
+		Hits:      generic.NewCounter("hits"),
+		Misses:    generic.NewCounter("misses"),
+		Evictions: generic.NewCounter("evictions"),
+	}
+	return NewCache(CacheOptions{Size: size, TTL: time.Minute, NegativeTTL: time.Second}, m), m
+}
+
+func TestCachingRepository_ReadsThrough(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cache, m := newTestCache(10)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	mockRepo := NewMockRepository(ctrl)
+	repo := NewCachingRepository(cache, mockRepo)
+
+	mockRepo.EXPECT().Find(gomock.Any(), 1, false).Return(New(1, "Ada", "Lovelace"), nil).Times(2)
+	mockRepo.EXPECT().Find(gomock.Any(), 2, false).Return(nil, errs.ErrUserNotFound).Times(2)
+
+	for i := 0; i < 3; i++ {
+		u, err := repo.Find(context.Background(), 1, false)
+		require.NoError(t, err)
+		assert.Equal(t, "Ada", u.FirstName)
+		u.FirstName = "Grace"
+
+		_, err = repo.Find(context.Background(), 2, false)
+		assert.True(t, errors.Is(err, errs.ErrUserNotFound))
+	}
+	assert.Equal(t, float64(4), m.Hits.(*generic.Counter).Value())
+	assert.Equal(t, float64(2), m.Misses.(*generic.Counter).Value())
+
+	// Not found users expire before found ones
+	now = now.Add(2 * time.Second)
+	repo.Find(context.Background(), 1, false)
+	repo.Find(context.Background(), 2, false)
+	now = now.Add(time.Minute)
+	repo.Find(context.Background(), 1, false)
+}
+
+func TestCachingRepository_EvictsLeastRecentlyUsed(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cache, m := newTestCache(2)
+	mockRepo := NewMockRepository(ctrl)
+	repo := NewCachingRepository(cache, mockRepo)
+
+	for id := 1; id <= 3; id++ {
+		mockRepo.EXPECT().Find(gomock.Any(), id, false).Return(New(id, "Ada", "Lovelace"), nil)
+	}
+	repo.Find(context.Background(), 1, false)
+	repo.Find(context.Background(), 2, false)
+	repo.Find(context.Background(), 1, false)
+	repo.Find(context.Background(), 3, false)
+	assert.Equal(t, float64(1), m.Evictions.(*generic.Counter).Value())
+
+	// 2 was evicted, 1 was not
+	mockRepo.EXPECT().Find(gomock.Any(), 2, false).Return(New(2, "Ada", "Lovelace"), nil)
+	repo.Find(context.Background(), 1, false)
+	repo.Find(context.Background(), 2, false)
+}
+
+func TestCachingRepository_WritesInvalidate(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cache, _ := newTestCache(10)
+	mockRepo := NewMockRepository(ctrl)
+	repo := NewCachingRepository(cache, mockRepo)
+	tx := NewCachingTransactor(cache, passthroughTransactor{mockRepo})
+
+	mockRepo.EXPECT().Find(gomock.Any(), 1, false).Return(New(1, "Ada", "Lovelace"), nil).Times(3)
+	mockRepo.EXPECT().Store(gomock.Any(), gomock.Any()).Return(nil)
+	mockRepo.EXPECT().Delete(gomock.Any(), 1, 0).Return(nil)
+
+	repo.Find(context.Background(), 1, false)
+	require.NoError(t, repo.Store(context.Background(), New(1, "Ada", "Lovelace")))
+	repo.Find(context.Background(), 1, false)
+	require.NoError(t, tx.Transact(context.Background(), func(repo Repository, _ func(events.Envelope), _ func(*AuditEntry)) error {
+		return repo.Delete(context.Background(), 1, 0)
+	}))
+	repo.Find(context.Background(), 1, false)
+}
+
+func TestCachingRepository_CollapsesConcurrentMisses(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cache, _ := newTestCache(10)
+	mockRepo := NewMockRepository(ctrl)
+	repo := NewCachingRepository(cache, mockRepo)
+
+	release := make(chan struct{})
+	mockRepo.EXPECT().Find(gomock.Any(), 1, false).DoAndReturn(func(context.Context, int, bool) (*User, error) {
+		<-release
+		return New(1, "Ada", "Lovelace"), nil
+	}).Times(1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			u, err := repo.Find(context.Background(), 1, false)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, u.ID)
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+}
@@ -2,6 +2,10 @@ package users
 
 import (
 	"context"
+	"fmt"
+	"io"
+
+	errs "github.com/bnelz/gokit-base/errors"
 
 	"github.com/go-kit/kit/endpoint"
 )
@@ -28,7 +32,7 @@ func makeCreateUserEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(*userCreateRequest)
 
-		id, err := s.CreateUser(req.ID, req.FirstName, req.LastName, req.FavoriteColor)
+		id, err := s.CreateUser(ctx, req.ID, req.FirstName, req.LastName, req.FavoriteColor)
 
 		return userCreateResponse{ID: id, Error: err}, nil
 	}
@@ -37,12 +41,21 @@ func makeCreateUserEndpoint(s Service) endpoint.Endpoint {
 // userReadRequest represents an HTTP request to read a single user from the client
 type userReadRequest struct {
 	ID int `json:"id"`
+
+	// IfNoneMatch holds the entity tags of representations the client already has
+	IfNoneMatch string `json:"-"`
+
+	// IncludeDeleted finds soft deleted users too, it is only set by the admin transport
+	IncludeDeleted bool `json:"-"`
 }
 
 // userReadResponse represents an HTTP response containing a user or the error when fetching
 type userReadResponse struct {
 	User  User  `json:"user,omitempty"`
 	Error error `json:"error,omitempty"`
+
+	// notModified is set when the client already has the current version of the user
+	notModified bool
 }
 
 // error is the userReadResponse errorer implementation
@@ -51,8 +64,11 @@ func (r userReadResponse) error() error { return r.Error }
 func makeReadUserEindpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(userReadRequest)
-		u, err := s.ReadUser(req.ID)
-		return userReadResponse{User: u, Error: err}, nil
+		u, err := s.ReadUser(ctx, req.ID, req.IncludeDeleted)
+		if err != nil {
+			return userReadResponse{Error: err}, nil
+		}
+		return userReadResponse{User: u, notModified: etagMatches(req.IfNoneMatch, u.Version)}, nil
 	}
 }
 
@@ -60,10 +76,14 @@ func makeReadUserEindpoint(s Service) endpoint.Endpoint {
 type userUpdateColorRequest struct {
 	ID            int    `json:"id"`
 	FavoriteColor string `json:"favorite_color"`
+
+	// Version is the user version named by If-Match, 0 for an unconditional update
+	Version int `json:"-"`
 }
 
 // userUpdateColorResponse represents an HTTP response from the server notifying the client of the update status
 type userUpdateColorResponse struct {
+	User  User  `json:"user,omitempty"`
 	Error error `json:"error,omitempty"`
 }
 
@@ -72,14 +92,42 @@ func (r userUpdateColorResponse) error() error { return r.Error }
 
 func makeUpdateUserColorEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
-		req := request.(userUpdateColorRequest)
-		err := s.UpdateUserColor(req.ID, req.FavoriteColor)
-		return userUpdateColorResponse{Error: err}, nil
+		req := request.(*userUpdateColorRequest)
+		u, err := s.UpdateUserColor(ctx, req.ID, req.FavoriteColor, req.Version)
+		return userUpdateColorResponse{User: u, Error: err}, nil
+	}
+}
+
+// userDeleteRequest represents an HTTP request from the client to delete a user
+type userDeleteRequest struct {
+	ID int `json:"id"`
+
+	// Version is the user version named by If-Match, 0 for an unconditional delete
+	Version int `json:"-"`
+}
+
+// userDeleteResponse represents an HTTP response from the server notifying the client of the delete status
+type userDeleteResponse struct {
+	Error error `json:"error,omitempty"`
+}
+
+// error is an errorer implementation for userDeleteResponse
+func (r userDeleteResponse) error() error { return r.Error }
+
+// makeDeleteUserEndpoint creates an HTTP endpoint for deleting a user
+func makeDeleteUserEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(userDeleteRequest)
+		err := s.DeleteUser(ctx, req.ID, req.Version)
+		return userDeleteResponse{Error: err}, nil
 	}
 }
 
 // userReadAllRequest represents an HTTP request from the client to get all users
-type userReadAllRequest struct{}
+type userReadAllRequest struct {
+	// IncludeDeleted lists soft deleted users too, it is only set by the admin transport
+	IncludeDeleted bool `json:"-"`
+}
 
 // userReadAllResponse represents an HTTP response from the server listing all users
 type userReadAllResponse struct {
@@ -93,7 +141,243 @@ func (r userReadAllResponse) error() error { return r.Error }
 // makeReadAllUsersEndpoint creates an HTTP endpoint for retrieving all users
 func makeReadAllUsersEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
-		users := s.Users()
+		req := request.(userReadAllRequest)
+		users := s.Users(ctx, req.IncludeDeleted)
 		return userReadAllResponse{Users: users, Error: nil}, nil
 	}
 }
+
+// userRestoreRequest represents an HTTP request from an admin to restore a soft deleted user
+type userRestoreRequest struct {
+	ID int `json:"id"`
+
+	// Version is the user version named by If-Match, 0 for an unconditional restore
+	Version int `json:"-"`
+}
+
+// userRestoreResponse represents an HTTP response containing the restored user
+type userRestoreResponse struct {
+	User  User  `json:"user,omitempty"`
+	Error error `json:"error,omitempty"`
+}
+
+// error is an errorer implementation for userRestoreResponse
+func (r userRestoreResponse) error() error { return r.Error }
+
+// makeRestoreUserEndpoint creates an HTTP endpoint restoring a soft deleted user
+func makeRestoreUserEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(userRestoreRequest)
+		u, err := s.RestoreUser(ctx, req.ID, req.Version)
+		return userRestoreResponse{User: u, Error: err}, nil
+	}
+}
+
+// userHistoryRequest represents an HTTP request for a page of a user's audit history
+type userHistoryRequest struct {
+	ID    int
+	After int
+	Limit int
+}
+
+// userHistoryResponse represents an HTTP response containing a page of a user's audit history. NextAfter is the
+// after parameter of the next page, it is omitted on the last page.
+type userHistoryResponse struct {
+	History   []*AuditEntry `json:"history"`
+	NextAfter int           `json:"next_after,omitempty"`
+	Error     error         `json:"error,omitempty"`
+}
+
+// error is an errorer implementation for userHistoryResponse
+func (r userHistoryResponse) error() error { return r.Error }
+
+// makeUserHistoryEndpoint creates an HTTP endpoint paging through a user's audit history
+func makeUserHistoryEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(userHistoryRequest)
+		history, err := s.UserHistory(ctx, req.ID, req.After, req.Limit)
+		if err != nil {
+			return userHistoryResponse{Error: err}, nil
+		}
+
+		res := userHistoryResponse{History: history}
+		if len(history) == req.Limit {
+			res.NextAfter = history[len(history)-1].ID
+		}
+		return res, nil
+	}
+}
+
+// userImportRequest represents a bulk import, rows are read from the request body as the import proceeds
+type userImportRequest struct {
+	rows   userRowReader
+	atomic bool
+}
+
+// userImportRowResult is the outcome of importing a single row
+type userImportRowResult struct {
+	Row    int            `json:"row"`
+	ID     int            `json:"id,omitempty"`
+	Status string         `json:"status"`
+	Error  *importProblem `json:"error,omitempty"`
+}
+
+// importProblem describes why a row was not imported
+type importProblem struct {
+	Code   errs.Code         `json:"code"`
+	Detail string            `json:"detail,omitempty"`
+	Errors []errs.FieldError `json:"errors,omitempty"`
+}
+
+// userImportResponse represents an HTTP response listing the result of every imported row
+type userImportResponse struct {
+	Created   int                   `json:"created"`
+	Failed    int                   `json:"failed"`
+	Aborted   bool                  `json:"aborted"`
+	Truncated bool                  `json:"truncated,omitempty"`
+	Results   []userImportRowResult `json:"results"`
+	Error     error                 `json:"error,omitempty"`
+}
+
+// error is an errorer implementation for userImportResponse
+func (r userImportResponse) error() error { return r.Error }
+
+// makeImportUsersEndpoint creates an HTTP endpoint importing users in bulk. Best-effort imports are passed to the
+// service in chunks as they are read and stop after maxImportRows rows. Atomic imports are read completely and
+// passed on as a single batch, they fail without creating anything if they have too many rows.
+func makeImportUsersEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(userImportRequest)
+		res := userImportResponse{Results: []userImportRowResult{}}
+
+		if req.atomic {
+			rows, err := readRows(req.rows, maxImportRows)
+			if err != nil {
+				return userImportResponse{Error: err}, nil
+			}
+			if more, err := hasMoreRows(req.rows); err != nil || more {
+				return userImportResponse{Error: errs.ErrInvalidArgument.WithDetail(
+					fmt.Sprintf("atomic imports are limited to %d rows", maxImportRows),
+				)}, nil
+			}
+			res.Results = importRows(ctx, s, rows, true, 0)
+		}
+
+		for !req.atomic {
+			n := maxImportRows - len(res.Results)
+			if n > importChunkSize {
+				n = importChunkSize
+			}
+			if n == 0 {
+				res.Truncated, _ = hasMoreRows(req.rows)
+				break
+			}
+
+			rows, err := readRows(req.rows, n)
+			if err != nil {
+				return userImportResponse{Error: err}, nil
+			}
+			if len(rows) == 0 {
+				break
+			}
+			res.Results = append(res.Results, importRows(ctx, s, rows, false, len(res.Results))...)
+		}
+
+		for _, r := range res.Results {
+			switch r.Status {
+			case "created":
+				res.Created++
+			case "aborted":
+				res.Aborted = true
+			default:
+				res.Failed++
+			}
+		}
+		return res, nil
+	}
+}
+
+// readRows reads up to n rows
+func readRows(r userRowReader, n int) ([]userRow, error) {
+	var rows []userRow
+	for len(rows) < n {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// hasMoreRows reports whether another row can be read, consuming it
+func hasMoreRows(r userRowReader) (bool, error) {
+	_, err := r.Read()
+	if err == io.EOF {
+		return false, nil
+	}
+	return true, err
+}
+
+// importRows imports the decodable rows and reports a result for every row, numbered from offset+1
+func importRows(ctx context.Context, s Service, rows []userRow, atomic bool, offset int) []userImportRowResult {
+	results := make([]ImportResult, len(rows))
+	users := make([]User, 0, len(rows))
+	decoded := make([]int, 0, len(rows))
+	for i, row := range rows {
+		if row.Error != nil {
+			results[i].Error = row.Error
+			continue
+		}
+		users = append(users, row.User)
+		decoded = append(decoded, i)
+	}
+
+	if atomic && len(users) < len(rows) {
+		results = abortImport(results)
+	} else {
+		for i, r := range s.ImportUsers(ctx, users, atomic) {
+			results[decoded[i]] = r
+		}
+	}
+
+	rowResults := make([]userImportRowResult, len(results))
+	for i, r := range results {
+		rowResults[i] = userImportRowResult{Row: offset + i + 1, ID: r.ID, Status: "created"}
+		if r.Error == nil {
+			continue
+		}
+
+		// Row errors are described like response errors so internal ones do not expose their cause
+		p := errs.NewProblem(ctx, r.Error)
+		rowResults[i].Status = "failed"
+		if p.Code == errs.CodeImportAborted {
+			rowResults[i].Status = "aborted"
+		}
+		rowResults[i].Error = &importProblem{Code: p.Code, Detail: p.Detail, Errors: p.Errors}
+	}
+	return rowResults
+}
+
+// userExportRequest represents an HTTP request streaming every user in the requested format
+type userExportRequest struct {
+	format string
+}
+
+// userExportResponse streams users to the encoder so they never have to be held in memory at once
+type userExportResponse struct {
+	format string
+	export func(fn func(User) error) error
+}
+
+// makeExportUsersEndpoint creates an HTTP endpoint exporting every user
+func makeExportUsersEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(userExportRequest)
+		export := func(fn func(User) error) error { return s.ExportUsers(ctx, fn) }
+		return userExportResponse{format: req.format, export: export}, nil
+	}
+}
@@ -1,6 +1,7 @@
 package users
 
 import (
+	"context"
 	"time"
 
 	"github.com/go-kit/kit/metrics"
@@ -22,10 +23,10 @@ func NewInstrumentingService(counter metrics.Counter, latency metrics.Histogram,
 	}
 }
 
-func (s *instrumentingService) CreateUser(id int, fname string, lname string, color string) (int, error) {
+func (s *instrumentingService) CreateUser(ctx context.Context, id int, fname string, lname string, color string) (int, error) {
 	defer func(begin time.Time) {
 		s.requestCount.With("method", "CreateUser").Add(1)
 		s.requestLatency.With("method", "CreateUser").Observe(time.Since(begin).Seconds())
 	}(time.Now())
-	return s.Service.CreateUser(id, fname, lname, color)
+	return s.Service.CreateUser(ctx, id, fname, lname, color)
 }
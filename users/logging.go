@@ -1,6 +1,7 @@
 package users
 
 import (
+	"context"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -18,7 +19,7 @@ func NewLoggingService(logger log.Logger, s Service) Service {
 }
 
 // CreateUser wraps the user service method with logging metadata we want to capture and defers the call
-func (s *loggingService) CreateUser(id int, fname string, lname string, color string) (retID int, err error) {
+func (s *loggingService) CreateUser(ctx context.Context, id int, fname string, lname string, color string) (retID int, err error) {
 	defer func(begin time.Time) {
 		s.logger.Log(
 			"context_method", "CreateUser",
@@ -30,5 +31,5 @@ func (s *loggingService) CreateUser(id int, fname string, lname string, color st
 			"message", err,
 		)
 	}(time.Now())
-	return s.Service.CreateUser(id, fname, lname, color)
+	return s.Service.CreateUser(ctx, id, fname, lname, color)
 }
@@ -0,0 +1,26 @@
+package users
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// RunPurge permanently removes users that were soft deleted more than retention ago, checking every interval
+// until ctx is done
+func RunPurge(ctx context.Context, repo Repository, retention time.Duration, interval time.Duration, logger log.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if n := repo.Purge(ctx, now.Add(-retention)); n > 0 {
+				logger.Log("context_method", "Purge", "context_purged", n, "message", "purged deleted users")
+			}
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package users
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/bnelz/gokit-base/events"
+)
+
+// RetryOptions configures how repository calls failing with transient errors are retried
+type RetryOptions struct {
+	// Attempts is the number of times a call is made before its last error is returned
+	Attempts int
+
+	// BaseBackoff is the wait before the first retry, it doubles on every further retry up to MaxBackoff
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+}
+
+// Transient reports whether err is a repository failure that may not happen again: a lost or refused connection,
+// or a transaction the database rolled back because it conflicted with another. Application errors such as
+// ErrUserNotFound, errors caused by a done context and errors the database will raise again for the same
+// statement, e.g. a violated constraint or a value out of range, are permanent.
+func Transient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return true
+	}
+	var se sqlStater
+	if errors.As(err, &se) {
+		state := se.SQLState()
+		return strings.HasPrefix(state, "08") || state == "40001" || state == "40P01"
+	}
+	return false
+}
+
+// sqlStater is implemented by database errors carrying an SQLSTATE code, e.g. *pq.Error
+type sqlStater interface {
+	SQLState() string
+}
+
+// retryingRepository retries the calls of a repository failing with transient errors
+type retryingRepository struct {
+	opts RetryOptions
+	Repository
+}
+
+// NewRetryingRepository returns a repository retrying the calls of r that fail with transient errors. Methods
+// that cannot report errors are passed through. A write whose outcome was lost may be applied by the first
+// attempt, so its retry can fail with ErrUserExists or ErrVersionConflict.
+func NewRetryingRepository(opts RetryOptions, r Repository) Repository {
+	return &retryingRepository{opts, r}
+}
+
+func (r *retryingRepository) Insert(ctx context.Context, user *User) error {
+	return retry(ctx, r.opts, func() error { return r.Repository.Insert(ctx, user) })
+}
+
+func (r *retryingRepository) Store(ctx context.Context, user *User) error {
+	return retry(ctx, r.opts, func() error { return r.Repository.Store(ctx, user) })
+}
+
+func (r *retryingRepository) Delete(ctx context.Context, id int, version int) error {
+	return retry(ctx, r.opts, func() error { return r.Repository.Delete(ctx, id, version) })
+}
+
+func (r *retryingRepository) Restore(ctx context.Context, id int, version int) (u *User, err error) {
+	err = retry(ctx, r.opts, func() error {
+		u, err = r.Repository.Restore(ctx, id, version)
+		return err
+	})
+	return u, err
+}
+
+func (r *retryingRepository) Find(ctx context.Context, id int, includeDeleted bool) (u *User, err error) {
+	err = retry(ctx, r.opts, func() error {
+		u, err = r.Repository.Find(ctx, id, includeDeleted)
+		return err
+	})
+	return u, err
+}
+
+// retryingTransactor retries transactions failing with transient errors
+type retryingTransactor struct {
+	opts RetryOptions
+	Transactor
+}
+
+// NewRetryingTransactor returns a transactor running fn again in a new transaction when a transaction of tx
+// fails with a transient error. Failed transactions are rolled back, so fn must only have effects through the
+// repository and events it is given.
+func NewRetryingTransactor(opts RetryOptions, tx Transactor) Transactor {
+	return &retryingTransactor{opts, tx}
+}
+
+func (t *retryingTransactor) Transact(ctx context.Context, fn func(repo Repository, record func(e events.Envelope), audit func(entry *AuditEntry)) error) error {
+	return retry(ctx, t.opts, func() error { return t.Transactor.Transact(ctx, fn) })
+}
+
+// retry calls fn until it succeeds, fails with a permanent error, runs out of attempts or ctx is done
+func retry(ctx context.Context, opts RetryOptions, fn func() error) error {
+	err := fn()
+	for attempt := 1; attempt < opts.Attempts && Transient(err); attempt++ {
+		t := time.NewTimer(opts.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+		err = fn()
+	}
+	return err
+}
+
+// backoff returns the wait before retrying after attempt: the exponential backoff with half of it jittered
+func (opts RetryOptions) backoff(attempt int) time.Duration {
+	b := opts.BaseBackoff
+	for i := 1; i < attempt && (opts.MaxBackoff <= 0 || b < opts.MaxBackoff); i++ {
+		b *= 2
+	}
+	if opts.MaxBackoff > 0 && b > opts.MaxBackoff {
+		b = opts.MaxBackoff
+	}
+	if b <= 0 {
+		return 0
+	}
+	half := b / 2
+	return half + time.Duration(rand.Int63n(int64(b-half)+1))
+}
@@ -0,0 +1,77 @@
+package users
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	errs "github.com/bnelz/gokit-base/errors"
+	"github.com/golang/mock/gomock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+var retries = RetryOptions{Attempts: 3, BaseBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+
+// errConnLost is a lost connection as reported by the SQL store
+var errConnLost = errs.ErrInternal.Wrap(driver.ErrBadConn)
+
+func TestTransient(t *testing.T) {
+	assert.True(t, Transient(errConnLost))
+	assert.True(t, Transient(&net.OpError{Op: "dial", Err: errors.New("connection refused")}))
+	assert.True(t, Transient(errs.ErrInternal.Wrap(&pq.Error{Code: "08006"})))
+	assert.True(t, Transient(errs.ErrInternal.Wrap(&pq.Error{Code: "40001"})))
+
+	assert.False(t, Transient(nil))
+	assert.False(t, Transient(errs.ErrUserNotFound))
+	assert.False(t, Transient(errs.ErrVersionConflict))
+	assert.False(t, Transient(errs.ErrUnavailable))
+	assert.False(t, Transient(context.Canceled))
+	assert.False(t, Transient(errs.ErrInternal.Wrap(context.DeadlineExceeded)))
+	assert.False(t, Transient(errs.ErrInternal.Wrap(&pq.Error{Code: "22003"})))
+	assert.False(t, Transient(errs.ErrInternal.Wrap(&pq.Error{Code: "23505"})))
+	assert.False(t, Transient(errors.New("unknown")))
+}
+
+func TestRetryingRepository_RetriesTransientErrors(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockRepo := NewMockRepository(ctrl)
+	want := New(1, "Ada", "Lovelace")
+	gomock.InOrder(
+		mockRepo.EXPECT().Find(gomock.Any(), 1, false).Return(nil, errConnLost).Times(2),
+		mockRepo.EXPECT().Find(gomock.Any(), 1, false).Return(want, nil),
+	)
+
+	u, err := NewRetryingRepository(retries, mockRepo).Find(context.Background(), 1, false)
+	assert.NoError(t, err)
+	assert.Equal(t, want, u)
+}
+
+func TestRetryingRepository_GivesUp(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockRepo := NewMockRepository(ctrl)
+	repo := NewRetryingRepository(retries, mockRepo)
+
+	// Transient errors are retried until the attempts run out
+	mockRepo.EXPECT().Delete(gomock.Any(), 1, 0).Return(errConnLost).Times(3)
+	assert.True(t, errors.Is(repo.Delete(context.Background(), 1, 0), driver.ErrBadConn))
+
+	// Permanent errors are returned right away
+	mockRepo.EXPECT().Insert(gomock.Any(), gomock.Any()).Return(errs.ErrUserExists)
+	assert.True(t, errors.Is(repo.Insert(context.Background(), New(1, "Ada", "Lovelace")), errs.ErrUserExists))
+
+	// A done context stops the retries
+	ctx, cancel := context.WithCancel(context.Background())
+	mockRepo.EXPECT().Store(gomock.Any(), gomock.Any()).DoAndReturn(func(context.Context, *User) error {
+		cancel()
+		return errConnLost
+	})
+	assert.Error(t, repo.Store(ctx, New(1, "Ada", "Lovelace")))
+}
@@ -1,24 +1,59 @@
 package users
 
 import (
+	"context"
+	"time"
+
 	errs "github.com/bnelz/gokit-base/errors"
+	"github.com/bnelz/gokit-base/events"
 )
 
 // Service describes the behavior of a user service e.g. CRUD actions
 type Service interface {
-	// CreateUser defines a new user and returns its id
-	CreateUser(id int, fname string, lname string, color string) (int, error)
+	// CreateUser defines a new user and returns its id, an id of 0 asks the service to allocate one
+	CreateUser(ctx context.Context, id int, fname string, lname string, color string) (int, error)
+
+	// ReadUser finds a user model by id, soft deleted users are only found if includeDeleted is set
+	ReadUser(ctx context.Context, id int, includeDeleted bool) (User, error)
+
+	// UpdateUserColor sets a user's favorite color. A non-zero version must match the user's current version.
+	UpdateUserColor(ctx context.Context, id int, color string, version int) (User, error)
+
+	// DeleteUser soft deletes a user. A non-zero version must match the user's current version.
+	DeleteUser(ctx context.Context, id int, version int) error
+
+	// RestoreUser undoes the soft delete of a user. A non-zero version must match the user's current version.
+	RestoreUser(ctx context.Context, id int, version int) (User, error)
+
+	// Users returns all users, soft deleted users are only included if includeDeleted is set
+	Users(ctx context.Context, includeDeleted bool) []*User
+
+	// ImportUsers creates many users at once and returns the result of every row. An atomic import creates
+	// nothing unless every user can be created.
+	ImportUsers(ctx context.Context, users []User, atomic bool) []ImportResult
+
+	// ExportUsers calls fn with every user in ID order, stopping at the first error fn returns
+	ExportUsers(ctx context.Context, fn func(User) error) error
 
-	// ReadUser finds a user model by id
-	ReadUser(id int) (User, error)
+	// UserHistory returns up to limit audit entries of a user with an ID greater than after, oldest first
+	UserHistory(ctx context.Context, id int, after int, limit int) ([]*AuditEntry, error)
+}
 
-	// UpdateUserColor sets a user's favorite color
-	UpdateUserColor(id int, color string) error
+// ImportResult is the outcome of importing a single user
+type ImportResult struct {
+	// ID of the created user, 0 if it was not created
+	ID int
 
-	// Users returns all users
-	Users() []*User
+	// Error describes why the user was not created
+	Error error
 }
 
+// errAtomicImportFailed rolls back the transaction of an atomic import that did not insert every user
+var errAtomicImportFailed = errs.ErrImportAborted.WithDetail("atomic import failed")
+
+// exportPageSize is the number of users read from the repository at a time while exporting
+const exportPageSize = 500
+
 // userService is an implementation of the user service interface
 type userService struct {
 	// Dependencies go here!
@@ -30,21 +65,41 @@ type userService struct {
 
 	// userRepo is our user store
 	userRepo Repository
+
+	// ids allocates IDs for users created without one
+	ids IDGenerator
+
+	// audit records every change made to a user
+	audit AuditStore
+
+	// tx commits writes along with the events announcing them, writes are made without events if it is nil
+	tx Transactor
 }
 
-// NewService returns a new userService
-func NewService(repo Repository) Service {
+// NewService returns a new userService. Writes are made through tx when it is not nil so the events announcing
+// them and their audit entries are committed atomically, audit must then be the audit store of tx.
+func NewService(repo Repository, ids IDGenerator, audit AuditStore, tx Transactor) Service {
 	return &userService{
 		userRepo: repo,
+		ids:      ids,
+		audit:    audit,
+		tx:       tx,
 	}
 }
 
 // CreateUser validates and sends a message to our user storage with a user to create
-func (us *userService) CreateUser(id int, fname string, lname string, color string) (int, error) {
-	if id <= 0 {
+func (us *userService) CreateUser(ctx context.Context, id int, fname string, lname string, color string) (int, error) {
+	if id < 0 {
 		return id, errs.ErrInvalidArgument
 	}
 
+	if id == 0 {
+		var err error
+		if id, err = us.ids.NextID(ctx); err != nil {
+			return 0, err
+		}
+	}
+
 	u := User{
 		ID:            id,
 		FirstName:     fname,
@@ -52,43 +107,269 @@ func (us *userService) CreateUser(id int, fname string, lname string, color stri
 		FavoriteColor: color,
 	}
 
-	err := us.userRepo.Store(&u)
+	err := us.write(ctx, func(repo Repository, publish func(events.Event), audit auditFunc) error {
+		if err := repo.Insert(ctx, &u); err != nil {
+			return err
+		}
+		publish(events.UserCreated{UserID: u.ID, FirstName: u.FirstName, LastName: u.LastName, FavoriteColor: u.FavoriteColor})
+		audit(OperationCreate, nil, &u)
+		return nil
+	})
 	if err != nil {
 		return id, err
 	}
-
 	return u.ID, nil
 }
 
 // ReadUser returns a read-only user model from the underlying user repository
-func (us *userService) ReadUser(id int) (User, error) {
+func (us *userService) ReadUser(ctx context.Context, id int, includeDeleted bool) (User, error) {
 	if id <= 0 {
 		return User{}, errs.ErrInvalidArgument
 	}
 
-	u, err := us.userRepo.Find(id)
-	return *u, err
+	u, err := us.userRepo.Find(ctx, id, includeDeleted)
+	if err != nil {
+		return User{}, err
+	}
+	return *u, nil
 }
 
 // Update a user's favorite color in the storage repository
-func (us *userService) UpdateUserColor(id int, color string) error {
-	if id <= 0 {
-		return errs.ErrInvalidArgument
+func (us *userService) UpdateUserColor(ctx context.Context, id int, color string, version int) (User, error) {
+	if id <= 0 || version < 0 {
+		return User{}, errs.ErrInvalidArgument
 	}
 
-	u, err := us.userRepo.Find(id)
+	var after User
+	err := us.write(ctx, func(repo Repository, publish func(events.Event), audit auditFunc) error {
+		u, err := repo.Find(ctx, id, false)
+		if err != nil {
+			return err
+		}
+		if version != 0 && u.Version != version {
+			return errs.ErrVersionConflict
+		}
+
+		// u keeps the version just read so the store is a compare and swap, even when the client sent no version
+		before := *u
+		u.FavoriteColor = color
+		if err := repo.Store(ctx, u); err != nil {
+			return err
+		}
+		after = *u
+		publish(events.UserUpdated{UserID: u.ID, FavoriteColor: u.FavoriteColor, Version: u.Version})
+		audit(OperationUpdate, &before, &after)
+		return nil
+	})
 	if err != nil {
-		return err
+		return User{}, err
+	}
+	return after, nil
+}
+
+// DeleteUser soft deletes a user in the storage repository
+func (us *userService) DeleteUser(ctx context.Context, id int, version int) error {
+	if id <= 0 || version < 0 {
+		return errs.ErrInvalidArgument
 	}
 
-	u.FavoriteColor = color
+	return us.write(ctx, func(repo Repository, publish func(events.Event), audit auditFunc) error {
+		before, err := repo.Find(ctx, id, false)
+		if err != nil {
+			return err
+		}
+		if err := repo.Delete(ctx, id, version); err != nil {
+			return err
+		}
+		after, err := repo.Find(ctx, id, true)
+		if err != nil {
+			return err
+		}
+		publish(events.UserDeleted{UserID: id})
+		audit(OperationDelete, before, after)
+		return nil
+	})
+}
+
+// RestoreUser brings a soft deleted user back
+func (us *userService) RestoreUser(ctx context.Context, id int, version int) (User, error) {
+	if id <= 0 || version < 0 {
+		return User{}, errs.ErrInvalidArgument
+	}
 
-	return us.userRepo.Store(u)
+	var after *User
+	err := us.write(ctx, func(repo Repository, publish func(events.Event), audit auditFunc) error {
+		before, err := repo.Find(ctx, id, true)
+		if err != nil {
+			return err
+		}
+		if after, err = repo.Restore(ctx, id, version); err != nil {
+			return err
+		}
+		publish(events.UserRestored{UserID: id, Version: after.Version})
+		audit(OperationRestore, before, after)
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return *after, nil
 }
 
 // Users returns all registered users for the application from the repository
-func (us *userService) Users() []*User {
-	allUsers := us.userRepo.FindAll()
+func (us *userService) Users(ctx context.Context, includeDeleted bool) []*User {
+	allUsers := us.userRepo.FindAll(ctx, includeDeleted)
 	// Copy the struct
 	return allUsers
 }
+
+// ImportUsers allocates missing IDs and inserts users into the repository as one batch
+func (us *userService) ImportUsers(ctx context.Context, users []User, atomic bool) []ImportResult {
+	results := make([]ImportResult, len(users))
+	batch := make([]*User, 0, len(users))
+	rows := make([]int, 0, len(users))
+
+	for i := range users {
+		u := users[i]
+		if u.ID < 0 {
+			results[i].Error = errs.ErrInvalidArgument.WithDetail("id must not be negative")
+			continue
+		}
+		if u.ID == 0 {
+			id, err := us.ids.NextID(ctx)
+			if err != nil {
+				results[i].Error = err
+				continue
+			}
+			u.ID = id
+		}
+		batch = append(batch, &u)
+		rows = append(rows, i)
+	}
+
+	if atomic && len(batch) < len(users) {
+		return abortImport(results)
+	}
+
+	var inserted []error
+	err := us.write(ctx, func(repo Repository, publish func(events.Event), audit auditFunc) error {
+		inserted = repo.InsertBatch(ctx, batch, atomic)
+		for i, err := range inserted {
+			if err != nil {
+				if atomic {
+					return errAtomicImportFailed
+				}
+				continue
+			}
+			u := batch[i]
+			publish(events.UserCreated{UserID: u.ID, FirstName: u.FirstName, LastName: u.LastName, FavoriteColor: u.FavoriteColor})
+			audit(OperationCreate, nil, u)
+		}
+		return nil
+	})
+	if err != nil && err != errAtomicImportFailed {
+		if inserted == nil {
+			inserted = make([]error, len(batch))
+		}
+		for i := range inserted {
+			if inserted[i] == nil {
+				inserted[i] = err
+			}
+		}
+	}
+
+	for i, err := range inserted {
+		if err != nil {
+			results[rows[i]].Error = err
+			continue
+		}
+		results[rows[i]].ID = batch[i].ID
+	}
+	if atomic && err != nil {
+		return abortImport(results)
+	}
+	return results
+}
+
+// ExportUsers pages through the repository in ID order
+func (us *userService) ExportUsers(ctx context.Context, fn func(User) error) error {
+	after := 0
+	for {
+		page := us.userRepo.FindAfter(ctx, after, exportPageSize)
+		for _, u := range page {
+			if err := fn(*u); err != nil {
+				return err
+			}
+			after = u.ID
+		}
+		if len(page) < exportPageSize {
+			return nil
+		}
+	}
+}
+
+// UserHistory pages through the audit entries of a user
+func (us *userService) UserHistory(ctx context.Context, id int, after int, limit int) ([]*AuditEntry, error) {
+	if id <= 0 || after < 0 || limit <= 0 {
+		return nil, errs.ErrInvalidArgument
+	}
+
+	history, err := us.audit.History(ctx, id, after, limit)
+	if err != nil {
+		return nil, errs.ErrInternal.Wrap(err)
+	}
+	return history, nil
+}
+
+// auditFunc records a change to a user in the audit history
+type auditFunc func(op Operation, before *User, after *User)
+
+// write calls fn with the repository writes are made through, the events fn publishes and the changes it audits
+// are made on behalf of the actor in ctx. With a transactor the writes, events and audit entries commit together.
+// Without one the events are discarded and the audit entries are appended once fn succeeded.
+func (us *userService) write(ctx context.Context, fn func(repo Repository, publish func(events.Event), audit auditFunc) error) error {
+	actor := ActorFromContext(ctx)
+	entry := func(op Operation, before *User, after *User) *AuditEntry {
+		return &AuditEntry{
+			UserID:    after.ID,
+			Actor:     actor,
+			Timestamp: time.Now().UTC(),
+			Operation: op,
+			Version:   after.Version,
+			Changes:   diffUsers(before, after),
+		}
+	}
+
+	if us.tx == nil {
+		var entries []*AuditEntry
+		err := fn(us.userRepo, func(events.Event) {}, func(op Operation, before *User, after *User) {
+			entries = append(entries, entry(op, before, after))
+		})
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := us.audit.Append(ctx, e); err != nil {
+				return errs.ErrInternal.Wrap(err)
+			}
+		}
+		return nil
+	}
+
+	return us.tx.Transact(ctx, func(repo Repository, record func(events.Envelope), audit func(*AuditEntry)) error {
+		return fn(repo, func(e events.Event) { record(events.NewEnvelope(e, actor)) }, func(op Operation, before *User, after *User) {
+			audit(entry(op, before, after))
+		})
+	})
+}
+
+// abortImport marks every row of an atomic import that did not fail itself as aborted
+func abortImport(results []ImportResult) []ImportResult {
+	for i := range results {
+		results[i].ID = 0
+		if results[i].Error == nil {
+			results[i].Error = errs.ErrImportAborted
+		}
+	}
+	return results
+}
@@ -1,9 +1,11 @@
-// Automatically generated by MockGen. DO NOT EDIT!
-// Source: users/service.go
+// Mocks of the interfaces in users/service.go, maintained by hand in the layout of MockGen output. Update them along
+// with the interfaces.
 
 package users
 
 import (
+	context "context"
+
 	gomock "github.com/golang/mock/gomock"
 )
 
@@ -28,44 +30,97 @@ func (_m *MockService) EXPECT() *_MockServiceRecorder {
 	return _m.recorder
 }
 
-func (_m *MockService) CreateUser(id int, fname string, lname string, color string) (int, error) {
-	ret := _m.ctrl.Call(_m, "CreateUser", id, fname, lname, color)
+func (_m *MockService) CreateUser(ctx context.Context, id int, fname string, lname string, color string) (int, error) {
+	ret := _m.ctrl.Call(_m, "CreateUser", ctx, id, fname, lname, color)
 	ret0, _ := ret[0].(int)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-func (_mr *_MockServiceRecorder) CreateUser(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "CreateUser", arg0, arg1, arg2, arg3)
+func (_mr *_MockServiceRecorder) CreateUser(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CreateUser", arg0, arg1, arg2, arg3, arg4)
+}
+
+func (_m *MockService) ReadUser(ctx context.Context, id int, includeDeleted bool) (User, error) {
+	ret := _m.ctrl.Call(_m, "ReadUser", ctx, id, includeDeleted)
+	ret0, _ := ret[0].(User)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockServiceRecorder) ReadUser(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ReadUser", arg0, arg1, arg2)
 }
 
-func (_m *MockService) ReadUser(id int) (User, error) {
-	ret := _m.ctrl.Call(_m, "ReadUser", id)
+func (_m *MockService) UpdateUserColor(ctx context.Context, id int, color string, version int) (User, error) {
+	ret := _m.ctrl.Call(_m, "UpdateUserColor", ctx, id, color, version)
 	ret0, _ := ret[0].(User)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-func (_mr *_MockServiceRecorder) ReadUser(arg0 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "ReadUser", arg0)
+func (_mr *_MockServiceRecorder) UpdateUserColor(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "UpdateUserColor", arg0, arg1, arg2, arg3)
 }
 
-func (_m *MockService) UpdateUserColor(id int, color string) error {
-	ret := _m.ctrl.Call(_m, "UpdateUserColor", id, color)
+func (_m *MockService) DeleteUser(ctx context.Context, id int, version int) error {
+	ret := _m.ctrl.Call(_m, "DeleteUser", ctx, id, version)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-func (_mr *_MockServiceRecorder) UpdateUserColor(arg0, arg1 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "UpdateUserColor", arg0, arg1)
+func (_mr *_MockServiceRecorder) DeleteUser(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "DeleteUser", arg0, arg1, arg2)
 }
 
-func (_m *MockService) Users() []*User {
-	ret := _m.ctrl.Call(_m, "Users")
+func (_m *MockService) RestoreUser(ctx context.Context, id int, version int) (User, error) {
+	ret := _m.ctrl.Call(_m, "RestoreUser", ctx, id, version)
+	ret0, _ := ret[0].(User)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockServiceRecorder) RestoreUser(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RestoreUser", arg0, arg1, arg2)
+}
+
+func (_m *MockService) Users(ctx context.Context, includeDeleted bool) []*User {
+	ret := _m.ctrl.Call(_m, "Users", ctx, includeDeleted)
 	ret0, _ := ret[0].([]*User)
 	return ret0
 }
 
-func (_mr *_MockServiceRecorder) Users() *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "Users")
+func (_mr *_MockServiceRecorder) Users(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Users", arg0, arg1)
+}
+
+func (_m *MockService) ImportUsers(ctx context.Context, users []User, atomic bool) []ImportResult {
+	ret := _m.ctrl.Call(_m, "ImportUsers", ctx, users, atomic)
+	ret0, _ := ret[0].([]ImportResult)
+	return ret0
+}
+
+func (_mr *_MockServiceRecorder) ImportUsers(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ImportUsers", arg0, arg1, arg2)
+}
+
+func (_m *MockService) ExportUsers(ctx context.Context, fn func(User) error) error {
+	ret := _m.ctrl.Call(_m, "ExportUsers", ctx, fn)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockServiceRecorder) ExportUsers(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ExportUsers", arg0, arg1)
+}
+
+func (_m *MockService) UserHistory(ctx context.Context, id int, after int, limit int) ([]*AuditEntry, error) {
+	ret := _m.ctrl.Call(_m, "UserHistory", ctx, id, after, limit)
+	ret0, _ := ret[0].([]*AuditEntry)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockServiceRecorder) UserHistory(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "UserHistory", arg0, arg1, arg2, arg3)
 }
@@ -1,11 +1,13 @@
 package users
 
 import (
+	"context"
 	"testing"
 
 	"errors"
 
 	errs "github.com/bnelz/gokit-base/errors"
+	"github.com/bnelz/gokit-base/events"
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 )
@@ -15,14 +17,14 @@ func TestUserService_CreateUserInvalidArgs(t *testing.T) {
 	defer ctrl.Finish()
 
 	mockRepo := NewMockRepository(ctrl)
-	us := NewService(mockRepo)
+	us := NewService(mockRepo, NewMockIDGenerator(ctrl), NewMockAuditStore(ctrl), nil)
 	mockUser := User{
-		ID:            0,
+		ID:            -1,
 		FirstName:     "Bob",
 		LastName:      "YourUncle",
 		FavoriteColor: "Blue",
 	}
-	id, err := us.CreateUser(mockUser.ID, mockUser.FirstName, mockUser.LastName, mockUser.FavoriteColor)
+	id, err := us.CreateUser(context.Background(), mockUser.ID, mockUser.FirstName, mockUser.LastName, mockUser.FavoriteColor)
 	assert.Equal(t, mockUser.ID, id)
 	assert.EqualError(t, err, errs.ErrInvalidArgument.Error())
 }
@@ -32,19 +34,48 @@ func TestUserService_CreateUserFailureOnStore(t *testing.T) {
 	defer ctrl.Finish()
 
 	mockRepo := NewMockRepository(ctrl)
-	us := NewService(mockRepo)
+	us := NewService(mockRepo, NewMockIDGenerator(ctrl), NewMockAuditStore(ctrl), nil)
 	mockUser := User{
 		ID:            1,
 		FirstName:     "Bob",
 		LastName:      "YourUncle",
 		FavoriteColor: "Blue",
 	}
-	mockRepo.EXPECT().Store(&mockUser).Return(errors.New("I'm a repository error!"))
-	id, err := us.CreateUser(mockUser.ID, mockUser.FirstName, mockUser.LastName, mockUser.FavoriteColor)
+	mockRepo.EXPECT().Insert(gomock.Any(), &mockUser).Return(errors.New("I'm a repository error!"))
+	id, err := us.CreateUser(context.Background(), mockUser.ID, mockUser.FirstName, mockUser.LastName, mockUser.FavoriteColor)
 	assert.Error(t, err)
 	assert.Equal(t, mockUser.ID, id)
 }
 
+func TestUserService_CreateUserWritesThroughTransaction(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockRepo := NewMockRepository(ctrl)
+	mockTx := NewMockTransactor(ctrl)
+	us := NewService(NewMockRepository(ctrl), NewMockIDGenerator(ctrl), NewMockAuditStore(ctrl), mockTx)
+
+	var (
+		recorded []events.Envelope
+		audited  []*AuditEntry
+	)
+	mockTx.EXPECT().Transact(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, fn func(Repository, func(events.Envelope), func(*AuditEntry)) error) error {
+			return fn(mockRepo,
+				func(e events.Envelope) { recorded = append(recorded, e) },
+				func(entry *AuditEntry) { audited = append(audited, entry) })
+		})
+	mockRepo.EXPECT().Insert(gomock.Any(), gomock.Any()).Return(nil)
+
+	id, err := us.CreateUser(context.Background(), 1, "Bob", "YourUncle", "Blue")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, id)
+	assert.Len(t, recorded, 1)
+	if assert.Len(t, audited, 1) {
+		assert.Equal(t, OperationCreate, audited[0].Operation)
+	}
+}
+
 func TestUserService_CreateUserSuccessfulStore(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -56,9 +87,112 @@ func TestUserService_CreateUserSuccessfulStore(t *testing.T) {
 		LastName:      "YourUncle",
 		FavoriteColor: "Blue",
 	}
-	us := NewService(mockRepo)
-	mockRepo.EXPECT().Store(&mockUser).Return(nil)
-	id, err := us.CreateUser(mockUser.ID, mockUser.FirstName, mockUser.LastName, mockUser.FavoriteColor)
+	mockAudit := NewMockAuditStore(ctrl)
+	us := NewService(mockRepo, NewMockIDGenerator(ctrl), mockAudit, nil)
+	mockRepo.EXPECT().Insert(gomock.Any(), &mockUser).Return(nil)
+	mockAudit.EXPECT().Append(gomock.Any(), gomock.Any()).Return(nil)
+	id, err := us.CreateUser(context.Background(), mockUser.ID, mockUser.FirstName, mockUser.LastName, mockUser.FavoriteColor)
+	assert.NoError(t, err)
+	assert.Equal(t, mockUser.ID, id)
+}
+
+func TestUserService_CreateUserAllocatesID(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockRepo := NewMockRepository(ctrl)
+	mockIDs := NewMockIDGenerator(ctrl)
+	mockUser := User{
+		ID:            42,
+		FirstName:     "Bob",
+		LastName:      "YourUncle",
+		FavoriteColor: "Blue",
+	}
+	mockAudit := NewMockAuditStore(ctrl)
+	us := NewService(mockRepo, mockIDs, mockAudit, nil)
+	mockIDs.EXPECT().NextID(gomock.Any()).Return(42, nil)
+	mockRepo.EXPECT().Insert(gomock.Any(), &mockUser).Return(nil)
+	mockAudit.EXPECT().Append(gomock.Any(), gomock.Any()).Return(nil)
+	id, err := us.CreateUser(context.Background(), 0, mockUser.FirstName, mockUser.LastName, mockUser.FavoriteColor)
 	assert.NoError(t, err)
 	assert.Equal(t, mockUser.ID, id)
 }
+
+func TestUserService_CreateUserExists(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockRepo := NewMockRepository(ctrl)
+	us := NewService(mockRepo, NewMockIDGenerator(ctrl), NewMockAuditStore(ctrl), nil)
+	mockRepo.EXPECT().Insert(gomock.Any(), gomock.Any()).Return(errs.ErrUserExists)
+	_, err := us.CreateUser(context.Background(), 1, "Bob", "YourUncle", "Blue")
+	assert.EqualError(t, err, errs.ErrUserExists.Error())
+}
+
+func TestUserService_ImportUsersAtomic(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockRepo := NewMockRepository(ctrl)
+	mockIDs := NewMockIDGenerator(ctrl)
+	us := NewService(mockRepo, mockIDs, NewMockAuditStore(ctrl), nil)
+
+	mockIDs.EXPECT().NextID(gomock.Any()).Return(5, nil)
+	mockRepo.EXPECT().InsertBatch(gomock.Any(), []*User{
+		{ID: 5, FirstName: "Bob"},
+		{ID: 2, FirstName: "Alice"},
+	}, true).Return([]error{errs.ErrImportAborted, errs.ErrUserExists})
+
+	results := us.ImportUsers(context.Background(), []User{{FirstName: "Bob"}, {ID: 2, FirstName: "Alice"}}, true)
+	assert.Equal(t, []ImportResult{{Error: errs.ErrImportAborted}, {Error: errs.ErrUserExists}}, results)
+
+	results = us.ImportUsers(context.Background(), []User{{ID: -1, FirstName: "Eve"}, {ID: 3, FirstName: "Carol"}}, true)
+	assert.True(t, errors.Is(results[0].Error, errs.ErrInvalidArgument))
+	assert.Equal(t, errs.ErrImportAborted, results[1].Error)
+}
+
+func TestUserService_UpdateUserColorRecordsAudit(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockRepo := NewMockRepository(ctrl)
+	mockAudit := NewMockAuditStore(ctrl)
+	us := NewService(mockRepo, NewMockIDGenerator(ctrl), mockAudit, nil)
+
+	mockRepo.EXPECT().Find(gomock.Any(), 1, false).Return(&User{ID: 1, FirstName: "Bob", FavoriteColor: "blue", Version: 3}, nil)
+	mockRepo.EXPECT().Store(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, u *User) error {
+		u.Version = 4
+		return nil
+	})
+	mockAudit.EXPECT().Append(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, e *AuditEntry) error {
+		assert.Equal(t, 1, e.UserID)
+		assert.Equal(t, "alice", e.Actor)
+		assert.Equal(t, OperationUpdate, e.Operation)
+		assert.Equal(t, 4, e.Version)
+		assert.Equal(t, []FieldChange{{Field: "fav_color", Before: "blue", After: "red"}}, e.Changes)
+		return nil
+	})
+
+	u, err := us.UpdateUserColor(WithActor(context.Background(), "alice"), 1, "red", 3)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, u.Version)
+}
+
+func TestUserService_UpdateUserColorComparesReadVersion(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockRepo := NewMockRepository(ctrl)
+	mockAudit := NewMockAuditStore(ctrl)
+	us := NewService(mockRepo, NewMockIDGenerator(ctrl), mockAudit, nil)
+
+	// Without a version from the client the store still checks the version that was read
+	mockRepo.EXPECT().Find(gomock.Any(), 1, false).Return(&User{ID: 1, FavoriteColor: "blue", Version: 3}, nil)
+	mockRepo.EXPECT().Store(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, u *User) error {
+		assert.Equal(t, 3, u.Version)
+		return errs.ErrVersionConflict
+	})
+
+	_, err := us.UpdateUserColor(context.Background(), 1, "red", 0)
+	assert.True(t, errors.Is(err, errs.ErrVersionConflict))
+}
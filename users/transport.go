@@ -5,12 +5,18 @@ import (
 
 	"context"
 	"encoding/json"
+	"errors"
 
 	"io/ioutil"
 
 	"strconv"
+	"strings"
 
+	"github.com/bnelz/gokit-base/auth"
+	"github.com/bnelz/gokit-base/deadline"
 	errs "github.com/bnelz/gokit-base/errors"
+	"github.com/bnelz/gokit-base/ratelimit"
+	"github.com/go-kit/kit/endpoint"
 	kitlog "github.com/go-kit/kit/log"
 	kithttp "github.com/go-kit/kit/transport/http"
 	"github.com/gorilla/mux"
@@ -20,17 +26,36 @@ type errorer interface {
 	error() error
 }
 
-func MakeHandler(us Service, logger kitlog.Logger) http.Handler {
+// defaultHistoryLimit and maxHistoryLimit bound the page size of a user's audit history
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 200
+)
+
+// MakeHandler builds the public user endpoints. Changes are attributed to the client identified by client, see
+// auth.Client, or to nobody if it is nil. Each route is rate limited by limits and bounded by deadlines under its
+// endpoint name, both may be nil.
+func MakeHandler(us Service, logger kitlog.Logger, client func(r *http.Request) string, limits *ratelimit.Policy, deadlines *deadline.Policy) http.Handler {
 	opts := []kithttp.ServerOption{
 		kithttp.ServerErrorLogger(logger),
-		kithttp.ServerErrorEncoder(encodeError),
+		kithttp.ServerErrorEncoder(limits.ErrorEncoder(encodeError)),
+		kithttp.ServerBefore(kithttp.PopulateRequestContext, populateClient(client), limits.PopulateClient, deadlines.PopulateTimeout),
+		kithttp.ServerAfter(limits.SetHeaders),
+	}
+	route := func(name string, e endpoint.Endpoint) endpoint.Endpoint {
+		return limits.Middleware(name)(deadlines.Middleware(name)(e))
 	}
 
-	// Define all endpoints
-	create := makeCreateUserEndpoint(us)
-	read := makeReadUserEindpoint(us)
-	update := makeUpdateUserColorEndpoint(us)
-	list := makeReadAllUsersEndpoint(us)
+	// Define all endpoints. Exports stream from the repository while the response is written, after the endpoint
+	// returned, so they are not bounded by a deadline.
+	create := route("create_user", makeCreateUserEndpoint(us))
+	read := route("read_user", makeReadUserEindpoint(us))
+	update := route("update_user", makeUpdateUserColorEndpoint(us))
+	list := route("list_users", makeReadAllUsersEndpoint(us))
+	remove := route("delete_user", makeDeleteUserEndpoint(us))
+	bulkImport := route("import_users", makeImportUsersEndpoint(us))
+	bulkExport := limits.Middleware("export_users")(makeExportUsersEndpoint(us))
+	history := route("user_history", makeUserHistoryEndpoint(us))
 
 	createHandler := kithttp.NewServer(
 		create,
@@ -60,29 +85,132 @@ func MakeHandler(us Service, logger kitlog.Logger) http.Handler {
 		opts...,
 	)
 
+	deleteHandler := kithttp.NewServer(
+		remove,
+		decodeDeleteUserRequest,
+		encodeDeleteUserResponse,
+		opts...,
+	)
+
+	importHandler := kithttp.NewServer(
+		bulkImport,
+		decodeImportUsersRequest,
+		encodeImportUsersResponse,
+		opts...,
+	)
+
+	exportHandler := kithttp.NewServer(
+		bulkExport,
+		decodeExportUsersRequest,
+		encodeExportUsersResponse,
+		opts...,
+	)
+
+	historyHandler := kithttp.NewServer(
+		history,
+		decodeUserHistoryRequest,
+		encodeUserHistoryResponse,
+		opts...,
+	)
+
 	r := mux.NewRouter()
 	r.Handle("/api/v1/users", listHandler).Methods("GET")
 	r.Handle("/api/v1/users", createHandler).Methods("POST")
+	r.Handle("/api/v1/users:import", importHandler).Methods("POST")
+	r.Handle("/api/v1/users:export", exportHandler).Methods("GET")
 	r.Handle("/api/v1/users/{id}", readHandler).Methods("GET")
-	r.Handle("/api/v1/users/{id}", updateHandler).Methods("PUT")
+	r.Handle("/api/v1/users/{id}", updateHandler).Methods("PUT", "PATCH")
+	r.Handle("/api/v1/users/{id}", deleteHandler).Methods("DELETE")
+	r.Handle("/api/v1/users/{id}/history", historyHandler).Methods("GET")
+
+	return r
+}
+
+// MakeAdminHandler builds the user endpoints reserved for admins, which can see soft deleted users, restore them
+// and see who changed a user, addresses included. It is only mounted on the admin listener.
+func MakeAdminHandler(us Service, logger kitlog.Logger) http.Handler {
+	opts := []kithttp.ServerOption{
+		kithttp.ServerErrorLogger(logger),
+		kithttp.ServerErrorEncoder(encodeError),
+		kithttp.ServerBefore(kithttp.PopulateRequestContext, populateActor),
+	}
+
+	listHandler := kithttp.NewServer(
+		makeReadAllUsersEndpoint(us),
+		decodeAdminListUsersRequest,
+		encodeListUsersResponse,
+		opts...,
+	)
 
+	readHandler := kithttp.NewServer(
+		makeReadUserEindpoint(us),
+		decodeAdminReadUserRequest,
+		encodeReadUserResponse,
+		opts...,
+	)
+
+	restoreHandler := kithttp.NewServer(
+		makeRestoreUserEndpoint(us),
+		decodeRestoreUserRequest,
+		encodeRestoreUserResponse,
+		opts...,
+	)
+
+	historyHandler := kithttp.NewServer(
+		makeUserHistoryEndpoint(us),
+		decodeUserHistoryRequest,
+		encodeAdminUserHistoryResponse,
+		opts...,
+	)
+
+	r := mux.NewRouter()
+	r.Handle("/admin/users", listHandler).Methods("GET")
+	r.Handle("/admin/users/{id}", readHandler).Methods("GET")
+	r.Handle("/admin/users/{id}/restore", restoreHandler).Methods("POST")
+	r.Handle("/admin/users/{id}/history", historyHandler).Methods("GET")
 	return r
 }
 
+// populateClient records the client identified by client as the actor of the request. Headers a client could
+// set to impersonate another actor are ignored.
+func populateClient(client func(r *http.Request) string) kithttp.RequestFunc {
+	return func(ctx context.Context, r *http.Request) context.Context {
+		if client == nil {
+			return ctx
+		}
+		if actor := client(r); actor != "" {
+			return WithActor(ctx, actor)
+		}
+		return ctx
+	}
+}
+
+// populateActor records the actor named by the X-Actor header, set by the authenticating proxy in front of the
+// admin listener, in the request context so changes can be attributed to it. Public requests never reach it.
+func populateActor(ctx context.Context, r *http.Request) context.Context {
+	if actor := r.Header.Get("X-Actor"); actor != "" {
+		return WithActor(ctx, actor)
+	}
+	return ctx
+}
+
 func decodeRequest(to interface{}, r *http.Request) (interface{}, error) {
 	d, err := ioutil.ReadAll(r.Body)
 	defer r.Body.Close()
 	if err != nil {
-		return nil, err
+		return nil, errs.ErrInvalidArgument.Wrap(err)
+	}
+	if err = json.Unmarshal(d, &to); err != nil {
+		return nil, errs.ErrInvalidArgument.Wrap(err)
 	}
-	err = json.Unmarshal(d, &to)
-	return to, err
+	return to, nil
 }
 
 func encodeResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
 	d, err := json.Marshal(response)
 	if err != nil {
 		encodeError(ctx, err, w)
+		return nil
 	}
 	_, err = w.Write(d)
 	return err
@@ -100,16 +228,31 @@ func encodeCreateUserResponse(ctx context.Context, w http.ResponseWriter, respon
 	}
 
 	res := response.(userCreateResponse)
+	w.Header().Set("Location", "/api/v1/users/"+strconv.Itoa(res.ID))
+	w.WriteHeader(http.StatusCreated)
 	return encodeResponse(ctx, w, res)
 }
 
-func decodeReadUserRequest(_ context.Context, r *http.Request) (interface{}, error) {
+// decodeUserID reads the user id from the request path
+func decodeUserID(r *http.Request) (int, error) {
 	vars := mux.Vars(r)
 	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		return 0, errs.ErrInvalidArgument.WithDetail("user id must be an integer")
+	}
+	return id, nil
+}
+
+func decodeReadUserRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	id, err := decodeUserID(r)
+	if err != nil {
+		return nil, err
+	}
 	req := userReadRequest{
-		ID: id,
+		ID:          id,
+		IfNoneMatch: r.Header.Get("If-None-Match"),
 	}
-	return req, err
+	return req, nil
 }
 
 func encodeReadUserResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
@@ -119,12 +262,30 @@ func encodeReadUserResponse(ctx context.Context, w http.ResponseWriter, response
 	}
 
 	res := response.(userReadResponse)
+	w.Header().Set("ETag", etag(res.User.Version))
+	if res.notModified {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
 	return encodeResponse(ctx, w, res)
 }
 
 func decodeUpdateUserRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	id, err := decodeUserID(r)
+	if err != nil {
+		return nil, err
+	}
+	version, err := decodeIfMatch(r)
+	if err != nil {
+		return nil, err
+	}
+
 	var req userUpdateColorRequest
-	return decodeRequest(req, r)
+	if _, err := decodeRequest(&req, r); err != nil {
+		return nil, err
+	}
+	req.ID, req.Version = id, version
+	return &req, nil
 }
 
 func encodeUpdateUserResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
@@ -134,14 +295,95 @@ func encodeUpdateUserResponse(ctx context.Context, w http.ResponseWriter, respon
 	}
 
 	res := response.(userUpdateColorResponse)
+	w.Header().Set("ETag", etag(res.User.Version))
 	return encodeResponse(ctx, w, res)
 }
 
+func decodeDeleteUserRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	id, err := decodeUserID(r)
+	if err != nil {
+		return nil, err
+	}
+	version, err := decodeIfMatch(r)
+	if err != nil {
+		return nil, err
+	}
+	return userDeleteRequest{ID: id, Version: version}, nil
+}
+
+func encodeDeleteUserResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	if e, ok := response.(errorer); ok && e.error() != nil {
+		encodeError(ctx, e.error(), w)
+		return nil
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
 func decodeListUsersRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	req := userReadAllRequest{}
 	return req, nil
 }
 
+// decodeIncludeDeleted reads the include_deleted query parameter
+func decodeIncludeDeleted(r *http.Request) (bool, error) {
+	v := r.URL.Query().Get("include_deleted")
+	if v == "" {
+		return false, nil
+	}
+	include, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, errs.ErrInvalidArgument.WithDetail("include_deleted must be a boolean")
+	}
+	return include, nil
+}
+
+func decodeAdminListUsersRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	include, err := decodeIncludeDeleted(r)
+	if err != nil {
+		return nil, err
+	}
+	return userReadAllRequest{IncludeDeleted: include}, nil
+}
+
+func decodeAdminReadUserRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	include, err := decodeIncludeDeleted(r)
+	if err != nil {
+		return nil, err
+	}
+	req, err := decodeReadUserRequest(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	read := req.(userReadRequest)
+	read.IncludeDeleted = include
+	return read, nil
+}
+
+func decodeRestoreUserRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	id, err := decodeUserID(r)
+	if err != nil {
+		return nil, err
+	}
+	version, err := decodeIfMatch(r)
+	if err != nil {
+		return nil, err
+	}
+	return userRestoreRequest{ID: id, Version: version}, nil
+}
+
+func encodeRestoreUserResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	if e, ok := response.(errorer); ok && e.error() != nil {
+		encodeError(ctx, e.error(), w)
+		return nil
+	}
+
+	res := response.(userRestoreResponse)
+	w.Header().Set("ETag", etag(res.User.Version))
+	return encodeResponse(ctx, w, res)
+}
+
 func encodeListUsersResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
 	if e, ok := response.(errorer); ok && e.error() != nil {
 		encodeError(ctx, e.error(), w)
@@ -152,17 +394,180 @@ func encodeListUsersResponse(ctx context.Context, w http.ResponseWriter, respons
 	return encodeResponse(ctx, w, res)
 }
 
-func encodeError(_ context.Context, err error, w http.ResponseWriter) {
-	switch err {
-	case errs.ErrInvalidArgument:
-		w.WriteHeader(http.StatusBadRequest)
-	case errs.ErrUserNotFound:
-		w.WriteHeader(http.StatusNotFound)
+// decodeUserHistoryRequest reads the page of history requested by the after and limit query parameters
+func decodeUserHistoryRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	id, err := decodeUserID(r)
+	if err != nil {
+		return nil, err
+	}
+
+	req := userHistoryRequest{ID: id, Limit: defaultHistoryLimit}
+	q := r.URL.Query()
+	if v := q.Get("after"); v != "" {
+		if req.After, err = strconv.Atoi(v); err != nil || req.After < 0 {
+			return nil, errs.ErrInvalidArgument.WithDetail("after must be a non-negative integer")
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if req.Limit, err = strconv.Atoi(v); err != nil || req.Limit <= 0 {
+			return nil, errs.ErrInvalidArgument.WithDetail("limit must be a positive integer")
+		}
+	}
+	if req.Limit > maxHistoryLimit {
+		req.Limit = maxHistoryLimit
+	}
+	return req, nil
+}
+
+// encodeUserHistoryResponse writes a page of history in which clients identified by their address appear as
+// AnonymousActor, so the public history does not expose the addresses of other clients
+func encodeUserHistoryResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	if e, ok := response.(errorer); ok && e.error() != nil {
+		encodeError(ctx, e.error(), w)
+		return nil
+	}
+
+	res := response.(userHistoryResponse)
+	history := make([]*AuditEntry, len(res.History))
+	for i, e := range res.History {
+		entry := *e
+		if auth.ByAddress(entry.Actor) {
+			entry.Actor = AnonymousActor
+		}
+		history[i] = &entry
+	}
+	res.History = history
+	return encodeResponse(ctx, w, res)
+}
+
+// encodeAdminUserHistoryResponse writes a page of history with every actor
+func encodeAdminUserHistoryResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	if e, ok := response.(errorer); ok && e.error() != nil {
+		encodeError(ctx, e.error(), w)
+		return nil
+	}
+
+	res := response.(userHistoryResponse)
+	return encodeResponse(ctx, w, res)
+}
+
+// decodeImportUsersRequest prepares to read rows from the body. The mode query parameter selects an "atomic"
+// (the default) or "best-effort" import.
+func decodeImportUsersRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var atomic bool
+	switch r.URL.Query().Get("mode") {
+	case "", "atomic":
+		atomic = true
+	case "best-effort":
 	default:
-		w.WriteHeader(http.StatusInternalServerError)
+		return nil, errs.ErrInvalidArgument.WithDetail(`mode must be "atomic" or "best-effort"`)
 	}
+
+	rows, err := newUserRowReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return userImportRequest{rows: rows, atomic: atomic}, nil
+}
+
+func encodeImportUsersResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	if e, ok := response.(errorer); ok && e.error() != nil {
+		encodeError(ctx, e.error(), w)
+		return nil
+	}
+
+	res := response.(userImportResponse)
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"error": err.Error(),
+	if res.Aborted {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	return json.NewEncoder(w).Encode(res)
+}
+
+// decodeExportUsersRequest selects CSV when asked for by the format query parameter or the Accept header,
+// otherwise users are exported as NDJSON
+func decodeExportUsersRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	format := ndjsonContentType
+	if r.URL.Query().Get("format") == "csv" || strings.Contains(r.Header.Get("Accept"), csvContentType) {
+		format = csvContentType
+	}
+	return userExportRequest{format: format}, nil
+}
+
+// encodeExportUsersResponse streams every user to the client, flushing periodically. Once streaming has
+// started errors can no longer be reported with a status code so they end the response early.
+func encodeExportUsersResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(userExportResponse)
+
+	w.Header().Set("Content-Type", res.format+"; charset=utf-8")
+	rw, err := newUserRowWriter(res.format, w)
+	if err != nil {
+		return err
+	}
+
+	flusher, _ := w.(http.Flusher)
+	rows := 0
+	err = res.export(func(u User) error {
+		if err := rw.Write(u); err != nil {
+			return err
+		}
+		if rows++; rows%exportFlushRows == 0 {
+			if err := rw.Flush(); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return nil
 	})
+	if err != nil {
+		return err
+	}
+	return rw.Flush()
+}
+
+// etag returns the strong entity tag of a user version
+func etag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// etagMatches reports whether an If-None-Match or If-Match header value names version
+func etagMatches(header string, version int) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag(version) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeIfMatch returns the user version named by the If-Match header, or 0 if the header is absent or "*".
+// Tags we could not have issued can never match so they fail the precondition.
+func decodeIfMatch(r *http.Request) (int, error) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return 0, nil
+	}
+
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+			continue
+		}
+		if version, err := strconv.Atoi(tag[1 : len(tag)-1]); err == nil && version > 0 {
+			return version, nil
+		}
+	}
+	return 0, errs.ErrVersionConflict
+}
+
+// encodeError renders err as RFC 7807 problem details. Endpoints return their errors in responses, out of reach of
+// the deadline middleware, so failures caused by an exceeded deadline are mapped to ErrDeadlineExceeded here.
+func encodeError(ctx context.Context, err error, w http.ResponseWriter) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = errs.ErrDeadlineExceeded
+	}
+	errs.EncodeProblem(ctx, err, w)
 }
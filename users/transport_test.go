@@ -0,0 +1,177 @@
+package users
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bnelz/gokit-base/deadline"
+	errs "github.com/bnelz/gokit-base/errors"
+	kitlog "github.com/go-kit/kit/log"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransport_ReadUserETag(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockService := NewMockService(ctrl)
+	h := MakeHandler(mockService, kitlog.NewNopLogger(), nil, nil, nil)
+	mockService.EXPECT().ReadUser(gomock.Any(), 1, false).Return(User{ID: 1, FirstName: "Bob", Version: 3}, nil).Times(2)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/users/1", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"3"`, w.Header().Get("ETag"))
+
+	r := httptest.NewRequest("GET", "/api/v1/users/1", nil)
+	r.Header.Set("If-None-Match", `"3"`)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Empty(t, w.Body.String())
+}
+
+func TestTransport_UpdateUserIfMatch(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockService := NewMockService(ctrl)
+	h := MakeHandler(mockService, kitlog.NewNopLogger(), nil, nil, nil)
+
+	mockService.EXPECT().UpdateUserColor(gomock.Any(), 1, "blue", 3).Return(User{ID: 1, FavoriteColor: "blue", Version: 4}, nil)
+	r := httptest.NewRequest("PUT", "/api/v1/users/1", strings.NewReader(`{"favorite_color":"blue"}`))
+	r.Header.Set("If-Match", `"3"`)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"4"`, w.Header().Get("ETag"))
+
+	mockService.EXPECT().UpdateUserColor(gomock.Any(), 1, "blue", 3).Return(User{}, errs.ErrVersionConflict)
+	r = httptest.NewRequest("PATCH", "/api/v1/users/1", strings.NewReader(`{"favorite_color":"blue"}`))
+	r.Header.Set("If-Match", `"3"`)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+
+	r = httptest.NewRequest("DELETE", "/api/v1/users/1", nil)
+	r.Header.Set("If-Match", `W/"3"`)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+}
+
+func TestTransport_DeadlineExceeded(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockService := NewMockService(ctrl)
+	h := MakeHandler(mockService, kitlog.NewNopLogger(), nil, nil, deadline.NewPolicy(deadline.Options{Default: 10 * time.Millisecond}))
+
+	// The repository gave up on the deadline, the endpoint reports it in its response
+	mockService.EXPECT().ReadUser(gomock.Any(), 1, false).DoAndReturn(func(ctx context.Context, _ int, _ bool) (User, error) {
+		<-ctx.Done()
+		return User{}, errs.ErrInternal.Wrap(ctx.Err())
+	})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/users/1", nil))
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.Contains(t, w.Body.String(), `"code":"deadline_exceeded"`)
+}
+
+func TestTransport_ActorIsTheAuthenticatedClient(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockService := NewMockService(ctrl)
+	h := MakeHandler(mockService, kitlog.NewNopLogger(), func(*http.Request) string { return "sub:ada" }, nil, nil)
+
+	// A client naming another actor is still attributed its own changes
+	mockService.EXPECT().ReadUser(gomock.Any(), 1, false).DoAndReturn(func(ctx context.Context, _ int, _ bool) (User, error) {
+		assert.Equal(t, "sub:ada", ActorFromContext(ctx))
+		return User{ID: 1, Version: 1}, nil
+	})
+	r := httptest.NewRequest("GET", "/api/v1/users/1", nil)
+	r.Header.Set("X-Actor", "admin")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+}
+
+func TestAdminTransport_IncludeDeletedAndRestore(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockService := NewMockService(ctrl)
+	h := MakeAdminHandler(mockService, kitlog.NewNopLogger())
+
+	mockService.EXPECT().ReadUser(gomock.Any(), 1, true).Return(User{ID: 1, Version: 2}, nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/admin/users/1?include_deleted=true", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/admin/users?include_deleted=maybe", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	mockService.EXPECT().RestoreUser(gomock.Any(), 1, 2).Return(User{ID: 1, Version: 3}, nil)
+	r := httptest.NewRequest("POST", "/admin/users/1/restore", nil)
+	r.Header.Set("If-Match", `"2"`)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"3"`, w.Header().Get("ETag"))
+
+	mockService.EXPECT().RestoreUser(gomock.Any(), 2, 0).Return(User{}, errs.ErrUserNotDeleted)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/admin/users/2/restore", nil))
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestTransport_UserHistoryPagination(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockService := NewMockService(ctrl)
+	h := MakeHandler(mockService, kitlog.NewNopLogger(), nil, nil, nil)
+
+	mockService.EXPECT().UserHistory(gomock.Any(), 1, 4, 2).Return([]*AuditEntry{{ID: 5}, {ID: 9}}, nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/users/1/history?after=4&limit=2", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"next_after":9`)
+
+	mockService.EXPECT().UserHistory(gomock.Any(), 1, 0, defaultHistoryLimit).Return([]*AuditEntry{{ID: 5}}, nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/users/1/history", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "next_after")
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/users/1/history?limit=0", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestTransport_UserHistoryHidesAddressesFromThePublic(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockService := NewMockService(ctrl)
+	history := []*AuditEntry{{ID: 1, Actor: "ip:203.0.113.7"}, {ID: 2, Actor: "sub:alice"}}
+	mockService.EXPECT().UserHistory(gomock.Any(), 1, 0, defaultHistoryLimit).Return(history, nil).Times(2)
+
+	w := httptest.NewRecorder()
+	MakeHandler(mockService, kitlog.NewNopLogger(), nil, nil, nil).ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/users/1/history", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "203.0.113.7")
+	assert.Contains(t, w.Body.String(), `"actor":"anonymous"`)
+	assert.Contains(t, w.Body.String(), `"actor":"sub:alice"`)
+
+	// Admins see every actor
+	w = httptest.NewRecorder()
+	MakeAdminHandler(mockService, kitlog.NewNopLogger()).ServeHTTP(w, httptest.NewRequest("GET", "/admin/users/1/history", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"actor":"ip:203.0.113.7"`)
+}
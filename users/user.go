@@ -1,12 +1,30 @@
 // Users package is a sample business domain object package for application users
 package users
 
+import (
+	"context"
+	"time"
+
+	"github.com/bnelz/gokit-base/events"
+)
+
 // User describes an application user business object
 type User struct {
 	ID            int    `json:"id"`
 	FirstName     string `json:"first_name"`
 	LastName      string `json:"last_name"`
 	FavoriteColor string `json:"fav_color,omitempty"`
+
+	// Version is incremented by the repository on every write
+	Version int `json:"version"`
+
+	// DeletedAt is set when the user has been soft deleted, it is purged once its retention period is over
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// Deleted reports whether the user has been soft deleted
+func (u *User) Deleted() bool {
+	return u.DeletedAt != nil
 }
 
 // New returns a reference to a new user instance
@@ -18,14 +36,51 @@ func New(id int, fname string, lname string) *User {
 	}
 }
 
-// (User) Repository is the set of behavior a repository, or "store", of users must conform to.
+// (User) Repository is the set of behavior a repository, or "store", of users must conform to. Implementations
+// give up on calls whose context is done where they can.
 type Repository interface {
-	// Store a new user in the repository
-	Store(user *User) error
+	// Insert a new user into the repository, failing with ErrUserExists if the ID is taken
+	Insert(ctx context.Context, user *User) error
+
+	// Store a user in the repository, replacing any existing user with the same ID. A non-zero user.Version must
+	// match the stored version or ErrVersionConflict is returned. On success user.Version is the new version.
+	Store(ctx context.Context, user *User) error
+
+	// Delete soft deletes a user in the repository. A non-zero version must match the stored version.
+	Delete(ctx context.Context, id int, version int) error
 
-	// Find a user in the repository by ID
-	Find(id int) (*User, error)
+	// Restore undoes the soft delete of a user. A non-zero version must match the stored version.
+	Restore(ctx context.Context, id int, version int) (*User, error)
+
+	// Purge permanently removes users soft deleted before the given time and returns how many were removed
+	Purge(ctx context.Context, deletedBefore time.Time) int
+
+	// Find a user in the repository by ID, soft deleted users are only found if includeDeleted is set
+	Find(ctx context.Context, id int, includeDeleted bool) (*User, error)
+
+	// FindAll users in the repository, soft deleted users are only returned if includeDeleted is set
+	FindAll(ctx context.Context, includeDeleted bool) []*User
+
+	// InsertBatch inserts many users at once and returns a result per user, nil for users that were inserted.
+	// An atomic batch inserts nothing unless every user can be inserted.
+	InsertBatch(ctx context.Context, users []*User, atomic bool) []error
+
+	// FindAfter returns up to limit users with an ID greater than afterID, ordered by ID, excluding soft
+	// deleted users
+	FindAfter(ctx context.Context, afterID int, limit int) []*User
+}
+
+// Transactor commits repository writes together with the events they cause, a transactional outbox, and the audit
+// entries recording them
+type Transactor interface {
+	// Transact calls fn with a repository bound to a new transaction. The writes made through it, the events
+	// passed to record and the entries passed to audit are committed together when fn returns nil, and discarded
+	// together otherwise. Entries are assigned their ID on commit.
+	Transact(ctx context.Context, fn func(repo Repository, record func(e events.Envelope), audit func(entry *AuditEntry)) error) error
+}
 
-	// FindAll users in the repository
-	FindAll() []*User
+// IDGenerator allocates IDs for users created without one
+type IDGenerator interface {
+	// NextID returns an ID that has not been allocated before
+	NextID(ctx context.Context) (int, error)
 }
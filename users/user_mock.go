@@ -1,9 +1,13 @@
-// Automatically generated by MockGen. DO NOT EDIT!
-// Source: users/user.go
+// Mocks of the interfaces in users/user.go, maintained by hand in the layout of MockGen output. Update them along
+// with the interfaces.
 
 package users
 
 import (
+	context "context"
+	time "time"
+
+	events "github.com/bnelz/gokit-base/events"
 	gomock "github.com/golang/mock/gomock"
 )
 
@@ -28,33 +32,157 @@ func (_m *MockRepository) EXPECT() *_MockRepositoryRecorder {
 	return _m.recorder
 }
 
-func (_m *MockRepository) Store(user *User) error {
-	ret := _m.ctrl.Call(_m, "Store", user)
+func (_m *MockRepository) Insert(ctx context.Context, user *User) error {
+	ret := _m.ctrl.Call(_m, "Insert", ctx, user)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockRepositoryRecorder) Insert(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Insert", arg0, arg1)
+}
+
+func (_m *MockRepository) InsertBatch(ctx context.Context, users []*User, atomic bool) []error {
+	ret := _m.ctrl.Call(_m, "InsertBatch", ctx, users, atomic)
+	ret0, _ := ret[0].([]error)
+	return ret0
+}
+
+func (_mr *_MockRepositoryRecorder) InsertBatch(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "InsertBatch", arg0, arg1, arg2)
+}
+
+func (_m *MockRepository) FindAfter(ctx context.Context, afterID int, limit int) []*User {
+	ret := _m.ctrl.Call(_m, "FindAfter", ctx, afterID, limit)
+	ret0, _ := ret[0].([]*User)
+	return ret0
+}
+
+func (_mr *_MockRepositoryRecorder) FindAfter(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "FindAfter", arg0, arg1, arg2)
+}
+
+func (_m *MockRepository) Store(ctx context.Context, user *User) error {
+	ret := _m.ctrl.Call(_m, "Store", ctx, user)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-func (_mr *_MockRepositoryRecorder) Store(arg0 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "Store", arg0)
+func (_mr *_MockRepositoryRecorder) Store(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Store", arg0, arg1)
+}
+
+func (_m *MockRepository) Delete(ctx context.Context, id int, version int) error {
+	ret := _m.ctrl.Call(_m, "Delete", ctx, id, version)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockRepositoryRecorder) Delete(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Delete", arg0, arg1, arg2)
+}
+
+func (_m *MockRepository) Restore(ctx context.Context, id int, version int) (*User, error) {
+	ret := _m.ctrl.Call(_m, "Restore", ctx, id, version)
+	ret0, _ := ret[0].(*User)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockRepositoryRecorder) Restore(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Restore", arg0, arg1, arg2)
+}
+
+func (_m *MockRepository) Purge(ctx context.Context, deletedBefore time.Time) int {
+	ret := _m.ctrl.Call(_m, "Purge", ctx, deletedBefore)
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+func (_mr *_MockRepositoryRecorder) Purge(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Purge", arg0, arg1)
 }
 
-func (_m *MockRepository) Find(id int) (*User, error) {
-	ret := _m.ctrl.Call(_m, "Find", id)
+func (_m *MockRepository) Find(ctx context.Context, id int, includeDeleted bool) (*User, error) {
+	ret := _m.ctrl.Call(_m, "Find", ctx, id, includeDeleted)
 	ret0, _ := ret[0].(*User)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-func (_mr *_MockRepositoryRecorder) Find(arg0 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "Find", arg0)
+func (_mr *_MockRepositoryRecorder) Find(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Find", arg0, arg1, arg2)
 }
 
-func (_m *MockRepository) FindAll() []*User {
-	ret := _m.ctrl.Call(_m, "FindAll")
+func (_m *MockRepository) FindAll(ctx context.Context, includeDeleted bool) []*User {
+	ret := _m.ctrl.Call(_m, "FindAll", ctx, includeDeleted)
 	ret0, _ := ret[0].([]*User)
 	return ret0
 }
 
-func (_mr *_MockRepositoryRecorder) FindAll() *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "FindAll")
+func (_mr *_MockRepositoryRecorder) FindAll(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "FindAll", arg0, arg1)
+}
+
+// Mock of IDGenerator interface
+type MockIDGenerator struct {
+	ctrl     *gomock.Controller
+	recorder *_MockIDGeneratorRecorder
+}
+
+// Recorder for MockIDGenerator (not exported)
+type _MockIDGeneratorRecorder struct {
+	mock *MockIDGenerator
+}
+
+func NewMockIDGenerator(ctrl *gomock.Controller) *MockIDGenerator {
+	mock := &MockIDGenerator{ctrl: ctrl}
+	mock.recorder = &_MockIDGeneratorRecorder{mock}
+	return mock
+}
+
+func (_m *MockIDGenerator) EXPECT() *_MockIDGeneratorRecorder {
+	return _m.recorder
+}
+
+func (_m *MockIDGenerator) NextID(ctx context.Context) (int, error) {
+	ret := _m.ctrl.Call(_m, "NextID", ctx)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockIDGeneratorRecorder) NextID(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "NextID", arg0)
+}
+
+// Mock of Transactor interface
+type MockTransactor struct {
+	ctrl     *gomock.Controller
+	recorder *_MockTransactorRecorder
+}
+
+// Recorder for MockTransactor (not exported)
+type _MockTransactorRecorder struct {
+	mock *MockTransactor
+}
+
+func NewMockTransactor(ctrl *gomock.Controller) *MockTransactor {
+	mock := &MockTransactor{ctrl: ctrl}
+	mock.recorder = &_MockTransactorRecorder{mock}
+	return mock
+}
+
+func (_m *MockTransactor) EXPECT() *_MockTransactorRecorder {
+	return _m.recorder
+}
+
+func (_m *MockTransactor) Transact(ctx context.Context, fn func(repo Repository, record func(e events.Envelope), audit func(entry *AuditEntry)) error) error {
+	ret := _m.ctrl.Call(_m, "Transact", ctx, fn)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockTransactorRecorder) Transact(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Transact", arg0, arg1)
 }
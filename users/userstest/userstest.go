@@ -0,0 +1,174 @@
+// Userstest package checks that user repositories behave the way the users service relies on
+package userstest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	errs "github.com/bnelz/gokit-base/errors"
+	"github.com/bnelz/gokit-base/users"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRepository runs the repository conformance tests against empty repositories made by newRepo
+func TestRepository(t *testing.T, newRepo func() users.Repository) {
+	for name, test := range map[string]func(*testing.T, users.Repository){
+		"InsertAndFind":    testInsertAndFind,
+		"Store":            testStore,
+		"DeleteAndRestore": testDeleteAndRestore,
+		"Purge":            testPurge,
+		"InsertBatch":      testInsertBatch,
+		"FindAfter":        testFindAfter,
+		"FindAll":          testFindAll,
+	} {
+		test := test
+		t.Run(name, func(t *testing.T) { test(t, newRepo()) })
+	}
+}
+
+var ctx = context.Background()
+
+// insert adds a user named after its ID
+func insert(t *testing.T, repo users.Repository, id int) {
+	require.NoError(t, repo.Insert(ctx, users.New(id, "Ada", "Lovelace")))
+}
+
+func testInsertAndFind(t *testing.T, repo users.Repository) {
+	_, err := repo.Find(ctx, 1, false)
+	assert.True(t, errors.Is(err, errs.ErrUserNotFound))
+
+	u := users.New(1, "Ada", "Lovelace")
+	require.NoError(t, repo.Insert(ctx, u))
+	assert.Equal(t, 1, u.Version)
+
+	found, err := repo.Find(ctx, 1, false)
+	require.NoError(t, err)
+	assert.Equal(t, "Ada", found.FirstName)
+	assert.Equal(t, 1, found.Version)
+
+	// Found users are copies
+	found.FirstName = "Grace"
+	found, err = repo.Find(ctx, 1, false)
+	require.NoError(t, err)
+	assert.Equal(t, "Ada", found.FirstName)
+
+	err = repo.Insert(ctx, users.New(1, "Grace", "Hopper"))
+	assert.True(t, errors.Is(err, errs.ErrUserExists))
+}
+
+func testStore(t *testing.T, repo users.Repository) {
+	insert(t, repo, 1)
+
+	u, err := repo.Find(ctx, 1, false)
+	require.NoError(t, err)
+	u.FavoriteColor = "blue"
+	require.NoError(t, repo.Store(ctx, u))
+	assert.Equal(t, 2, u.Version)
+
+	found, err := repo.Find(ctx, 1, false)
+	require.NoError(t, err)
+	assert.Equal(t, "blue", found.FavoriteColor)
+	assert.Equal(t, 2, found.Version)
+
+	stale := *found
+	stale.Version = 1
+	assert.True(t, errors.Is(repo.Store(ctx, &stale), errs.ErrVersionConflict))
+
+	missing := users.New(2, "Grace", "Hopper")
+	missing.Version = 1
+	assert.True(t, errors.Is(repo.Store(ctx, missing), errs.ErrUserNotFound))
+}
+
+func testDeleteAndRestore(t *testing.T, repo users.Repository) {
+	insert(t, repo, 1)
+
+	assert.True(t, errors.Is(repo.Delete(ctx, 1, 7), errs.ErrVersionConflict))
+	require.NoError(t, repo.Delete(ctx, 1, 1))
+	assert.True(t, errors.Is(repo.Delete(ctx, 1, 0), errs.ErrUserNotFound))
+
+	_, err := repo.Find(ctx, 1, false)
+	assert.True(t, errors.Is(err, errs.ErrUserNotFound))
+	deleted, err := repo.Find(ctx, 1, true)
+	require.NoError(t, err)
+	assert.True(t, deleted.Deleted())
+	assert.Equal(t, 2, deleted.Version)
+
+	// Deleted users cannot be stored
+	deleted.DeletedAt = nil
+	assert.True(t, errors.Is(repo.Store(ctx, deleted), errs.ErrUserNotFound))
+
+	restored, err := repo.Restore(ctx, 1, 2)
+	require.NoError(t, err)
+	assert.False(t, restored.Deleted())
+	assert.Equal(t, 3, restored.Version)
+
+	found, err := repo.Find(ctx, 1, false)
+	require.NoError(t, err)
+	assert.Equal(t, 3, found.Version)
+
+	_, err = repo.Restore(ctx, 1, 0)
+	assert.True(t, errors.Is(err, errs.ErrUserNotDeleted))
+	_, err = repo.Restore(ctx, 2, 0)
+	assert.True(t, errors.Is(err, errs.ErrUserNotFound))
+}
+
+func testPurge(t *testing.T, repo users.Repository) {
+	insert(t, repo, 1)
+	insert(t, repo, 2)
+	require.NoError(t, repo.Delete(ctx, 1, 0))
+
+	assert.Equal(t, 0, repo.Purge(ctx, time.Now().Add(-time.Hour)))
+	assert.Equal(t, 1, repo.Purge(ctx, time.Now().Add(time.Hour)))
+
+	_, err := repo.Find(ctx, 1, true)
+	assert.True(t, errors.Is(err, errs.ErrUserNotFound))
+	_, err = repo.Find(ctx, 2, false)
+	assert.NoError(t, err)
+}
+
+func testInsertBatch(t *testing.T, repo users.Repository) {
+	insert(t, repo, 2)
+
+	// An atomic batch inserts nothing if a user exists
+	results := repo.InsertBatch(ctx, []*users.User{users.New(1, "Ada", "Lovelace"), users.New(2, "Grace", "Hopper")}, true)
+	require.Len(t, results, 2)
+	assert.True(t, errors.Is(results[0], errs.ErrImportAborted))
+	assert.True(t, errors.Is(results[1], errs.ErrUserExists))
+	_, err := repo.Find(ctx, 1, false)
+	assert.True(t, errors.Is(err, errs.ErrUserNotFound))
+
+	// Other batches insert every user they can
+	results = repo.InsertBatch(ctx, []*users.User{users.New(1, "Ada", "Lovelace"), users.New(2, "Grace", "Hopper")}, false)
+	require.Len(t, results, 2)
+	assert.NoError(t, results[0])
+	assert.True(t, errors.Is(results[1], errs.ErrUserExists))
+	found, err := repo.Find(ctx, 1, false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, found.Version)
+}
+
+func testFindAfter(t *testing.T, repo users.Repository) {
+	for id := 1; id <= 5; id++ {
+		insert(t, repo, id)
+	}
+	require.NoError(t, repo.Delete(ctx, 3, 0))
+
+	var ids []int
+	for _, u := range repo.FindAfter(ctx, 1, 3) {
+		ids = append(ids, u.ID)
+	}
+	assert.Equal(t, []int{2, 4, 5}, ids)
+	assert.Empty(t, repo.FindAfter(ctx, 5, 3))
+}
+
+func testFindAll(t *testing.T, repo users.Repository) {
+	insert(t, repo, 1)
+	insert(t, repo, 2)
+	require.NoError(t, repo.Delete(ctx, 2, 0))
+
+	assert.Len(t, repo.FindAll(ctx, false), 1)
+	assert.Len(t, repo.FindAll(ctx, true), 2)
+}
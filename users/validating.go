@@ -0,0 +1,131 @@
+package users
+
+import (
+	"context"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bnelz/gokit-base/validation"
+)
+
+// maxNameLength is the longest first or last name we accept, in characters
+const maxNameLength = 100
+
+// maxID is the largest user ID we accept, repositories store IDs as 32 bit integers
+const maxID = math.MaxInt32
+
+// hexColor matches #rgb and #rrggbb colors
+var hexColor = regexp.MustCompile(`^#([0-9a-f]{3}|[0-9a-f]{6})$`)
+
+// namedColors is the whitelist of color names we accept
+var namedColors = map[string]bool{
+	"black": true, "white": true, "gray": true, "silver": true,
+	"red": true, "maroon": true, "orange": true, "yellow": true,
+	"olive": true, "lime": true, "green": true, "teal": true,
+	"cyan": true, "aqua": true, "blue": true, "navy": true,
+	"purple": true, "fuchsia": true, "magenta": true, "pink": true,
+	"brown": true,
+}
+
+// validatingService normalizes and validates input before it reaches the user service
+type validatingService struct {
+	Service
+}
+
+// NewValidatingService returns a user service rejecting invalid input with a validation error listing every
+// violation
+func NewValidatingService(s Service) Service {
+	return &validatingService{s}
+}
+
+// CreateUser normalizes the user's names and color and validates them
+func (s *validatingService) CreateUser(ctx context.Context, id int, fname string, lname string, color string) (int, error) {
+	fname, lname, color = validation.Normalize(fname), validation.Normalize(lname), normalizeColor(color)
+	if err := validateUser(id, fname, lname, color); err != nil {
+		return id, err
+	}
+
+	return s.Service.CreateUser(ctx, id, fname, lname, color)
+}
+
+// ImportUsers normalizes and validates every user, only valid users are passed on. An atomic import is aborted
+// before reaching the service if any user is invalid.
+func (s *validatingService) ImportUsers(ctx context.Context, users []User, atomic bool) []ImportResult {
+	results := make([]ImportResult, len(users))
+	valid := make([]User, 0, len(users))
+	rows := make([]int, 0, len(users))
+
+	for i, u := range users {
+		u.FirstName = validation.Normalize(u.FirstName)
+		u.LastName = validation.Normalize(u.LastName)
+		u.FavoriteColor = normalizeColor(u.FavoriteColor)
+		if err := validateUser(u.ID, u.FirstName, u.LastName, u.FavoriteColor); err != nil {
+			results[i].Error = err
+			continue
+		}
+		valid = append(valid, u)
+		rows = append(rows, i)
+	}
+
+	if atomic && len(valid) < len(users) {
+		return abortImport(results)
+	}
+
+	for i, r := range s.Service.ImportUsers(ctx, valid, atomic) {
+		results[rows[i]] = r
+	}
+	return results
+}
+
+// UpdateUserColor normalizes and validates the new color
+func (s *validatingService) UpdateUserColor(ctx context.Context, id int, color string, version int) (User, error) {
+	color = normalizeColor(color)
+
+	var v validation.Validator
+	validateID(&v, id)
+	if v.Required("favorite_color", color) {
+		validateColor(&v, "favorite_color", color)
+	}
+	if err := v.Err(); err != nil {
+		return User{}, err
+	}
+
+	return s.Service.UpdateUserColor(ctx, id, color, version)
+}
+
+// validateUser checks every field of a new user
+func validateUser(id int, fname string, lname string, color string) error {
+	var v validation.Validator
+	validateID(&v, id)
+	validateName(&v, "first_name", fname)
+	validateName(&v, "last_name", lname)
+	if color != "" {
+		validateColor(&v, "fav_color", color)
+	}
+	return v.Err()
+}
+
+// validateID checks that id fits the repositories, zero lets the service allocate one
+func validateID(v *validation.Validator, id int) {
+	v.Check(id <= maxID, "id", "must be at most "+strconv.Itoa(maxID))
+}
+
+// validateName checks a first or last name
+func validateName(v *validation.Validator, field string, name string) {
+	if v.Required(field, name) {
+		v.MaxLength(field, name, maxNameLength)
+		v.Printable(field, name)
+	}
+}
+
+// validateColor checks that color is a whitelisted name or a hex color
+func validateColor(v *validation.Validator, field string, color string) {
+	v.Check(namedColors[color] || hexColor.MatchString(color), field, "must be a color name or a hex color such as #1e90ff")
+}
+
+// normalizeColor trims, normalizes and lower cases a color
+func normalizeColor(color string) string {
+	return strings.ToLower(validation.Normalize(color))
+}
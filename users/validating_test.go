@@ -0,0 +1,52 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	errs "github.com/bnelz/gokit-base/errors"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidatingService_CreateUserNormalizes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockService := NewMockService(ctrl)
+	vs := NewValidatingService(mockService)
+
+	// "Zoe" with a combining diaeresis is normalized to its precomposed form
+	mockService.EXPECT().CreateUser(gomock.Any(), 1, "Zoë", "YourUncle", "#1e90ff").Return(1, nil)
+	id, err := vs.CreateUser(context.Background(), 1, "  Zoe\u0308 ", "YourUncle\t", " #1E90FF")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, id)
+}
+
+func TestValidatingService_CreateUserReportsEveryViolation(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	vs := NewValidatingService(NewMockService(ctrl))
+	_, err := vs.CreateUser(context.Background(), maxID+1, " ", strings.Repeat("a", maxNameLength+1), "plaid")
+
+	assert.True(t, errors.Is(err, errs.ErrValidation))
+	assert.Equal(t, []errs.FieldError{
+		{Field: "id", Message: "must be at most 2147483647"},
+		{Field: "first_name", Message: "is required"},
+		{Field: "last_name", Message: "must be at most 100 characters"},
+		{Field: "fav_color", Message: "must be a color name or a hex color such as #1e90ff"},
+	}, errs.AsError(err).Fields)
+}
+
+func TestValidatingService_UpdateUserColorRequired(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	vs := NewValidatingService(NewMockService(ctrl))
+	_, err := vs.UpdateUserColor(context.Background(), 1, "", 0)
+
+	assert.True(t, errors.Is(err, errs.ErrValidation))
+}
@@ -0,0 +1,54 @@
+// Validation package collects field level violations of client input so they can be reported all at once
+package validation
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	errs "github.com/bnelz/gokit-base/errors"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Normalize trims surrounding whitespace and applies Unicode NFC normalization so equivalent strings compare equal
+func Normalize(s string) string {
+	return norm.NFC.String(strings.TrimSpace(s))
+}
+
+// Validator collects field violations. The zero value is ready to use.
+type Validator struct {
+	fields []errs.FieldError
+}
+
+// Check records message against field unless ok
+func (v *Validator) Check(ok bool, field string, message string) {
+	if !ok {
+		v.fields = append(v.fields, errs.FieldError{Field: field, Message: message})
+	}
+}
+
+// Required records a violation if value is empty
+func (v *Validator) Required(field string, value string) bool {
+	v.Check(value != "", field, "is required")
+	return value != ""
+}
+
+// MaxLength records a violation if value is longer than max characters
+func (v *Validator) MaxLength(field string, value string, max int) {
+	v.Check(utf8.RuneCountInString(value) <= max, field, fmt.Sprintf("must be at most %d characters", max))
+}
+
+// Printable records a violation if value is not valid UTF-8 or contains control characters
+func (v *Validator) Printable(field string, value string) {
+	ok := utf8.ValidString(value) && strings.IndexFunc(value, unicode.IsControl) < 0
+	v.Check(ok, field, "must not contain control characters")
+}
+
+// Err returns a validation error listing every violation, or nil if there were none
+func (v *Validator) Err() error {
+	if len(v.fields) == 0 {
+		return nil
+	}
+	return errs.ErrValidation.WithFields(v.fields...)
+}
@@ -0,0 +1,59 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	errs "github.com/bnelz/gokit-base/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient_RefusesInternalAddresses(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer receiver.Close()
+
+	_, err := NewClient().Post(receiver.URL, "application/json", nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "internal address")
+}
+
+func TestClient_DoesNotFollowRedirects(t *testing.T) {
+	redirector := httptest.NewServer(http.RedirectHandler("http://127.0.0.1:8082/admin/users", http.StatusFound))
+	defer redirector.Close()
+
+	// The guard is bypassed to reach the test server, the redirect itself must not be followed
+	client := NewClient()
+	client.Transport = http.DefaultTransport
+	res, err := client.Post(redirector.URL, "application/json", nil)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusFound, res.StatusCode)
+}
+
+func TestRegister_RejectsInternalURLs(t *testing.T) {
+	ws := NewService(&fakeStore{}, &fakeStore{}, nil)
+	for _, u := range []string{
+		"http://127.0.0.1:8082/admin/users/5/restore",
+		"http://localhost/hook",
+		"http://10.1.2.3/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://[::1]/hook",
+		"http://[fe80::1]/hook",
+		"http://0.1.2.3/hook",
+		"http://100.64.0.1/hook",
+		"http://192.0.0.8/hook",
+		"http://198.18.0.1/hook",
+		"http://255.255.255.255/hook",
+		"http://[::ffff:10.1.2.3]/hook",
+	} {
+		_, err := ws.Register(context.Background(), u, nil, testSecret)
+		assert.True(t, errors.Is(err, errs.ErrValidation), u)
+	}
+
+	_, err := ws.Register(context.Background(), "https://hooks.example.com/users", nil, testSecret)
+	assert.NoError(t, err)
+}
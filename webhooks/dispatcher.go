@@ -0,0 +1,358 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bnelz/gokit-base/events"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+)
+
+// errDispatcherClosed is returned for events handed to a closed dispatcher
+var errDispatcherClosed = errors.New("webhook dispatcher closed")
+
+// DispatcherOptions configures a Dispatcher
+type DispatcherOptions struct {
+	// Workers is the number of deliveries made concurrently
+	Workers int
+
+	// QueueSize is the number of deliveries queued before handing events to the dispatcher blocks
+	QueueSize int
+
+	// MaxAttempts is the number of times a delivery is attempted before it is dead lettered
+	MaxAttempts int
+
+	// BaseBackoff is the wait before the first retry, it doubles on every further retry up to MaxBackoff
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+
+	// Timeout bounds a single delivery attempt
+	Timeout time.Duration
+}
+
+// delivery is an event on its way to a subscription
+type delivery struct {
+	sub   Subscription
+	event events.Envelope
+	body  []byte
+
+	// attempt is the number of the next attempt to deliver
+	attempt int
+
+	// done is called once the delivery was made or dead lettered
+	done func()
+}
+
+// Dispatcher delivers events to webhook subscriptions in the background. Deliveries are signed, retried with
+// exponential backoff and jitter, and dead lettered once every attempt failed. Workers only make attempts, deliveries
+// waiting for their retry are kept on timers so failing receivers cannot hold every worker. Deliveries cut short by
+// Close are dropped rather than dead lettered, the caller hands their event over again after a restart and
+// receivers deduplicate by the X-Webhook-Id header.
+type Dispatcher struct {
+	repo       Repository
+	dlq        DeadLetterQueue
+	client     *http.Client
+	opts       DispatcherOptions
+	logger     log.Logger
+	deliveries metrics.Counter
+
+	jobs      chan delivery
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+
+	mtx    sync.Mutex
+	status map[string]*DeliveryStatus
+
+	// retries holds the deliveries waiting for their retry timer, requeuing counts those being put back in jobs
+	retryMtx  sync.Mutex
+	retries   map[*time.Timer]delivery
+	requeuing sync.WaitGroup
+}
+
+// NewDispatcher starts a dispatcher delivering to the subscriptions in repo. Attempts are counted by deliveries
+// with a result label of "ok", "retry" or "dead_letter".
+func NewDispatcher(repo Repository, dlq DeadLetterQueue, client *http.Client, opts DispatcherOptions, logger log.Logger, deliveries metrics.Counter) *Dispatcher {
+	if opts.Workers <= 0 {
+		opts.Workers = 1
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 1
+	}
+
+	d := &Dispatcher{
+		repo:       repo,
+		dlq:        dlq,
+		client:     client,
+		opts:       opts,
+		logger:     logger,
+		deliveries: deliveries,
+		jobs:       make(chan delivery, opts.QueueSize),
+		done:       make(chan struct{}),
+		status:     make(map[string]*DeliveryStatus),
+		retries:    make(map[*time.Timer]delivery),
+	}
+
+	d.wg.Add(opts.Workers)
+	for i := 0; i < opts.Workers; i++ {
+		go d.work()
+	}
+	return d
+}
+
+// Dispatch queues e for every subscription that wants it and calls done once each of these deliveries was made
+// or dead lettered. done is not called for an event Dispatch fails to queue or whose deliveries Close cut short.
+func (d *Dispatcher) Dispatch(ctx context.Context, e events.Envelope, done func()) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	var subs []*Subscription
+	for _, s := range d.repo.FindAll() {
+		if s.Wants(e.Type) {
+			subs = append(subs, s)
+		}
+	}
+	if len(subs) == 0 {
+		done()
+		return nil
+	}
+
+	remaining := int32(len(subs))
+	delivered := func() {
+		if atomic.AddInt32(&remaining, -1) == 0 {
+			done()
+		}
+	}
+	for _, s := range subs {
+		select {
+		case <-d.done:
+			return errDispatcherClosed
+		default:
+		}
+
+		d.update(s.ID, func(st *DeliveryStatus) { st.Pending++ })
+		select {
+		case d.jobs <- delivery{sub: *s, event: e, body: body, attempt: 1, done: delivered}:
+		case <-d.done:
+			d.update(s.ID, func(st *DeliveryStatus) { st.Pending-- })
+			return errDispatcherClosed
+		case <-ctx.Done():
+			d.update(s.ID, func(st *DeliveryStatus) { st.Pending-- })
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Status returns the delivery status of a subscription
+func (d *Dispatcher) Status(id string) DeliveryStatus {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if st, ok := d.status[id]; ok {
+		return *st
+	}
+	return DeliveryStatus{}
+}
+
+// Close stops the workers. Deliveries waiting to be retried or still queued are dropped.
+func (d *Dispatcher) Close() {
+	d.closeOnce.Do(func() {
+		close(d.done)
+		d.wg.Wait()
+
+		// Workers are done scheduling retries, the ones whose timer did not fire yet are dropped here
+		d.retryMtx.Lock()
+		waiting := d.retries
+		d.retries = make(map[*time.Timer]delivery)
+		d.retryMtx.Unlock()
+		for t, j := range waiting {
+			t.Stop()
+			d.drop(j)
+		}
+		d.requeuing.Wait()
+
+		for {
+			select {
+			case j := <-d.jobs:
+				d.drop(j)
+			default:
+				return
+			}
+		}
+	})
+}
+
+// work makes deliveries until the dispatcher is closed
+func (d *Dispatcher) work() {
+	defer d.wg.Done()
+	for {
+		select {
+		case j := <-d.jobs:
+			d.deliver(j)
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// deliver makes an attempt of a delivery and schedules its retry if it failed and attempts are left
+func (d *Dispatcher) deliver(j delivery) {
+	code, err := d.attempt(j, j.attempt)
+
+	now := time.Now().UTC()
+	d.update(j.sub.ID, func(st *DeliveryStatus) {
+		st.LastAttemptAt, st.LastStatusCode, st.LastError = &now, code, ""
+		if err != nil {
+			st.FailedAttempts++
+			st.LastError = err.Error()
+			return
+		}
+		st.Delivered++
+		st.Pending--
+		st.LastSuccessAt = &now
+	})
+	if err == nil {
+		d.deliveries.With("result", "ok").Add(1)
+		j.done()
+		return
+	}
+
+	if j.attempt >= d.opts.MaxAttempts {
+		d.deadLetter(j, j.attempt, err)
+		return
+	}
+	d.deliveries.With("result", "retry").Add(1)
+	d.retry(j, d.backoff(j.attempt))
+}
+
+// retry puts a delivery back on the queue for its next attempt once wait has passed
+func (d *Dispatcher) retry(j delivery, wait time.Duration) {
+	j.attempt++
+
+	d.retryMtx.Lock()
+	defer d.retryMtx.Unlock()
+
+	var t *time.Timer
+	t = time.AfterFunc(wait, func() {
+		d.retryMtx.Lock()
+		j, ok := d.retries[t]
+		delete(d.retries, t)
+		if ok {
+			d.requeuing.Add(1)
+		}
+		d.retryMtx.Unlock()
+		if !ok {
+			// Close dropped it
+			return
+		}
+		defer d.requeuing.Done()
+
+		select {
+		case d.jobs <- j:
+		case <-d.done:
+			d.drop(j)
+		}
+	})
+	d.retries[t] = j
+}
+
+// attempt posts the signed event to the subscription URL, any response other than 2xx is an error
+func (d *Dispatcher) attempt(j delivery, attempt int) (int, error) {
+	ctx := context.Background()
+	if d.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.opts.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequest("POST", j.sub.URL, bytes.NewReader(j.body))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Id", j.event.ID)
+	req.Header.Set("X-Webhook-Event", string(j.event.Type))
+	req.Header.Set("X-Webhook-Attempt", strconv.Itoa(attempt))
+	req.Header.Set(SignatureHeader, Sign(j.sub.Secret, time.Now(), j.body))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("receiver responded with status %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+// backoff returns the wait before retrying after attempt: the exponential backoff with half of it jittered
+func (d *Dispatcher) backoff(attempt int) time.Duration {
+	b := d.opts.BaseBackoff
+	for i := 1; i < attempt && (d.opts.MaxBackoff <= 0 || b < d.opts.MaxBackoff); i++ {
+		b *= 2
+	}
+	if d.opts.MaxBackoff > 0 && b > d.opts.MaxBackoff {
+		b = d.opts.MaxBackoff
+	}
+	if b <= 0 {
+		return 0
+	}
+	half := b / 2
+	return half + time.Duration(rand.Int63n(int64(b-half)+1))
+}
+
+// drop forgets a delivery cut short by Close
+func (d *Dispatcher) drop(j delivery) {
+	d.update(j.sub.ID, func(st *DeliveryStatus) { st.Pending-- })
+}
+
+// deadLetter gives up on a delivery
+func (d *Dispatcher) deadLetter(j delivery, attempts int, err error) {
+	d.deliveries.With("result", "dead_letter").Add(1)
+	d.update(j.sub.ID, func(st *DeliveryStatus) {
+		st.DeadLettered++
+		st.Pending--
+	})
+
+	dl := DeadLetter{
+		SubscriptionID: j.sub.ID,
+		Event:          j.event,
+		Attempts:       attempts,
+		LastError:      err.Error(),
+		FailedAt:       time.Now().UTC(),
+	}
+	if err := d.dlq.Push(dl); err != nil {
+		d.logger.Log("context_subscription", j.sub.ID, "context_event", j.event.ID, "message", err)
+	}
+	j.done()
+}
+
+// update changes the delivery status of a subscription
+func (d *Dispatcher) update(id string, fn func(st *DeliveryStatus)) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	st, ok := d.status[id]
+	if !ok {
+		st = &DeliveryStatus{}
+		d.status[id] = st
+	}
+	fn(st)
+}
@@ -0,0 +1,177 @@
+package webhooks
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bnelz/gokit-base/events"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testSecret = "0123456789abcdef"
+
+// fakeStore is a Repository and DeadLetterQueue backed by slices
+type fakeStore struct {
+	mtx     sync.Mutex
+	subs    []*Subscription
+	letters []DeadLetter
+}
+
+func (f *fakeStore) Insert(s *Subscription) error          { f.subs = append(f.subs, s); return nil }
+func (f *fakeStore) Delete(id string) error                { return nil }
+func (f *fakeStore) Find(id string) (*Subscription, error) { return f.subs[0], nil }
+func (f *fakeStore) FindAll() []*Subscription              { return f.subs }
+
+func (f *fakeStore) Push(d DeadLetter) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.letters = append(f.letters, d)
+	return nil
+}
+
+func (f *fakeStore) List(string) []DeadLetter {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return append([]DeadLetter{}, f.letters...)
+}
+
+func newTestDispatcher(store *fakeStore, maxAttempts int) *Dispatcher {
+	return NewDispatcher(store, store, http.DefaultClient, DispatcherOptions{
+		Workers:     1,
+		QueueSize:   10,
+		MaxAttempts: maxAttempts,
+		BaseBackoff: time.Millisecond,
+		MaxBackoff:  5 * time.Millisecond,
+		Timeout:     time.Second,
+	}, log.NewNopLogger(), discard.NewCounter())
+}
+
+// waitFor polls cond until it holds or a second has passed
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDispatcher_RetriesSignedDeliveries(t *testing.T) {
+	var calls int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := Verify(testSecret, r.Header.Get(SignatureHeader), body, time.Now(), time.Minute); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		assert.Equal(t, "user.created", r.Header.Get("X-Webhook-Event"))
+		assert.Equal(t, "3", r.Header.Get("X-Webhook-Attempt"))
+	}))
+	defer receiver.Close()
+
+	store := &fakeStore{subs: []*Subscription{
+		{ID: "created", URL: receiver.URL, Secret: testSecret, Types: []events.Type{events.TypeUserCreated}},
+		{ID: "deleted", URL: receiver.URL, Secret: testSecret, Types: []events.Type{events.TypeUserDeleted}},
+	}}
+	d := newTestDispatcher(store, 5)
+	defer d.Close()
+
+	var done int32
+	require.NoError(t, d.Dispatch(context.Background(), events.NewEnvelope(events.UserCreated{UserID: 1}, ""), func() {
+		atomic.AddInt32(&done, 1)
+	}))
+	waitFor(t, func() bool { return atomic.LoadInt32(&done) == 1 })
+
+	st := d.Status("created")
+	assert.Equal(t, 2, st.FailedAttempts)
+	assert.Equal(t, 0, st.Pending)
+	assert.Equal(t, http.StatusOK, st.LastStatusCode)
+	assert.NotNil(t, st.LastSuccessAt)
+	assert.Equal(t, DeliveryStatus{}, d.Status("deleted"))
+	assert.Empty(t, store.List("created"))
+}
+
+func TestDispatcher_DeadLettersAfterMaxAttempts(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	store := &fakeStore{subs: []*Subscription{{ID: "sub", URL: receiver.URL, Secret: testSecret}}}
+	d := newTestDispatcher(store, 3)
+	defer d.Close()
+
+	// Dead lettering is the outcome of the delivery
+	var done int32
+	e := events.NewEnvelope(events.UserDeleted{UserID: 1}, "")
+	require.NoError(t, d.Dispatch(context.Background(), e, func() { atomic.AddInt32(&done, 1) }))
+	waitFor(t, func() bool { return atomic.LoadInt32(&done) == 1 })
+
+	letters := store.List("sub")
+	require.Len(t, letters, 1)
+	assert.Equal(t, e.ID, letters[0].Event.ID)
+	assert.Equal(t, 3, letters[0].Attempts)
+	assert.Equal(t, "receiver responded with status 500", letters[0].LastError)
+	assert.Equal(t, 3, d.Status("sub").FailedAttempts)
+}
+
+func TestDispatcher_RetriesDoNotHoldWorkers(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer healthy.Close()
+
+	store := &fakeStore{subs: []*Subscription{
+		{ID: "failing", URL: failing.URL, Secret: testSecret},
+		{ID: "healthy", URL: healthy.URL, Secret: testSecret},
+	}}
+	d := NewDispatcher(store, store, http.DefaultClient, DispatcherOptions{
+		Workers:     1,
+		QueueSize:   10,
+		MaxAttempts: 3,
+		BaseBackoff: time.Hour,
+		Timeout:     time.Second,
+	}, log.NewNopLogger(), discard.NewCounter())
+
+	// The only worker is free to deliver to the healthy receiver while the failing one waits an hour
+	var done int32
+	require.NoError(t, d.Dispatch(context.Background(), events.NewEnvelope(events.UserCreated{UserID: 1}, ""), func() {
+		atomic.AddInt32(&done, 1)
+	}))
+	waitFor(t, func() bool { return d.Status("healthy").Delivered == 1 })
+	assert.Equal(t, 1, d.Status("failing").FailedAttempts)
+
+	// Closing drops the waiting retry without an outcome, the event is handed over again after a restart
+	d.Close()
+	assert.Empty(t, store.List("failing"))
+	assert.Equal(t, 0, d.Status("failing").Pending)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&done))
+	assert.Equal(t, errDispatcherClosed, d.Dispatch(context.Background(), events.NewEnvelope(events.UserCreated{UserID: 2}, ""), func() {}))
+}
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"id":"1"}`)
+	now := time.Unix(1600000000, 0)
+	sig := Sign(testSecret, now, body)
+
+	assert.NoError(t, Verify(testSecret, sig, body, now.Add(time.Minute), 5*time.Minute))
+	assert.Equal(t, ErrInvalidSignature, Verify("another secret!!", sig, body, now, 0))
+	assert.Equal(t, ErrInvalidSignature, Verify(testSecret, sig, []byte(`{"id":"2"}`), now, 0))
+	assert.Equal(t, ErrInvalidSignature, Verify(testSecret, sig, body, now.Add(time.Hour), 5*time.Minute))
+}
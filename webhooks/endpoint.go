@@ -0,0 +1,96 @@
+package webhooks
+
+import (
+	"context"
+
+	"github.com/bnelz/gokit-base/events"
+	"github.com/go-kit/kit/endpoint"
+)
+
+// registerRequest represents an HTTP request from a client subscribing a URL to events
+type registerRequest struct {
+	URL    string        `json:"url"`
+	Events []events.Type `json:"events"`
+	Secret string        `json:"secret"`
+}
+
+// registerResponse represents an HTTP response containing the new subscription
+type registerResponse struct {
+	Subscription Subscription `json:"subscription"`
+	Error        error        `json:"error,omitempty"`
+}
+
+// error is the registerResponse errorer implementation
+func (r registerResponse) error() error { return r.Error }
+
+// makeRegisterEndpoint creates an HTTP endpoint registering a subscription
+func makeRegisterEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(*registerRequest)
+		sub, err := s.Register(ctx, req.URL, req.Events, req.Secret)
+		return registerResponse{Subscription: sub, Error: err}, nil
+	}
+}
+
+// unregisterRequest represents an HTTP request from a client removing a subscription
+type unregisterRequest struct {
+	ID string
+}
+
+// unregisterResponse represents an HTTP response notifying the client of the removal
+type unregisterResponse struct {
+	Error error `json:"error,omitempty"`
+}
+
+// error is the unregisterResponse errorer implementation
+func (r unregisterResponse) error() error { return r.Error }
+
+// makeUnregisterEndpoint creates an HTTP endpoint removing a subscription
+func makeUnregisterEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(unregisterRequest)
+		return unregisterResponse{Error: s.Unregister(ctx, req.ID)}, nil
+	}
+}
+
+// listRequest has no parameters, but we still generate an empty struct to represent it
+type listRequest struct{}
+
+// listResponse represents an HTTP response listing every subscription
+type listResponse struct {
+	Subscriptions []*Subscription `json:"subscriptions"`
+}
+
+// makeListEndpoint creates an HTTP endpoint listing every subscription
+func makeListEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		return listResponse{Subscriptions: s.Subscriptions(ctx)}, nil
+	}
+}
+
+// statusRequest represents an HTTP request for the delivery status of a subscription
+type statusRequest struct {
+	ID string
+}
+
+// statusResponse represents an HTTP response with the delivery status and dead letters of a subscription
+type statusResponse struct {
+	Status      DeliveryStatus `json:"status"`
+	DeadLetters []DeadLetter   `json:"dead_letters"`
+	Error       error          `json:"error,omitempty"`
+}
+
+// error is the statusResponse errorer implementation
+func (r statusResponse) error() error { return r.Error }
+
+// makeStatusEndpoint creates an HTTP endpoint reporting the delivery status of a subscription
+func makeStatusEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(statusRequest)
+		status, deadLetters, err := s.Status(ctx, req.ID)
+		if deadLetters == nil {
+			deadLetters = []DeadLetter{}
+		}
+		return statusResponse{Status: status, DeadLetters: deadLetters, Error: err}, nil
+	}
+}
@@ -0,0 +1,116 @@
+package webhooks
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/url"
+	"time"
+
+	"github.com/bnelz/gokit-base/events"
+	"github.com/bnelz/gokit-base/validation"
+)
+
+// minSecretLength is the shortest signing secret we accept
+const minSecretLength = 16
+
+// knownTypes are the event types a subscription may choose
+var knownTypes = map[events.Type]bool{
+	events.TypeUserCreated:  true,
+	events.TypeUserUpdated:  true,
+	events.TypeUserDeleted:  true,
+	events.TypeUserRestored: true,
+}
+
+// Service describes the management of webhook subscriptions
+type Service interface {
+	// Register subscribes rawURL to events of the given types, or every type if none are given
+	Register(ctx context.Context, rawURL string, types []events.Type, secret string) (Subscription, error)
+
+	// Unregister removes a subscription
+	Unregister(ctx context.Context, id string) error
+
+	// Subscriptions returns every subscription
+	Subscriptions(ctx context.Context) []*Subscription
+
+	// Status returns the delivery status and dead letters of a subscription
+	Status(ctx context.Context, id string) (DeliveryStatus, []DeadLetter, error)
+}
+
+// StatusReporter reports the delivery status of subscriptions, a Dispatcher is one
+type StatusReporter interface {
+	Status(id string) DeliveryStatus
+}
+
+// webhookService is an implementation of the webhook service interface
+type webhookService struct {
+	repo     Repository
+	dlq      DeadLetterQueue
+	reporter StatusReporter
+}
+
+// NewService returns a new webhook service
+func NewService(repo Repository, dlq DeadLetterQueue, reporter StatusReporter) Service {
+	return &webhookService{
+		repo:     repo,
+		dlq:      dlq,
+		reporter: reporter,
+	}
+}
+
+// Register validates and stores a new subscription
+func (ws *webhookService) Register(_ context.Context, rawURL string, types []events.Type, secret string) (Subscription, error) {
+	rawURL = validation.Normalize(rawURL)
+
+	var v validation.Validator
+	if v.Required("url", rawURL) {
+		u, err := url.Parse(rawURL)
+		switch {
+		case err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "":
+			v.Check(false, "url", "must be an absolute http or https URL")
+		case internalHost(u.Hostname()):
+			v.Check(false, "url", "must not point to a loopback, private or link-local address")
+		}
+	}
+	for _, t := range types {
+		v.Check(knownTypes[t], "events", "must only name known event types")
+	}
+	if v.Required("secret", secret) {
+		v.Check(len(secret) >= minSecretLength, "secret", "must be at least 16 characters")
+	}
+	if err := v.Err(); err != nil {
+		return Subscription{}, err
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	s := Subscription{
+		ID:        hex.EncodeToString(b),
+		URL:       rawURL,
+		Types:     types,
+		Secret:    secret,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := ws.repo.Insert(&s); err != nil {
+		return Subscription{}, err
+	}
+	return s, nil
+}
+
+// Unregister deletes a subscription from the repository
+func (ws *webhookService) Unregister(_ context.Context, id string) error {
+	return ws.repo.Delete(id)
+}
+
+// Subscriptions returns every subscription in the repository
+func (ws *webhookService) Subscriptions(_ context.Context) []*Subscription {
+	return ws.repo.FindAll()
+}
+
+// Status combines the dispatcher's view of a subscription with its dead letters
+func (ws *webhookService) Status(_ context.Context, id string) (DeliveryStatus, []DeadLetter, error) {
+	if _, err := ws.repo.Find(id); err != nil {
+		return DeliveryStatus{}, nil, err
+	}
+	return ws.reporter.Status(id), ws.dlq.List(id), nil
+}
@@ -0,0 +1,64 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignatureHeader carries the signature of a delivery
+const SignatureHeader = "X-Webhook-Signature"
+
+// ErrInvalidSignature is returned by Verify when a signature does not match or is too old
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// Sign returns the signature header value of body sent at ts: "t=<unix seconds>,v1=<hex HMAC-SHA256>". The MAC
+// covers the timestamp so receivers can reject replayed deliveries.
+func Sign(secret string, ts time.Time, body []byte) string {
+	t := strconv.FormatInt(ts.Unix(), 10)
+	return fmt.Sprintf("t=%s,v1=%s", t, mac(secret, t, body))
+}
+
+// Verify checks a signature header value made by Sign. Signatures older than tolerance are rejected, a zero
+// tolerance accepts signatures of any age.
+func Verify(secret string, header string, body []byte, now time.Time, tolerance time.Duration) error {
+	var t, v1 string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			t = kv[1]
+		case "v1":
+			v1 = kv[1]
+		}
+	}
+
+	unix, err := strconv.ParseInt(t, 10, 64)
+	if err != nil || v1 == "" {
+		return ErrInvalidSignature
+	}
+	if tolerance > 0 && now.Sub(time.Unix(unix, 0)) > tolerance {
+		return ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(v1), []byte(mac(secret, t, body))) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// mac returns the hex HMAC-SHA256 of "<t>.<body>"
+func mac(secret string, t string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(t))
+	h.Write([]byte("."))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,128 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	errs "github.com/bnelz/gokit-base/errors"
+	kitlog "github.com/go-kit/kit/log"
+	kithttp "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+)
+
+// errorer describes the behavior of a request or response that can contain errors
+type errorer interface {
+	error() error
+}
+
+// MakeHandler builds a go-kit http transport managing webhook subscriptions and returns it. Subscriptions receive
+// every user event, so the handler is only served on the admin listener.
+func MakeHandler(ws Service, logger kitlog.Logger) http.Handler {
+	opts := []kithttp.ServerOption{
+		kithttp.ServerErrorLogger(logger),
+		kithttp.ServerErrorEncoder(encodeError),
+		kithttp.ServerBefore(kithttp.PopulateRequestContext),
+	}
+
+	registerHandler := kithttp.NewServer(
+		makeRegisterEndpoint(ws),
+		decodeRegisterRequest,
+		encodeRegisterResponse,
+		opts...,
+	)
+
+	unregisterHandler := kithttp.NewServer(
+		makeUnregisterEndpoint(ws),
+		decodeUnregisterRequest,
+		encodeUnregisterResponse,
+		opts...,
+	)
+
+	listHandler := kithttp.NewServer(
+		makeListEndpoint(ws),
+		decodeListRequest,
+		encodeResponse,
+		opts...,
+	)
+
+	statusHandler := kithttp.NewServer(
+		makeStatusEndpoint(ws),
+		decodeStatusRequest,
+		encodeResponse,
+		opts...,
+	)
+
+	r := mux.NewRouter()
+	r.Handle("/admin/webhooks", listHandler).Methods("GET")
+	r.Handle("/admin/webhooks", registerHandler).Methods("POST")
+	r.Handle("/admin/webhooks/{id}", unregisterHandler).Methods("DELETE")
+	r.Handle("/admin/webhooks/{id}/status", statusHandler).Methods("GET")
+	return r
+}
+
+// decodeRegisterRequest decodes the subscription to register from the body
+func decodeRegisterRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	var req registerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, errs.ErrInvalidArgument.Wrap(err)
+	}
+	return &req, nil
+}
+
+// encodeRegisterResponse responds with 201 Created and the location of the new subscription
+func encodeRegisterResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	if e, ok := response.(errorer); ok && e.error() != nil {
+		encodeError(ctx, e.error(), w)
+		return nil
+	}
+
+	res := response.(registerResponse)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Location", "/admin/webhooks/"+res.Subscription.ID)
+	w.WriteHeader(http.StatusCreated)
+	return json.NewEncoder(w).Encode(res)
+}
+
+// decodeUnregisterRequest reads the subscription id from the path
+func decodeUnregisterRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return unregisterRequest{ID: mux.Vars(r)["id"]}, nil
+}
+
+// encodeUnregisterResponse responds with 204 No Content once the subscription is removed
+func encodeUnregisterResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	if e, ok := response.(errorer); ok && e.error() != nil {
+		encodeError(ctx, e.error(), w)
+		return nil
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// decodeListRequest returns an empty request because there are no params for this request
+func decodeListRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return listRequest{}, nil
+}
+
+// decodeStatusRequest reads the subscription id from the path
+func decodeStatusRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return statusRequest{ID: mux.Vars(r)["id"]}, nil
+}
+
+// encodeResponse encodes a response as JSON, or the error it carries as problem details
+func encodeResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	if e, ok := response.(errorer); ok && e.error() != nil {
+		encodeError(ctx, e.error(), w)
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return json.NewEncoder(w).Encode(response)
+}
+
+// encodeError renders err as RFC 7807 problem details
+func encodeError(ctx context.Context, err error, w http.ResponseWriter) {
+	errs.EncodeProblem(ctx, err, w)
+}
@@ -0,0 +1,88 @@
+// Webhooks package delivers domain events to HTTP callbacks registered by partner teams
+package webhooks
+
+import (
+	"time"
+
+	"github.com/bnelz/gokit-base/events"
+)
+
+// Subscription is a callback URL registered to receive events
+type Subscription struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+
+	// Types lists the event types delivered to the subscription, every type is delivered if it is empty
+	Types []events.Type `json:"events"`
+
+	// Secret signs every delivery, it is never returned to clients
+	Secret string `json:"-"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Wants reports whether events of type t are delivered to the subscription
+func (s *Subscription) Wants(t events.Type) bool {
+	if len(s.Types) == 0 {
+		return true
+	}
+	for _, st := range s.Types {
+		if st == t {
+			return true
+		}
+	}
+	return false
+}
+
+// DeliveryStatus summarizes the deliveries made to a subscription
+type DeliveryStatus struct {
+	// Delivered counts events the receiver accepted
+	Delivered int `json:"delivered"`
+
+	// FailedAttempts counts attempts the receiver did not accept, including those that were retried
+	FailedAttempts int `json:"failed_attempts"`
+
+	// DeadLettered counts events given up on after the last attempt
+	DeadLettered int `json:"dead_lettered"`
+
+	// Pending counts events queued or waiting to be retried
+	Pending int `json:"pending"`
+
+	LastAttemptAt  *time.Time `json:"last_attempt_at,omitempty"`
+	LastSuccessAt  *time.Time `json:"last_success_at,omitempty"`
+	LastStatusCode int        `json:"last_status_code,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+}
+
+// DeadLetter is an event that could not be delivered to a subscription
+type DeadLetter struct {
+	SubscriptionID string          `json:"subscription_id"`
+	Event          events.Envelope `json:"event"`
+	Attempts       int             `json:"attempts"`
+	LastError      string          `json:"last_error"`
+	FailedAt       time.Time       `json:"failed_at"`
+}
+
+// Repository is the set of behavior a store of webhook subscriptions must conform to
+type Repository interface {
+	// Insert a new subscription
+	Insert(s *Subscription) error
+
+	// Delete a subscription, failing with ErrWebhookNotFound if there is none with the ID
+	Delete(id string) error
+
+	// Find a subscription by ID
+	Find(id string) (*Subscription, error)
+
+	// FindAll returns every subscription
+	FindAll() []*Subscription
+}
+
+// DeadLetterQueue keeps the events that could not be delivered so they can be inspected
+type DeadLetterQueue interface {
+	// Push adds a dead letter to the queue
+	Push(d DeadLetter) error
+
+	// List returns the dead letters of a subscription, oldest first
+	List(subscriptionID string) []DeadLetter
+}